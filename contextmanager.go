@@ -2,6 +2,7 @@ package netdicom
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/grailbio/go-dicom"
 	"github.com/grailbio/go-dicom/dicomlog"
@@ -31,14 +32,61 @@ type contextManager struct {
 	contextIDToAbstractSyntaxNameMap map[byte]*contextManagerEntry
 	abstractSyntaxNameToContextIDMap map[string]*contextManagerEntry
 
+	// The maximum length of the P-DATA-TF PDUs that this side accepts.
+	// It is advertised in the A-ASSOCIATE-* pdu. 0 means unlimited.
+	maxPDUSize int
+
 	// Info about the the other side of the communication, gleaned from
-	// A-ASSOCIATE-* pdu.
+	// A-ASSOCIATE-* pdu. peerMaxPDUSize is 0 if the peer accepts PDUs of
+	// any length.
 	peerMaxPDUSize int
 	// UID that identifies the peer type. It's supposed to be globally unique.
 	peerImplementationClassUID string
 	// Implementation version, virtually meaningless since its format isn't standardiszed.
 	peerImplementationVersionName string
 
+	// AE titles of the association, with the space padding removed.
+	calledAETitle  string
+	callingAETitle string
+
+	// The asynchronous operations window, from the viewpoint of this side.
+	// It is {1, 1} unless the peers negotiate otherwise.
+	opsWindow AsyncOpsWindow
+	// Set on the provider side if the A_ASSOCIATE_AC must carry an
+	// AsynchronousOperationsWindowSubItem.
+	replyOpsWindow bool
+	// Set on the user side if the A_ASSOCIATE_RQ carried an
+	// AsynchronousOperationsWindowSubItem.
+	proposedOpsWindow bool
+
+	// Role selections proposed by the requestor. Used only on the provider
+	// side. AssociationPolicy may update them.
+	roleSelections []*RoleSelection
+	// SOP classes for which the requestor proposed role selections. Used
+	// only on the user side.
+	proposedRoles map[string]bool
+	// The roles of the requestor negotiated for each SOP class. Keys are
+	// SOP class UIDs. Classes not found here use the default roles.
+	roles map[string]RoleSelection
+
+	// The identity presented by the requestor. On the provider side, it is
+	// cleared unless ServiceProviderParams.Authenticate accepts it.
+	userIdentity *UserIdentity
+	// The server response to the user identity. On the provider side, the
+	// A_ASSOCIATE_AC carries it iff it is non-nil.
+	userIdentityResponse []byte
+
+	// Extended negotiations proposed by the requestor. Used only on the
+	// provider side. AssociationPolicy may set the responses.
+	extendedNegotiations       []*ExtendedNegotiation
+	commonExtendedNegotiations []*CommonExtendedNegotiation
+	// SOP classes for which the requestor proposed extended negotiations.
+	// Used only on the user side.
+	proposedExtendedNegotiations map[string]bool
+	// The extended negotiation information accepted by the acceptor. Keys
+	// are SOP class UIDs.
+	extendedNegotiationResponses map[string][]byte
+
 	// tmpRequests used only on the client (requestor) side. It holds the
 	// contextid->presentationcontext mapping generated from the
 	// A_ASSOCIATE_RQ PDU. Once an A_ASSOCIATE_AC PDU arrives, tmpRequests
@@ -47,34 +95,41 @@ type contextManager struct {
 	tmpRequests map[byte]*pdu.PresentationContextItem
 }
 
-// Create an empty contextManager
-func newContextManager(label string) *contextManager {
+// Create an empty contextManager. maxPDUSize is the PDU size to advertise to
+// the peer; 0 means unlimited.
+func newContextManager(label string, maxPDUSize int) *contextManager {
 	c := &contextManager{
-		label: label,
+		label:                            label,
+		maxPDUSize:                       maxPDUSize,
 		contextIDToAbstractSyntaxNameMap: make(map[byte]*contextManagerEntry),
 		abstractSyntaxNameToContextIDMap: make(map[string]*contextManagerEntry),
 		peerMaxPDUSize:                   16384, // The default value used by Osirix & pynetdicom.
+		opsWindow:                        defaultAsyncOpsWindow,
 		tmpRequests:                      make(map[byte]*pdu.PresentationContextItem),
+		proposedRoles:                    make(map[string]bool),
+		roles:                            make(map[string]RoleSelection),
+		extendedNegotiationResponses:     make(map[string][]byte),
+		proposedExtendedNegotiations:     make(map[string]bool),
 	}
 	return c
 }
 
 // Called by the user (client) to produce a list to be embedded in an
 // A_REQUEST_RQ.Items. The PDU is sent when running as a service user (client).
-// maxPDUSize is the maximum PDU size, in bytes, that the clients is willing to
-// receive. maxPDUSize is encoded in one of the items.
-func (m *contextManager) generateAssociateRequest(
-	sopClassUIDs []string, transferSyntaxUIDs []string) []pdu.SubItem {
+// m.maxPDUSize, the maximum PDU size that the clients is willing to
+// receive, is encoded in one of the items. The other items are produced from
+// "params".
+func (m *contextManager) generateAssociateRequest(params *ServiceUserParams) []pdu.SubItem {
 	items := []pdu.SubItem{
 		&pdu.ApplicationContextItem{
 			Name: pdu.DICOMApplicationContextItemName,
 		}}
 	var contextID byte = 1
-	for _, sop := range sopClassUIDs {
+	for _, sop := range params.SOPClasses {
 		syntaxItems := []pdu.SubItem{
 			&pdu.AbstractSyntaxSubItem{Name: sop},
 		}
-		for _, syntaxUID := range transferSyntaxUIDs {
+		for _, syntaxUID := range params.TransferSyntaxes {
 			syntaxItems = append(syntaxItems, &pdu.TransferSyntaxSubItem{Name: syntaxUID})
 		}
 		item := &pdu.PresentationContextItem{
@@ -87,24 +142,66 @@ func (m *contextManager) generateAssociateRequest(
 		m.tmpRequests[contextID] = item
 		contextID += 2 // must be odd.
 	}
-	items = append(items,
-		&pdu.UserInformationItem{
-			Items: []pdu.SubItem{
-				&pdu.UserInformationMaximumLengthItem{uint32(DefaultMaxPDUSize)},
-				&pdu.ImplementationClassUIDSubItem{dicom.GoDICOMImplementationClassUID},
-				&pdu.ImplementationVersionNameSubItem{dicom.GoDICOMImplementationVersionName}}})
-
+	// The sub-items are sorted by type. P3.7 D.3.3.
+	userItems := []pdu.SubItem{
+		&pdu.UserInformationMaximumLengthItem{uint32(m.maxPDUSize)},
+		&pdu.ImplementationClassUIDSubItem{dicom.GoDICOMImplementationClassUID}}
+	if w := params.AsyncOpsWindow; w != nil {
+		userItems = append(userItems, &pdu.AsynchronousOperationsWindowSubItem{
+			MaxOpsInvoked:   uint16(w.MaxOpsInvoked),
+			MaxOpsPerformed: uint16(w.MaxOpsPerformed),
+		})
+		m.proposedOpsWindow = true
+	}
+	// For each SOP class in SCPRoleSOPClasses, propose to take both the
+	// SCU and SCP roles.
+	for _, sop := range params.SCPRoleSOPClasses {
+		userItems = append(userItems, &pdu.RoleSelectionSubItem{
+			SOPClassUID: sop,
+			SCURole:     1,
+			SCPRole:     1,
+		})
+		m.proposedRoles[sop] = true
+	}
+	userItems = append(userItems, &pdu.ImplementationVersionNameSubItem{dicom.GoDICOMImplementationVersionName})
+	var extSOPClassUIDs []string
+	for sop := range params.ExtendedNegotiation {
+		extSOPClassUIDs = append(extSOPClassUIDs, sop)
+	}
+	sort.Strings(extSOPClassUIDs)
+	for _, sop := range extSOPClassUIDs {
+		userItems = append(userItems, &pdu.SOPClassExtendedNegotiationSubItem{
+			SOPClassUID:                        sop,
+			ServiceClassApplicationInformation: params.ExtendedNegotiation[sop],
+		})
+		m.proposedExtendedNegotiations[sop] = true
+	}
+	for _, c := range params.CommonExtendedNegotiation {
+		userItems = append(userItems, &pdu.SOPClassCommonExtendedNegotiationSubItem{
+			SOPClassUID:                c.SOPClassUID,
+			ServiceClassUID:            c.ServiceClassUID,
+			RelatedGeneralSOPClassUIDs: c.RelatedGeneralSOPClassUIDs,
+		})
+	}
+	if id := params.UserIdentity; id != nil {
+		userItems = append(userItems, &pdu.UserIdentitySubItem{
+			Type:                      id.Type,
+			PositiveResponseRequested: id.PositiveResponseRequested,
+			PrimaryField:              id.PrimaryField,
+			SecondaryField:            id.SecondaryField,
+		})
+	}
+	items = append(items, &pdu.UserInformationItem{Items: userItems})
 	return items
 }
 
-// Called when A_ASSOCIATE_RQ pdu arrives, on the provider side. Returns a list of items to be sent in
-// the A_ASSOCIATE_AC pdu.
-func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem) ([]pdu.SubItem, error) {
-	responses := []pdu.SubItem{
-		&pdu.ApplicationContextItem{
-			Name: pdu.DICOMApplicationContextItemName,
-		},
-	}
+// Called when A_ASSOCIATE_RQ pdu arrives, on the provider side. Returns the
+// list of presentation contexts proposed by the peer. Each context is
+// tentatively accepted using the transfer syntax chosen by the preferences in
+// "params", or rejected if none of them is proposed. The caller may override
+// the decision before passing the list to generateAssociateResponse.
+func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem, params *ServiceProviderParams) ([]*PresentationContext, error) {
+	var contexts []*PresentationContext
 	for _, requestItem := range requestItems {
 		switch ri := requestItem.(type) {
 		case *pdu.ApplicationContextItem:
@@ -113,39 +210,41 @@ func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem) ([]pdu.S
 					m.label, ri.Name, pdu.DICOMApplicationContextItemName)
 			}
 		case *pdu.PresentationContextItem:
-			var sopUID string
-			var pickedTransferSyntaxUID string
+			if ri.ContextID%2 != 1 {
+				return nil, fmt.Errorf("dicom.onAssociateRequest: Context ID must be odd: %v", ri.String())
+			}
+			pc := &PresentationContext{ContextID: ri.ContextID}
 			for _, subItem := range ri.Items {
 				switch c := subItem.(type) {
 				case *pdu.AbstractSyntaxSubItem:
-					if sopUID != "" {
+					if pc.AbstractSyntaxUID != "" {
 						return nil, fmt.Errorf("dicom.onAssociateRequest: Multiple AbstractSyntaxSubItem found in %v",
 							ri.String())
 					}
-					sopUID = c.Name
+					pc.AbstractSyntaxUID = c.Name
 				case *pdu.TransferSyntaxSubItem:
-					// Just pick the first syntax UID proposed by the client.
-					if pickedTransferSyntaxUID == "" {
-						pickedTransferSyntaxUID = c.Name
-					}
+					pc.TransferSyntaxUIDs = append(pc.TransferSyntaxUIDs, c.Name)
+				case *pdu.SubItemUnsupported:
+					dicomlog.Vprintf(1, "dicom.onAssociateRequest(%s): Ignoring %v in PresentationContext", m.label, c)
 				default:
 					return nil, fmt.Errorf("dicom.onAssociateRequest: Unknown subitem in PresentationContext: %s",
 						subItem.String())
 				}
 			}
-			if sopUID == "" || pickedTransferSyntaxUID == "" {
+			if pc.AbstractSyntaxUID == "" || len(pc.TransferSyntaxUIDs) == 0 {
 				return nil, fmt.Errorf("dicom.onAssociateRequest: SOP or transfersyntax not found in PresentationContext: %v",
 					ri.String())
 			}
-			responses = append(responses, &pdu.PresentationContextItem{
-				Type:      pdu.ItemTypePresentationContextResponse,
-				ContextID: ri.ContextID,
-				Result:    0, // accepted
-				Items:     []pdu.SubItem{&pdu.TransferSyntaxSubItem{Name: pickedTransferSyntaxUID}}})
-			dicomlog.Vprintf(2, "dicom.onAssociateRequest(%s): Provider(%p): addmapping %v %v %v",
-				m.label, m, sopUID, pickedTransferSyntaxUID, ri.ContextID)
-			// TODO(saito) Callback the service provider instead of accepting the sopclass blindly.
-			addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, pdu.PresentationContextAccepted)
+			preferred := params.TransferSyntaxes
+			if l, ok := params.SOPTransferSyntaxes[pc.AbstractSyntaxUID]; ok {
+				preferred = l
+			}
+			pickTransferSyntax(pc, preferred)
+			if pc.Result != pdu.PresentationContextAccepted {
+				dicomlog.Vprintf(0, "dicom.onAssociateRequest(%s): No acceptable transfer syntax for %v; proposed %v",
+					m.label, dicomuid.UIDString(pc.AbstractSyntaxUID), pc.TransferSyntaxUIDs)
+			}
+			contexts = append(contexts, pc)
 		case *pdu.UserInformationItem:
 			for _, subItem := range ri.Items {
 				switch c := subItem.(type) {
@@ -155,18 +254,148 @@ func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem) ([]pdu.S
 					m.peerImplementationClassUID = c.Name
 				case *pdu.ImplementationVersionNameSubItem:
 					m.peerImplementationVersionName = c.Name
-
+				case *pdu.AsynchronousOperationsWindowSubItem:
+					if params.AsyncOpsWindow != nil {
+						// The peer's invocations are performed by
+						// us, and vice versa.
+						m.opsWindow = AsyncOpsWindow{
+							MaxOpsInvoked:   minOpsWindow(int(c.MaxOpsPerformed), params.AsyncOpsWindow.MaxOpsInvoked),
+							MaxOpsPerformed: minOpsWindow(int(c.MaxOpsInvoked), params.AsyncOpsWindow.MaxOpsPerformed),
+						}
+						m.replyOpsWindow = true
+					}
+				case *pdu.RoleSelectionSubItem:
+					rs := RoleSelection{
+						SOPClassUID: c.SOPClassUID,
+						SCURole:     c.SCURole == 1,
+						SCPRole:     c.SCPRole == 1,
+					}
+					// Remember the proposal, so that the policy
+					// can't grant a role that wasn't proposed.
+					m.roles[rs.SOPClassUID] = rs
+					m.roleSelections = append(m.roleSelections, &rs)
+				case *pdu.SOPClassExtendedNegotiationSubItem:
+					m.extendedNegotiations = append(m.extendedNegotiations, &ExtendedNegotiation{
+						SOPClassUID: c.SOPClassUID,
+						Info:        c.ServiceClassApplicationInformation,
+					})
+				case *pdu.SOPClassCommonExtendedNegotiationSubItem:
+					m.commonExtendedNegotiations = append(m.commonExtendedNegotiations, &CommonExtendedNegotiation{
+						SOPClassUID:                c.SOPClassUID,
+						ServiceClassUID:            c.ServiceClassUID,
+						RelatedGeneralSOPClassUIDs: c.RelatedGeneralSOPClassUIDs,
+					})
+				case *pdu.UserIdentitySubItem:
+					m.userIdentity = &UserIdentity{
+						Type:                      c.Type,
+						PositiveResponseRequested: c.PositiveResponseRequested,
+						PrimaryField:              c.PrimaryField,
+						SecondaryField:            c.SecondaryField,
+					}
+				case *pdu.SubItemUnsupported:
+					dicomlog.Vprintf(1, "dicom.onAssociateRequest(%s): Ignoring %v in UserInformation", m.label, c)
 				}
 			}
+		case *pdu.SubItemUnsupported:
+			dicomlog.Vprintf(1, "dicom.onAssociateRequest(%s): Ignoring %v", m.label, ri)
 		}
 	}
-	responses = append(responses,
-		&pdu.UserInformationItem{
-			Items: []pdu.SubItem{&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(DefaultMaxPDUSize)}}})
 	dicomlog.Vprintf(1, "dicom.onAssociateRequest(%s): Received associate request, #contexts:%v, maxPDU:%v, implclass:%v, version:%v",
-		m.label, len(m.contextIDToAbstractSyntaxNameMap),
+		m.label, len(contexts),
 		m.peerMaxPDUSize, m.peerImplementationClassUID, m.peerImplementationVersionName)
-	return responses, nil
+	return contexts, nil
+}
+
+// Set pc.Result and pc.TransferSyntaxUID. "preferred" lists the transfer
+// syntaxes supported by the provider, the most preferred one first. If
+// "preferred" is empty, the first syntax proposed by the client is picked.
+func pickTransferSyntax(pc *PresentationContext, preferred []string) {
+	if len(preferred) == 0 {
+		pc.Result = pdu.PresentationContextAccepted
+		pc.TransferSyntaxUID = pc.TransferSyntaxUIDs[0]
+		return
+	}
+	for _, uid := range preferred {
+		if containsString(pc.TransferSyntaxUIDs, uid) {
+			pc.Result = pdu.PresentationContextAccepted
+			pc.TransferSyntaxUID = uid
+			return
+		}
+	}
+	pc.Result = pdu.PresentationContextProviderRejectionTransferSyntaxNotSupported
+	pc.TransferSyntaxUID = ""
+}
+
+// Called on the provider side once the A_ASSOCIATE_RQ is accepted. Records the
+// context mappings and returns a list of items to be sent in the
+// A_ASSOCIATE_AC pdu.
+func (m *contextManager) generateAssociateResponse(contexts []*PresentationContext) []pdu.SubItem {
+	responses := []pdu.SubItem{
+		&pdu.ApplicationContextItem{
+			Name: pdu.DICOMApplicationContextItemName,
+		},
+	}
+	for _, pc := range contexts {
+		if pc.Result > pdu.PresentationContextProviderRejectionTransferSyntaxNotSupported {
+			dicomlog.Vprintf(0, "dicom.generateAssociateResponse(%s): Invalid result %v for %v; rejecting the context",
+				m.label, pc.Result, dicomuid.UIDString(pc.AbstractSyntaxUID))
+			pc.Result = pdu.PresentationContextProviderRejectionNoReason
+		}
+		if pc.Result == pdu.PresentationContextAccepted && !containsString(pc.TransferSyntaxUIDs, pc.TransferSyntaxUID) {
+			dicomlog.Vprintf(0, "dicom.generateAssociateResponse(%s): Transfer syntax %v for %v was not proposed by the peer; rejecting the context",
+				m.label, dicomuid.UIDString(pc.TransferSyntaxUID), dicomuid.UIDString(pc.AbstractSyntaxUID))
+			pc.Result = pdu.PresentationContextProviderRejectionTransferSyntaxNotSupported
+		}
+		transferSyntaxUID := pc.TransferSyntaxUID
+		if pc.Result != pdu.PresentationContextAccepted {
+			// P3.8 9.3.3.2: the transfer syntax sub-item is not
+			// significant when the context is rejected, but it
+			// must be present.
+			transferSyntaxUID = pc.TransferSyntaxUIDs[0]
+		}
+		responses = append(responses, &pdu.PresentationContextItem{
+			Type:      pdu.ItemTypePresentationContextResponse,
+			ContextID: pc.ContextID,
+			Result:    pc.Result,
+			Items:     []pdu.SubItem{&pdu.TransferSyntaxSubItem{Name: transferSyntaxUID}}})
+		dicomlog.Vprintf(2, "dicom.generateAssociateResponse(%s): Provider(%p): addmapping %v %v %v %v",
+			m.label, m, pc.AbstractSyntaxUID, transferSyntaxUID, pc.ContextID, pc.Result)
+		addContextMapping(m, pc.AbstractSyntaxUID, transferSyntaxUID, pc.ContextID, pc.Result)
+	}
+	userItems := []pdu.SubItem{&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(m.maxPDUSize)}}
+	if m.replyOpsWindow {
+		// The values are from the viewpoint of the requestor. P3.7 D.3.3.3.
+		userItems = append(userItems, &pdu.AsynchronousOperationsWindowSubItem{
+			MaxOpsInvoked:   uint16(m.opsWindow.MaxOpsPerformed),
+			MaxOpsPerformed: uint16(m.opsWindow.MaxOpsInvoked),
+		})
+	}
+	for _, rs := range m.roleSelections {
+		proposed := m.roles[rs.SOPClassUID]
+		rs.SCURole = rs.SCURole && proposed.SCURole
+		rs.SCPRole = rs.SCPRole && proposed.SCPRole
+		m.roles[rs.SOPClassUID] = *rs
+		userItems = append(userItems, &pdu.RoleSelectionSubItem{
+			SOPClassUID: rs.SOPClassUID,
+			SCURole:     roleByte(rs.SCURole),
+			SCPRole:     roleByte(rs.SCPRole),
+		})
+	}
+	for _, ext := range m.extendedNegotiations {
+		if ext.Response == nil {
+			continue
+		}
+		m.extendedNegotiationResponses[ext.SOPClassUID] = ext.Response
+		userItems = append(userItems, &pdu.SOPClassExtendedNegotiationSubItem{
+			SOPClassUID:                        ext.SOPClassUID,
+			ServiceClassApplicationInformation: ext.Response,
+		})
+	}
+	if m.userIdentityResponse != nil {
+		userItems = append(userItems, &pdu.UserIdentityResponseSubItem{ServerResponse: m.userIdentityResponse})
+	}
+	responses = append(responses, &pdu.UserInformationItem{Items: userItems})
+	return responses
 }
 
 // Called by the user (client) to when A_ASSOCIATE_AC PDU arrives from the provider.
@@ -184,6 +413,8 @@ func (m *contextManager) onAssociateResponse(responses []pdu.SubItem) error {
 					} else {
 						return fmt.Errorf("Multiple syntax UIDs returned in A_ASSOCIATE_AC: %v", ri.String())
 					}
+				case *pdu.SubItemUnsupported:
+					dicomlog.Vprintf(1, "dicom.onAssociateResponse(%s): Ignoring %v in PresentationContext", m.label, c)
 				default:
 					return fmt.Errorf("Unknown subitem %s in PresentationContext: %s", subItem.String(), ri.String())
 				}
@@ -210,6 +441,12 @@ func (m *contextManager) onAssociateResponse(responses []pdu.SubItem) error {
 			if sopUID == "" {
 				return fmt.Errorf("dicom.onAssociateResponse(%s): The A-ASSOCIATE request lacks the abstract syntax item for tag %v (this shouldn't happen)", m.label, ri.ContextID)
 			}
+			if ri.Result > pdu.PresentationContextProviderRejectionTransferSyntaxNotSupported {
+				return fmt.Errorf("dicom.onAssociateResponse(%s): Invalid result in A_ASSOCIATE_AC: %v", m.label, ri.String())
+			}
+			if ri.Result == pdu.PresentationContextAccepted && pickedTransferSyntaxUID == "" {
+				return fmt.Errorf("dicom.onAssociateResponse(%s): No transfer syntax for accepted context in A_ASSOCIATE_AC: %v", m.label, ri.String())
+			}
 			if ri.Result != pdu.PresentationContextAccepted {
 				dicomlog.Vprintf(0, "dicom.onAssociateResponse(%s): Abstract syntax %v, transfer syntax %v was rejected by the server: %s", m.label, dicomuid.UIDString(sopUID), dicomuid.UIDString(pickedTransferSyntaxUID), ri.Result.String())
 			}
@@ -237,7 +474,38 @@ func (m *contextManager) onAssociateResponse(responses []pdu.SubItem) error {
 					m.peerImplementationClassUID = c.Name
 				case *pdu.ImplementationVersionNameSubItem:
 					m.peerImplementationVersionName = c.Name
-
+				case *pdu.AsynchronousOperationsWindowSubItem:
+					if !m.proposedOpsWindow {
+						dicomlog.Vprintf(0, "dicom.onAssociateResponse(%s): Ignoring unsolicited %v", m.label, c)
+						break
+					}
+					m.opsWindow = AsyncOpsWindow{
+						MaxOpsInvoked:   int(c.MaxOpsInvoked),
+						MaxOpsPerformed: int(c.MaxOpsPerformed),
+					}
+				case *pdu.RoleSelectionSubItem:
+					if !m.proposedRoles[c.SOPClassUID] {
+						dicomlog.Vprintf(0, "dicom.onAssociateResponse(%s): Ignoring unsolicited %v", m.label, c)
+						break
+					}
+					// We proposed both roles, so the peer can
+					// only narrow them down.
+					m.roles[c.SOPClassUID] = RoleSelection{
+						SOPClassUID: c.SOPClassUID,
+						SCURole:     c.SCURole == 1,
+						SCPRole:     c.SCPRole == 1,
+					}
+				case *pdu.SOPClassExtendedNegotiationSubItem:
+					// P3.7 D.3.3.5.
+					if !m.proposedExtendedNegotiations[c.SOPClassUID] {
+						dicomlog.Vprintf(0, "dicom.onAssociateResponse(%s): Ignoring unsolicited %v", m.label, c)
+						break
+					}
+					m.extendedNegotiationResponses[c.SOPClassUID] = c.ServiceClassApplicationInformation
+				case *pdu.UserIdentityResponseSubItem:
+					m.userIdentityResponse = c.ServerResponse
+				case *pdu.SubItemUnsupported:
+					dicomlog.Vprintf(1, "dicom.onAssociateResponse(%s): Ignoring %v in UserInformation", m.label, c)
 				}
 			}
 		}
@@ -249,6 +517,51 @@ func (m *contextManager) onAssociateResponse(responses []pdu.SubItem) error {
 	return nil
 }
 
+// AsyncOpsWindow is the asynchronous operations window of an association. It
+// bounds the number of DIMSE operations outstanding at a time. P3.7 D.3.3.3.
+type AsyncOpsWindow struct {
+	// MaxOpsInvoked is the number of operations that a side may invoke
+	// before receiving their final responses. Zero means unlimited.
+	MaxOpsInvoked int
+	// MaxOpsPerformed is the number of operations that a side may be asked
+	// to perform at a time. Zero means unlimited.
+	MaxOpsPerformed int
+}
+
+// The window used unless the peers negotiate another one. P3.7 D.3.3.3.
+var defaultAsyncOpsWindow = AsyncOpsWindow{MaxOpsInvoked: 1, MaxOpsPerformed: 1}
+
+// Check that the values of "w" fit in an AsynchronousOperationsWindowSubItem.
+func (w *AsyncOpsWindow) validate() error {
+	if w.MaxOpsInvoked < 0 || w.MaxOpsInvoked > 0xffff || w.MaxOpsPerformed < 0 || w.MaxOpsPerformed > 0xffff {
+		return fmt.Errorf("Invalid AsyncOpsWindow %+v; values must be in range [0, 65535]", *w)
+	}
+	return nil
+}
+
+// Return the smaller of the two window sizes, where zero means unlimited.
+func minOpsWindow(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// Return the roles of the requestor negotiated for the SOP class.
+func (m *contextManager) requestorRole(sopClassUID string) RoleSelection {
+	if rs, ok := m.roles[sopClassUID]; ok {
+		return rs
+	}
+	return RoleSelection{SOPClassUID: sopClassUID, SCURole: true}
+}
+
+func roleByte(v bool) byte {
+	if v {
+		return 1
+	}
+	return 0
+}
+
 // Add a mapping between a (global) UID and a (per-session) context ID.
 func addContextMapping(
 	m *contextManager,
@@ -272,6 +585,11 @@ func addContextMapping(
 		result:            result,
 	}
 	m.contextIDToAbstractSyntaxNameMap[contextID] = e
+	// The peer may propose the same abstract syntax in multiple contexts.
+	// Don't let a rejected one hide an accepted one.
+	if old, ok := m.abstractSyntaxNameToContextIDMap[abstractSyntaxUID]; ok && old.result == pdu.PresentationContextAccepted && result != pdu.PresentationContextAccepted {
+		return
+	}
 	m.abstractSyntaxNameToContextIDMap[abstractSyntaxUID] = e
 }
 
@@ -1,7 +1,9 @@
 package netdicom
 
 import (
+	"context"
 	"fmt"
+	"io"
 
 	"github.com/grailbio/go-dicom"
 	"github.com/grailbio/go-dicom/dicomio"
@@ -12,8 +14,9 @@ import (
 )
 
 // Helper function used by C-{STORE,GET,MOVE} to send a dataset using C-STORE
-// over an already-established association.
-func runCStoreOnAssociation(upcallCh chan upcallEvent, downcallCh chan stateEvent,
+// over an already-established association. Returns ctx.Err() if ctx expires
+// before the response arrives.
+func runCStoreOnAssociation(ctx context.Context, upcallCh chan upcallEvent, disp *serviceDispatcher,
 	cm *contextManager,
 	messageID dimse.MessageID,
 	ds *dicom.DataSet) error {
@@ -58,32 +61,150 @@ func runCStoreOnAssociation(upcallCh chan upcallEvent, downcallCh chan stateEven
 		dicomlog.Vprintf(0, "dicom.cstore(%s): body encoder failed: %v", cm.label, err)
 		return err
 	}
-	downcallCh <- stateEvent{
-		event: evt09,
-		dimsePayload: &stateEventDIMSEPayload{
-			abstractSyntaxName: sopClassUID,
-			command: &dimse.CStoreRq{
-				AffectedSOPClassUID:    sopClassUID,
-				MessageID:              messageID,
-				CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
-				AffectedSOPInstanceUID: sopInstanceUID,
-			},
-			data: bodyEncoder.Bytes(),
+	return runCStoreRequest(ctx, upcallCh, disp, cm, &stateEventDIMSEPayload{
+		abstractSyntaxName: sopClassUID,
+		command: &dimse.CStoreRq{
+			AffectedSOPClassUID:    sopClassUID,
+			MessageID:              messageID,
+			CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
+			AffectedSOPInstanceUID: sopInstanceUID,
 		},
+		data: bodyEncoder.Bytes(),
+	})
+}
+
+// Send the C-STORE request in "payload" and wait for the response. Returns
+// ctx.Err() if ctx expires before the response arrives.
+func runCStoreRequest(ctx context.Context, upcallCh chan upcallEvent, disp *serviceDispatcher,
+	cm *contextManager,
+	payload *stateEventDIMSEPayload) error {
+	disp.sendPayload(payload)
+	return waitForCStoreResponse(ctx, upcallCh, cm, payload.command.GetMessageID())
+}
+
+// The max number of data fragments of a streamed C-STORE request queued for
+// the statemachine.
+const cstoreStreamWindow = 2
+
+// Send the C-STORE request "command", reading its data from "r" in the
+// caller's goroutine, and wait for the response. At most cstoreStreamWindow
+// fragments of the data are buffered. Returns a *streamReadError if reading
+// fails, and ctx.Err() if ctx expires first. Unless the read failed before
+// anything was sent, the data sent so far is incomplete, so the caller must
+// abort the association.
+func runCStoreStream(ctx context.Context, upcallCh chan upcallEvent, disp *serviceDispatcher,
+	cm *contextManager,
+	command *dimse.CStoreRq,
+	r io.Reader) error {
+	maxChunkSize, err := maxPDUChunkSize(cm)
+	if err != nil {
+		return err
+	}
+	var sent bool
+	var readChunk = func() ([]byte, bool, error) {
+		// A new buffer each time, since the statemachine may still
+		// hold the previous ones.
+		chunk := make([]byte, maxChunkSize)
+		n, err := io.ReadFull(r, chunk)
+		switch err {
+		case nil:
+			return chunk, false, nil
+		case io.EOF, io.ErrUnexpectedEOF:
+			return chunk[:n], true, nil
+		default:
+			return nil, false, &streamReadError{err: err, sent: sent}
+		}
 	}
+	// Read the first chunk before sending anything, so that an empty or
+	// unreadable body doesn't start a request.
+	chunk, eof, err := readChunk()
+	if err != nil {
+		return err
+	}
+	if len(chunk) == 0 {
+		return fmt.Errorf("dicom.cstore(%s): Empty C-STORE data for %s", cm.label, dicomuid.UIDString(command.AffectedSOPClassUID))
+	}
+	window := make(chan struct{}, cstoreStreamWindow)
+	err = func() error {
+		// The fragments of a message can't be interleaved with other
+		// messages, so the lock is held, and other sends wait, until the
+		// last fragment is queued.
+		disp.sendMu.Lock()
+		defer disp.sendMu.Unlock()
+		disp.downcallCh <- stateEvent{event: evt09, dimsePayload: &stateEventDIMSEPayload{
+			abstractSyntaxName: command.AffectedSOPClassUID,
+			command:            command,
+			dataFollows:        true,
+		}}
+		sent = true
+		for {
+			var next []byte
+			last := eof
+			if !last {
+				// Read ahead, since the current chunk must be
+				// marked if nothing follows it.
+				next, eof, err = readChunk()
+				if err != nil {
+					return err
+				}
+				last = eof && len(next) == 0
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-disp.done:
+				return errConnectionClosed
+			}
+			disp.downcallCh <- stateEvent{event: evt09, dimsePayload: &stateEventDIMSEPayload{
+				abstractSyntaxName: command.AffectedSOPClassUID,
+				data:               chunk,
+				last:               last,
+				window:             window,
+			}}
+			if last {
+				return nil
+			}
+			chunk = next
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	return waitForCStoreResponse(ctx, upcallCh, cm, command.MessageID)
+}
+
+// Wait for the response to the C-STORE request "messageID". Returns ctx.Err()
+// if ctx expires before the response arrives.
+func waitForCStoreResponse(ctx context.Context, upcallCh chan upcallEvent,
+	cm *contextManager,
+	messageID dimse.MessageID) error {
 	for {
 		dicomlog.Vprintf(0, "dicom.cstore(%s): Start reading resp w/ messageID:%v", cm.label, messageID)
-		event, ok := <-upcallCh
+		var event upcallEvent
+		var ok bool
+		select {
+		case event, ok = <-upcallCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 		if !ok {
-			return fmt.Errorf("dicom.cstore(%s): Connection closed while waiting for C-STORE response", cm.label)
+			dicomlog.Vprintf(0, "dicom.cstore(%s): Connection closed while waiting for C-STORE response", cm.label)
+			return errConnectionClosed
 		}
 		dicomlog.Vprintf(1, "dicom.cstore(%s): resp event: %v", cm.label, event.command)
 		doassert(event.eventType == upcallEventData)
 		doassert(event.command != nil)
 		resp, ok := event.command.(*dimse.CStoreRsp)
-		doassert(ok) // TODO(saito)
+		if !ok {
+			return fmt.Errorf("dicom.cstore(%s): Found wrong response for C-STORE: %v", cm.label, event.command)
+		}
 		if resp.Status.Status != 0 {
-			return fmt.Errorf("dicom.cstore(%s): failed: %v", cm.label, resp.String())
+			dicomlog.Vprintf(0, "dicom.cstore(%s): failed: %v", cm.label, resp.String())
+			return &DIMSEError{Op: "C-STORE", Status: resp.Status}
 		}
 		return nil
 	}
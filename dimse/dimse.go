@@ -191,10 +191,24 @@ const (
 	CMoveOutOfResourcesUnableToPerformSubOperations     StatusCode = 0xa702
 	CMoveMoveDestinationUnknown                         StatusCode = 0xa801
 	CMoveDataSetDoesNotMatchSOPClass                    StatusCode = 0xa900
+	// Warning: some sub-operations failed. P3.4 C.4.2.1.5.
+	CMoveSubOperationsCompleteWithFailures StatusCode = 0xb000
+
+	// DIMSE-N status codes. P3.7 C.
+	StatusNoSuchAttribute       StatusCode = 0x0105
+	StatusProcessingFailure     StatusCode = 0x0110
+	StatusDuplicateSOPInstance  StatusCode = 0x0111
+	StatusNoSuchEventType       StatusCode = 0x0113
+	StatusNoSuchSOPClass        StatusCode = 0x0118
+	StatusClassInstanceConflict StatusCode = 0x0119
+	StatusMissingAttribute      StatusCode = 0x0120
+	StatusMissingAttributeValue StatusCode = 0x0121
+	StatusNoSuchActionType      StatusCode = 0x0123
 
 	// Warning codes.
-	StatusAttributeValueOutOfRange StatusCode = 0x0116
-	StatusAttributeListError       StatusCode = 0x0107
+	StatusOptionalAttributesNotSupported StatusCode = 0x0001
+	StatusAttributeValueOutOfRange       StatusCode = 0x0116
+	StatusAttributeListError             StatusCode = 0x0107
 )
 
 // ReadMessage constructs a typed dimse.Message object, given a set of
@@ -312,4 +326,9 @@ func (a *CommandAssembler) AddDataPDU(pdu *pdu.PDataTf) (byte, Message, []byte,
 	// TODO(saito) Verify that there's no unread items after the last command&data.
 }
 
+// Empty reports whether no fragment of the next message has been added yet.
+func (a *CommandAssembler) Empty() bool {
+	return a.contextID == 0 && len(a.commandBytes) == 0 && len(a.dataBytes) == 0
+}
+
 type MessageID = uint16
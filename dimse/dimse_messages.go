@@ -550,6 +550,697 @@ func decodeCEchoRsp(d *messageDecoder) *CEchoRsp {
 	return v
 }
 
+type CCancelRq struct {
+	MessageIDBeingRespondedTo MessageID
+	CommandDataSetType        uint16
+	Extra                     []*dicom.Element // Unparsed elements
+}
+
+func (v *CCancelRq) Encode(e *dicomio.Encoder) {
+	elems := []*dicom.Element{}
+	elems = append(elems, newElement(dicomtag.CommandField, uint16(4095)))
+	elems = append(elems, newElement(dicomtag.MessageIDBeingRespondedTo, v.MessageIDBeingRespondedTo))
+	elems = append(elems, newElement(dicomtag.CommandDataSetType, v.CommandDataSetType))
+	elems = append(elems, v.Extra...)
+	encodeElements(e, elems)
+}
+
+func (v *CCancelRq) HasData() bool {
+	return v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v *CCancelRq) CommandField() int {
+	return 4095
+}
+
+func (v *CCancelRq) GetMessageID() MessageID {
+	return v.MessageIDBeingRespondedTo
+}
+
+func (v *CCancelRq) GetStatus() *Status {
+	return nil
+}
+
+func (v *CCancelRq) String() string {
+	return fmt.Sprintf("CCancelRq{MessageIDBeingRespondedTo:%v CommandDataSetType:%v}}", v.MessageIDBeingRespondedTo, v.CommandDataSetType)
+}
+
+func decodeCCancelRq(d *messageDecoder) *CCancelRq {
+	v := &CCancelRq{}
+	v.MessageIDBeingRespondedTo = d.getUInt16(dicomtag.MessageIDBeingRespondedTo, requiredElement)
+	v.CommandDataSetType = d.getUInt16(dicomtag.CommandDataSetType, requiredElement)
+	v.Extra = d.unparsedElements()
+	return v
+}
+
+type NEventReportRq struct {
+	AffectedSOPClassUID    string
+	MessageID              MessageID
+	CommandDataSetType     uint16
+	AffectedSOPInstanceUID string
+	EventTypeID            uint16
+	Extra                  []*dicom.Element // Unparsed elements
+}
+
+func (v *NEventReportRq) Encode(e *dicomio.Encoder) {
+	elems := []*dicom.Element{}
+	elems = append(elems, newElement(dicomtag.CommandField, uint16(256)))
+	elems = append(elems, newElement(dicomtag.AffectedSOPClassUID, v.AffectedSOPClassUID))
+	elems = append(elems, newElement(dicomtag.MessageID, v.MessageID))
+	elems = append(elems, newElement(dicomtag.CommandDataSetType, v.CommandDataSetType))
+	elems = append(elems, newElement(dicomtag.AffectedSOPInstanceUID, v.AffectedSOPInstanceUID))
+	elems = append(elems, newElement(dicomtag.EventTypeID, v.EventTypeID))
+	elems = append(elems, v.Extra...)
+	encodeElements(e, elems)
+}
+
+func (v *NEventReportRq) HasData() bool {
+	return v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v *NEventReportRq) CommandField() int {
+	return 256
+}
+
+func (v *NEventReportRq) GetMessageID() MessageID {
+	return v.MessageID
+}
+
+func (v *NEventReportRq) GetStatus() *Status {
+	return nil
+}
+
+func (v *NEventReportRq) String() string {
+	return fmt.Sprintf("NEventReportRq{AffectedSOPClassUID:%v MessageID:%v CommandDataSetType:%v AffectedSOPInstanceUID:%v EventTypeID:%v}}", v.AffectedSOPClassUID, v.MessageID, v.CommandDataSetType, v.AffectedSOPInstanceUID, v.EventTypeID)
+}
+
+func decodeNEventReportRq(d *messageDecoder) *NEventReportRq {
+	v := &NEventReportRq{}
+	v.AffectedSOPClassUID = d.getString(dicomtag.AffectedSOPClassUID, requiredElement)
+	v.MessageID = d.getUInt16(dicomtag.MessageID, requiredElement)
+	v.CommandDataSetType = d.getUInt16(dicomtag.CommandDataSetType, requiredElement)
+	v.AffectedSOPInstanceUID = d.getString(dicomtag.AffectedSOPInstanceUID, requiredElement)
+	v.EventTypeID = d.getUInt16(dicomtag.EventTypeID, requiredElement)
+	v.Extra = d.unparsedElements()
+	return v
+}
+
+type NEventReportRsp struct {
+	AffectedSOPClassUID       string
+	MessageIDBeingRespondedTo MessageID
+	CommandDataSetType        uint16
+	AffectedSOPInstanceUID    string
+	EventTypeID               uint16
+	Status                    Status
+	Extra                     []*dicom.Element // Unparsed elements
+}
+
+func (v *NEventReportRsp) Encode(e *dicomio.Encoder) {
+	elems := []*dicom.Element{}
+	elems = append(elems, newElement(dicomtag.CommandField, uint16(33024)))
+	if v.AffectedSOPClassUID != "" {
+		elems = append(elems, newElement(dicomtag.AffectedSOPClassUID, v.AffectedSOPClassUID))
+	}
+	elems = append(elems, newElement(dicomtag.MessageIDBeingRespondedTo, v.MessageIDBeingRespondedTo))
+	elems = append(elems, newElement(dicomtag.CommandDataSetType, v.CommandDataSetType))
+	if v.AffectedSOPInstanceUID != "" {
+		elems = append(elems, newElement(dicomtag.AffectedSOPInstanceUID, v.AffectedSOPInstanceUID))
+	}
+	if v.EventTypeID != 0 {
+		elems = append(elems, newElement(dicomtag.EventTypeID, v.EventTypeID))
+	}
+	elems = append(elems, newStatusElements(v.Status)...)
+	elems = append(elems, v.Extra...)
+	encodeElements(e, elems)
+}
+
+func (v *NEventReportRsp) HasData() bool {
+	return v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v *NEventReportRsp) CommandField() int {
+	return 33024
+}
+
+func (v *NEventReportRsp) GetMessageID() MessageID {
+	return v.MessageIDBeingRespondedTo
+}
+
+func (v *NEventReportRsp) GetStatus() *Status {
+	return &v.Status
+}
+
+func (v *NEventReportRsp) String() string {
+	return fmt.Sprintf("NEventReportRsp{AffectedSOPClassUID:%v MessageIDBeingRespondedTo:%v CommandDataSetType:%v AffectedSOPInstanceUID:%v EventTypeID:%v Status:%v}}", v.AffectedSOPClassUID, v.MessageIDBeingRespondedTo, v.CommandDataSetType, v.AffectedSOPInstanceUID, v.EventTypeID, v.Status)
+}
+
+func decodeNEventReportRsp(d *messageDecoder) *NEventReportRsp {
+	v := &NEventReportRsp{}
+	v.AffectedSOPClassUID = d.getString(dicomtag.AffectedSOPClassUID, optionalElement)
+	v.MessageIDBeingRespondedTo = d.getUInt16(dicomtag.MessageIDBeingRespondedTo, requiredElement)
+	v.CommandDataSetType = d.getUInt16(dicomtag.CommandDataSetType, requiredElement)
+	v.AffectedSOPInstanceUID = d.getString(dicomtag.AffectedSOPInstanceUID, optionalElement)
+	v.EventTypeID = d.getUInt16(dicomtag.EventTypeID, optionalElement)
+	v.Status = d.getStatus()
+	v.Extra = d.unparsedElements()
+	return v
+}
+
+type NGetRq struct {
+	RequestedSOPClassUID    string
+	MessageID               MessageID
+	CommandDataSetType      uint16
+	RequestedSOPInstanceUID string
+	Extra                   []*dicom.Element // Unparsed elements
+}
+
+func (v *NGetRq) Encode(e *dicomio.Encoder) {
+	elems := []*dicom.Element{}
+	elems = append(elems, newElement(dicomtag.CommandField, uint16(272)))
+	elems = append(elems, newElement(dicomtag.RequestedSOPClassUID, v.RequestedSOPClassUID))
+	elems = append(elems, newElement(dicomtag.MessageID, v.MessageID))
+	elems = append(elems, newElement(dicomtag.CommandDataSetType, v.CommandDataSetType))
+	elems = append(elems, newElement(dicomtag.RequestedSOPInstanceUID, v.RequestedSOPInstanceUID))
+	elems = append(elems, v.Extra...)
+	encodeElements(e, elems)
+}
+
+func (v *NGetRq) HasData() bool {
+	return v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v *NGetRq) CommandField() int {
+	return 272
+}
+
+func (v *NGetRq) GetMessageID() MessageID {
+	return v.MessageID
+}
+
+func (v *NGetRq) GetStatus() *Status {
+	return nil
+}
+
+func (v *NGetRq) String() string {
+	return fmt.Sprintf("NGetRq{RequestedSOPClassUID:%v MessageID:%v CommandDataSetType:%v RequestedSOPInstanceUID:%v}}", v.RequestedSOPClassUID, v.MessageID, v.CommandDataSetType, v.RequestedSOPInstanceUID)
+}
+
+func decodeNGetRq(d *messageDecoder) *NGetRq {
+	v := &NGetRq{}
+	v.RequestedSOPClassUID = d.getString(dicomtag.RequestedSOPClassUID, requiredElement)
+	v.MessageID = d.getUInt16(dicomtag.MessageID, requiredElement)
+	v.CommandDataSetType = d.getUInt16(dicomtag.CommandDataSetType, requiredElement)
+	v.RequestedSOPInstanceUID = d.getString(dicomtag.RequestedSOPInstanceUID, requiredElement)
+	v.Extra = d.unparsedElements()
+	return v
+}
+
+type NGetRsp struct {
+	AffectedSOPClassUID       string
+	MessageIDBeingRespondedTo MessageID
+	CommandDataSetType        uint16
+	AffectedSOPInstanceUID    string
+	Status                    Status
+	Extra                     []*dicom.Element // Unparsed elements
+}
+
+func (v *NGetRsp) Encode(e *dicomio.Encoder) {
+	elems := []*dicom.Element{}
+	elems = append(elems, newElement(dicomtag.CommandField, uint16(33040)))
+	if v.AffectedSOPClassUID != "" {
+		elems = append(elems, newElement(dicomtag.AffectedSOPClassUID, v.AffectedSOPClassUID))
+	}
+	elems = append(elems, newElement(dicomtag.MessageIDBeingRespondedTo, v.MessageIDBeingRespondedTo))
+	elems = append(elems, newElement(dicomtag.CommandDataSetType, v.CommandDataSetType))
+	if v.AffectedSOPInstanceUID != "" {
+		elems = append(elems, newElement(dicomtag.AffectedSOPInstanceUID, v.AffectedSOPInstanceUID))
+	}
+	elems = append(elems, newStatusElements(v.Status)...)
+	elems = append(elems, v.Extra...)
+	encodeElements(e, elems)
+}
+
+func (v *NGetRsp) HasData() bool {
+	return v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v *NGetRsp) CommandField() int {
+	return 33040
+}
+
+func (v *NGetRsp) GetMessageID() MessageID {
+	return v.MessageIDBeingRespondedTo
+}
+
+func (v *NGetRsp) GetStatus() *Status {
+	return &v.Status
+}
+
+func (v *NGetRsp) String() string {
+	return fmt.Sprintf("NGetRsp{AffectedSOPClassUID:%v MessageIDBeingRespondedTo:%v CommandDataSetType:%v AffectedSOPInstanceUID:%v Status:%v}}", v.AffectedSOPClassUID, v.MessageIDBeingRespondedTo, v.CommandDataSetType, v.AffectedSOPInstanceUID, v.Status)
+}
+
+func decodeNGetRsp(d *messageDecoder) *NGetRsp {
+	v := &NGetRsp{}
+	v.AffectedSOPClassUID = d.getString(dicomtag.AffectedSOPClassUID, optionalElement)
+	v.MessageIDBeingRespondedTo = d.getUInt16(dicomtag.MessageIDBeingRespondedTo, requiredElement)
+	v.CommandDataSetType = d.getUInt16(dicomtag.CommandDataSetType, requiredElement)
+	v.AffectedSOPInstanceUID = d.getString(dicomtag.AffectedSOPInstanceUID, optionalElement)
+	v.Status = d.getStatus()
+	v.Extra = d.unparsedElements()
+	return v
+}
+
+type NSetRq struct {
+	RequestedSOPClassUID    string
+	MessageID               MessageID
+	CommandDataSetType      uint16
+	RequestedSOPInstanceUID string
+	Extra                   []*dicom.Element // Unparsed elements
+}
+
+func (v *NSetRq) Encode(e *dicomio.Encoder) {
+	elems := []*dicom.Element{}
+	elems = append(elems, newElement(dicomtag.CommandField, uint16(288)))
+	elems = append(elems, newElement(dicomtag.RequestedSOPClassUID, v.RequestedSOPClassUID))
+	elems = append(elems, newElement(dicomtag.MessageID, v.MessageID))
+	elems = append(elems, newElement(dicomtag.CommandDataSetType, v.CommandDataSetType))
+	elems = append(elems, newElement(dicomtag.RequestedSOPInstanceUID, v.RequestedSOPInstanceUID))
+	elems = append(elems, v.Extra...)
+	encodeElements(e, elems)
+}
+
+func (v *NSetRq) HasData() bool {
+	return v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v *NSetRq) CommandField() int {
+	return 288
+}
+
+func (v *NSetRq) GetMessageID() MessageID {
+	return v.MessageID
+}
+
+func (v *NSetRq) GetStatus() *Status {
+	return nil
+}
+
+func (v *NSetRq) String() string {
+	return fmt.Sprintf("NSetRq{RequestedSOPClassUID:%v MessageID:%v CommandDataSetType:%v RequestedSOPInstanceUID:%v}}", v.RequestedSOPClassUID, v.MessageID, v.CommandDataSetType, v.RequestedSOPInstanceUID)
+}
+
+func decodeNSetRq(d *messageDecoder) *NSetRq {
+	v := &NSetRq{}
+	v.RequestedSOPClassUID = d.getString(dicomtag.RequestedSOPClassUID, requiredElement)
+	v.MessageID = d.getUInt16(dicomtag.MessageID, requiredElement)
+	v.CommandDataSetType = d.getUInt16(dicomtag.CommandDataSetType, requiredElement)
+	v.RequestedSOPInstanceUID = d.getString(dicomtag.RequestedSOPInstanceUID, requiredElement)
+	v.Extra = d.unparsedElements()
+	return v
+}
+
+type NSetRsp struct {
+	AffectedSOPClassUID       string
+	MessageIDBeingRespondedTo MessageID
+	CommandDataSetType        uint16
+	AffectedSOPInstanceUID    string
+	Status                    Status
+	Extra                     []*dicom.Element // Unparsed elements
+}
+
+func (v *NSetRsp) Encode(e *dicomio.Encoder) {
+	elems := []*dicom.Element{}
+	elems = append(elems, newElement(dicomtag.CommandField, uint16(33056)))
+	if v.AffectedSOPClassUID != "" {
+		elems = append(elems, newElement(dicomtag.AffectedSOPClassUID, v.AffectedSOPClassUID))
+	}
+	elems = append(elems, newElement(dicomtag.MessageIDBeingRespondedTo, v.MessageIDBeingRespondedTo))
+	elems = append(elems, newElement(dicomtag.CommandDataSetType, v.CommandDataSetType))
+	if v.AffectedSOPInstanceUID != "" {
+		elems = append(elems, newElement(dicomtag.AffectedSOPInstanceUID, v.AffectedSOPInstanceUID))
+	}
+	elems = append(elems, newStatusElements(v.Status)...)
+	elems = append(elems, v.Extra...)
+	encodeElements(e, elems)
+}
+
+func (v *NSetRsp) HasData() bool {
+	return v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v *NSetRsp) CommandField() int {
+	return 33056
+}
+
+func (v *NSetRsp) GetMessageID() MessageID {
+	return v.MessageIDBeingRespondedTo
+}
+
+func (v *NSetRsp) GetStatus() *Status {
+	return &v.Status
+}
+
+func (v *NSetRsp) String() string {
+	return fmt.Sprintf("NSetRsp{AffectedSOPClassUID:%v MessageIDBeingRespondedTo:%v CommandDataSetType:%v AffectedSOPInstanceUID:%v Status:%v}}", v.AffectedSOPClassUID, v.MessageIDBeingRespondedTo, v.CommandDataSetType, v.AffectedSOPInstanceUID, v.Status)
+}
+
+func decodeNSetRsp(d *messageDecoder) *NSetRsp {
+	v := &NSetRsp{}
+	v.AffectedSOPClassUID = d.getString(dicomtag.AffectedSOPClassUID, optionalElement)
+	v.MessageIDBeingRespondedTo = d.getUInt16(dicomtag.MessageIDBeingRespondedTo, requiredElement)
+	v.CommandDataSetType = d.getUInt16(dicomtag.CommandDataSetType, requiredElement)
+	v.AffectedSOPInstanceUID = d.getString(dicomtag.AffectedSOPInstanceUID, optionalElement)
+	v.Status = d.getStatus()
+	v.Extra = d.unparsedElements()
+	return v
+}
+
+type NActionRq struct {
+	RequestedSOPClassUID    string
+	MessageID               MessageID
+	CommandDataSetType      uint16
+	RequestedSOPInstanceUID string
+	ActionTypeID            uint16
+	Extra                   []*dicom.Element // Unparsed elements
+}
+
+func (v *NActionRq) Encode(e *dicomio.Encoder) {
+	elems := []*dicom.Element{}
+	elems = append(elems, newElement(dicomtag.CommandField, uint16(304)))
+	elems = append(elems, newElement(dicomtag.RequestedSOPClassUID, v.RequestedSOPClassUID))
+	elems = append(elems, newElement(dicomtag.MessageID, v.MessageID))
+	elems = append(elems, newElement(dicomtag.CommandDataSetType, v.CommandDataSetType))
+	elems = append(elems, newElement(dicomtag.RequestedSOPInstanceUID, v.RequestedSOPInstanceUID))
+	elems = append(elems, newElement(dicomtag.ActionTypeID, v.ActionTypeID))
+	elems = append(elems, v.Extra...)
+	encodeElements(e, elems)
+}
+
+func (v *NActionRq) HasData() bool {
+	return v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v *NActionRq) CommandField() int {
+	return 304
+}
+
+func (v *NActionRq) GetMessageID() MessageID {
+	return v.MessageID
+}
+
+func (v *NActionRq) GetStatus() *Status {
+	return nil
+}
+
+func (v *NActionRq) String() string {
+	return fmt.Sprintf("NActionRq{RequestedSOPClassUID:%v MessageID:%v CommandDataSetType:%v RequestedSOPInstanceUID:%v ActionTypeID:%v}}", v.RequestedSOPClassUID, v.MessageID, v.CommandDataSetType, v.RequestedSOPInstanceUID, v.ActionTypeID)
+}
+
+func decodeNActionRq(d *messageDecoder) *NActionRq {
+	v := &NActionRq{}
+	v.RequestedSOPClassUID = d.getString(dicomtag.RequestedSOPClassUID, requiredElement)
+	v.MessageID = d.getUInt16(dicomtag.MessageID, requiredElement)
+	v.CommandDataSetType = d.getUInt16(dicomtag.CommandDataSetType, requiredElement)
+	v.RequestedSOPInstanceUID = d.getString(dicomtag.RequestedSOPInstanceUID, requiredElement)
+	v.ActionTypeID = d.getUInt16(dicomtag.ActionTypeID, requiredElement)
+	v.Extra = d.unparsedElements()
+	return v
+}
+
+type NActionRsp struct {
+	AffectedSOPClassUID       string
+	MessageIDBeingRespondedTo MessageID
+	CommandDataSetType        uint16
+	AffectedSOPInstanceUID    string
+	ActionTypeID              uint16
+	Status                    Status
+	Extra                     []*dicom.Element // Unparsed elements
+}
+
+func (v *NActionRsp) Encode(e *dicomio.Encoder) {
+	elems := []*dicom.Element{}
+	elems = append(elems, newElement(dicomtag.CommandField, uint16(33072)))
+	if v.AffectedSOPClassUID != "" {
+		elems = append(elems, newElement(dicomtag.AffectedSOPClassUID, v.AffectedSOPClassUID))
+	}
+	elems = append(elems, newElement(dicomtag.MessageIDBeingRespondedTo, v.MessageIDBeingRespondedTo))
+	elems = append(elems, newElement(dicomtag.CommandDataSetType, v.CommandDataSetType))
+	if v.AffectedSOPInstanceUID != "" {
+		elems = append(elems, newElement(dicomtag.AffectedSOPInstanceUID, v.AffectedSOPInstanceUID))
+	}
+	if v.ActionTypeID != 0 {
+		elems = append(elems, newElement(dicomtag.ActionTypeID, v.ActionTypeID))
+	}
+	elems = append(elems, newStatusElements(v.Status)...)
+	elems = append(elems, v.Extra...)
+	encodeElements(e, elems)
+}
+
+func (v *NActionRsp) HasData() bool {
+	return v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v *NActionRsp) CommandField() int {
+	return 33072
+}
+
+func (v *NActionRsp) GetMessageID() MessageID {
+	return v.MessageIDBeingRespondedTo
+}
+
+func (v *NActionRsp) GetStatus() *Status {
+	return &v.Status
+}
+
+func (v *NActionRsp) String() string {
+	return fmt.Sprintf("NActionRsp{AffectedSOPClassUID:%v MessageIDBeingRespondedTo:%v CommandDataSetType:%v AffectedSOPInstanceUID:%v ActionTypeID:%v Status:%v}}", v.AffectedSOPClassUID, v.MessageIDBeingRespondedTo, v.CommandDataSetType, v.AffectedSOPInstanceUID, v.ActionTypeID, v.Status)
+}
+
+func decodeNActionRsp(d *messageDecoder) *NActionRsp {
+	v := &NActionRsp{}
+	v.AffectedSOPClassUID = d.getString(dicomtag.AffectedSOPClassUID, optionalElement)
+	v.MessageIDBeingRespondedTo = d.getUInt16(dicomtag.MessageIDBeingRespondedTo, requiredElement)
+	v.CommandDataSetType = d.getUInt16(dicomtag.CommandDataSetType, requiredElement)
+	v.AffectedSOPInstanceUID = d.getString(dicomtag.AffectedSOPInstanceUID, optionalElement)
+	v.ActionTypeID = d.getUInt16(dicomtag.ActionTypeID, optionalElement)
+	v.Status = d.getStatus()
+	v.Extra = d.unparsedElements()
+	return v
+}
+
+type NCreateRq struct {
+	AffectedSOPClassUID    string
+	MessageID              MessageID
+	CommandDataSetType     uint16
+	AffectedSOPInstanceUID string
+	Extra                  []*dicom.Element // Unparsed elements
+}
+
+func (v *NCreateRq) Encode(e *dicomio.Encoder) {
+	elems := []*dicom.Element{}
+	elems = append(elems, newElement(dicomtag.CommandField, uint16(320)))
+	elems = append(elems, newElement(dicomtag.AffectedSOPClassUID, v.AffectedSOPClassUID))
+	elems = append(elems, newElement(dicomtag.MessageID, v.MessageID))
+	elems = append(elems, newElement(dicomtag.CommandDataSetType, v.CommandDataSetType))
+	if v.AffectedSOPInstanceUID != "" {
+		elems = append(elems, newElement(dicomtag.AffectedSOPInstanceUID, v.AffectedSOPInstanceUID))
+	}
+	elems = append(elems, v.Extra...)
+	encodeElements(e, elems)
+}
+
+func (v *NCreateRq) HasData() bool {
+	return v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v *NCreateRq) CommandField() int {
+	return 320
+}
+
+func (v *NCreateRq) GetMessageID() MessageID {
+	return v.MessageID
+}
+
+func (v *NCreateRq) GetStatus() *Status {
+	return nil
+}
+
+func (v *NCreateRq) String() string {
+	return fmt.Sprintf("NCreateRq{AffectedSOPClassUID:%v MessageID:%v CommandDataSetType:%v AffectedSOPInstanceUID:%v}}", v.AffectedSOPClassUID, v.MessageID, v.CommandDataSetType, v.AffectedSOPInstanceUID)
+}
+
+func decodeNCreateRq(d *messageDecoder) *NCreateRq {
+	v := &NCreateRq{}
+	v.AffectedSOPClassUID = d.getString(dicomtag.AffectedSOPClassUID, requiredElement)
+	v.MessageID = d.getUInt16(dicomtag.MessageID, requiredElement)
+	v.CommandDataSetType = d.getUInt16(dicomtag.CommandDataSetType, requiredElement)
+	v.AffectedSOPInstanceUID = d.getString(dicomtag.AffectedSOPInstanceUID, optionalElement)
+	v.Extra = d.unparsedElements()
+	return v
+}
+
+type NCreateRsp struct {
+	AffectedSOPClassUID       string
+	MessageIDBeingRespondedTo MessageID
+	CommandDataSetType        uint16
+	AffectedSOPInstanceUID    string
+	Status                    Status
+	Extra                     []*dicom.Element // Unparsed elements
+}
+
+func (v *NCreateRsp) Encode(e *dicomio.Encoder) {
+	elems := []*dicom.Element{}
+	elems = append(elems, newElement(dicomtag.CommandField, uint16(33088)))
+	if v.AffectedSOPClassUID != "" {
+		elems = append(elems, newElement(dicomtag.AffectedSOPClassUID, v.AffectedSOPClassUID))
+	}
+	elems = append(elems, newElement(dicomtag.MessageIDBeingRespondedTo, v.MessageIDBeingRespondedTo))
+	elems = append(elems, newElement(dicomtag.CommandDataSetType, v.CommandDataSetType))
+	if v.AffectedSOPInstanceUID != "" {
+		elems = append(elems, newElement(dicomtag.AffectedSOPInstanceUID, v.AffectedSOPInstanceUID))
+	}
+	elems = append(elems, newStatusElements(v.Status)...)
+	elems = append(elems, v.Extra...)
+	encodeElements(e, elems)
+}
+
+func (v *NCreateRsp) HasData() bool {
+	return v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v *NCreateRsp) CommandField() int {
+	return 33088
+}
+
+func (v *NCreateRsp) GetMessageID() MessageID {
+	return v.MessageIDBeingRespondedTo
+}
+
+func (v *NCreateRsp) GetStatus() *Status {
+	return &v.Status
+}
+
+func (v *NCreateRsp) String() string {
+	return fmt.Sprintf("NCreateRsp{AffectedSOPClassUID:%v MessageIDBeingRespondedTo:%v CommandDataSetType:%v AffectedSOPInstanceUID:%v Status:%v}}", v.AffectedSOPClassUID, v.MessageIDBeingRespondedTo, v.CommandDataSetType, v.AffectedSOPInstanceUID, v.Status)
+}
+
+func decodeNCreateRsp(d *messageDecoder) *NCreateRsp {
+	v := &NCreateRsp{}
+	v.AffectedSOPClassUID = d.getString(dicomtag.AffectedSOPClassUID, optionalElement)
+	v.MessageIDBeingRespondedTo = d.getUInt16(dicomtag.MessageIDBeingRespondedTo, requiredElement)
+	v.CommandDataSetType = d.getUInt16(dicomtag.CommandDataSetType, requiredElement)
+	v.AffectedSOPInstanceUID = d.getString(dicomtag.AffectedSOPInstanceUID, optionalElement)
+	v.Status = d.getStatus()
+	v.Extra = d.unparsedElements()
+	return v
+}
+
+type NDeleteRq struct {
+	RequestedSOPClassUID    string
+	MessageID               MessageID
+	CommandDataSetType      uint16
+	RequestedSOPInstanceUID string
+	Extra                   []*dicom.Element // Unparsed elements
+}
+
+func (v *NDeleteRq) Encode(e *dicomio.Encoder) {
+	elems := []*dicom.Element{}
+	elems = append(elems, newElement(dicomtag.CommandField, uint16(336)))
+	elems = append(elems, newElement(dicomtag.RequestedSOPClassUID, v.RequestedSOPClassUID))
+	elems = append(elems, newElement(dicomtag.MessageID, v.MessageID))
+	elems = append(elems, newElement(dicomtag.CommandDataSetType, v.CommandDataSetType))
+	elems = append(elems, newElement(dicomtag.RequestedSOPInstanceUID, v.RequestedSOPInstanceUID))
+	elems = append(elems, v.Extra...)
+	encodeElements(e, elems)
+}
+
+func (v *NDeleteRq) HasData() bool {
+	return v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v *NDeleteRq) CommandField() int {
+	return 336
+}
+
+func (v *NDeleteRq) GetMessageID() MessageID {
+	return v.MessageID
+}
+
+func (v *NDeleteRq) GetStatus() *Status {
+	return nil
+}
+
+func (v *NDeleteRq) String() string {
+	return fmt.Sprintf("NDeleteRq{RequestedSOPClassUID:%v MessageID:%v CommandDataSetType:%v RequestedSOPInstanceUID:%v}}", v.RequestedSOPClassUID, v.MessageID, v.CommandDataSetType, v.RequestedSOPInstanceUID)
+}
+
+func decodeNDeleteRq(d *messageDecoder) *NDeleteRq {
+	v := &NDeleteRq{}
+	v.RequestedSOPClassUID = d.getString(dicomtag.RequestedSOPClassUID, requiredElement)
+	v.MessageID = d.getUInt16(dicomtag.MessageID, requiredElement)
+	v.CommandDataSetType = d.getUInt16(dicomtag.CommandDataSetType, requiredElement)
+	v.RequestedSOPInstanceUID = d.getString(dicomtag.RequestedSOPInstanceUID, requiredElement)
+	v.Extra = d.unparsedElements()
+	return v
+}
+
+type NDeleteRsp struct {
+	AffectedSOPClassUID       string
+	MessageIDBeingRespondedTo MessageID
+	CommandDataSetType        uint16
+	AffectedSOPInstanceUID    string
+	Status                    Status
+	Extra                     []*dicom.Element // Unparsed elements
+}
+
+func (v *NDeleteRsp) Encode(e *dicomio.Encoder) {
+	elems := []*dicom.Element{}
+	elems = append(elems, newElement(dicomtag.CommandField, uint16(33104)))
+	if v.AffectedSOPClassUID != "" {
+		elems = append(elems, newElement(dicomtag.AffectedSOPClassUID, v.AffectedSOPClassUID))
+	}
+	elems = append(elems, newElement(dicomtag.MessageIDBeingRespondedTo, v.MessageIDBeingRespondedTo))
+	elems = append(elems, newElement(dicomtag.CommandDataSetType, v.CommandDataSetType))
+	if v.AffectedSOPInstanceUID != "" {
+		elems = append(elems, newElement(dicomtag.AffectedSOPInstanceUID, v.AffectedSOPInstanceUID))
+	}
+	elems = append(elems, newStatusElements(v.Status)...)
+	elems = append(elems, v.Extra...)
+	encodeElements(e, elems)
+}
+
+func (v *NDeleteRsp) HasData() bool {
+	return v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v *NDeleteRsp) CommandField() int {
+	return 33104
+}
+
+func (v *NDeleteRsp) GetMessageID() MessageID {
+	return v.MessageIDBeingRespondedTo
+}
+
+func (v *NDeleteRsp) GetStatus() *Status {
+	return &v.Status
+}
+
+func (v *NDeleteRsp) String() string {
+	return fmt.Sprintf("NDeleteRsp{AffectedSOPClassUID:%v MessageIDBeingRespondedTo:%v CommandDataSetType:%v AffectedSOPInstanceUID:%v Status:%v}}", v.AffectedSOPClassUID, v.MessageIDBeingRespondedTo, v.CommandDataSetType, v.AffectedSOPInstanceUID, v.Status)
+}
+
+func decodeNDeleteRsp(d *messageDecoder) *NDeleteRsp {
+	v := &NDeleteRsp{}
+	v.AffectedSOPClassUID = d.getString(dicomtag.AffectedSOPClassUID, optionalElement)
+	v.MessageIDBeingRespondedTo = d.getUInt16(dicomtag.MessageIDBeingRespondedTo, requiredElement)
+	v.CommandDataSetType = d.getUInt16(dicomtag.CommandDataSetType, requiredElement)
+	v.AffectedSOPInstanceUID = d.getString(dicomtag.AffectedSOPInstanceUID, optionalElement)
+	v.Status = d.getStatus()
+	v.Extra = d.unparsedElements()
+	return v
+}
+
 const CommandFieldCStoreRq = 1
 const CommandFieldCStoreRsp = 32769
 const CommandFieldCFindRq = 32
@@ -560,6 +1251,19 @@ const CommandFieldCMoveRq = 33
 const CommandFieldCMoveRsp = 32801
 const CommandFieldCEchoRq = 48
 const CommandFieldCEchoRsp = 32816
+const CommandFieldCCancelRq = 4095
+const CommandFieldNEventReportRq = 256
+const CommandFieldNEventReportRsp = 33024
+const CommandFieldNGetRq = 272
+const CommandFieldNGetRsp = 33040
+const CommandFieldNSetRq = 288
+const CommandFieldNSetRsp = 33056
+const CommandFieldNActionRq = 304
+const CommandFieldNActionRsp = 33072
+const CommandFieldNCreateRq = 320
+const CommandFieldNCreateRsp = 33088
+const CommandFieldNDeleteRq = 336
+const CommandFieldNDeleteRsp = 33104
 
 func decodeMessageForType(d *messageDecoder, commandField uint16) Message {
 	switch commandField {
@@ -583,6 +1287,32 @@ func decodeMessageForType(d *messageDecoder, commandField uint16) Message {
 		return decodeCEchoRq(d)
 	case 0x8030:
 		return decodeCEchoRsp(d)
+	case 0xfff:
+		return decodeCCancelRq(d)
+	case 0x100:
+		return decodeNEventReportRq(d)
+	case 0x8100:
+		return decodeNEventReportRsp(d)
+	case 0x110:
+		return decodeNGetRq(d)
+	case 0x8110:
+		return decodeNGetRsp(d)
+	case 0x120:
+		return decodeNSetRq(d)
+	case 0x8120:
+		return decodeNSetRsp(d)
+	case 0x130:
+		return decodeNActionRq(d)
+	case 0x8130:
+		return decodeNActionRsp(d)
+	case 0x140:
+		return decodeNCreateRq(d)
+	case 0x8140:
+		return decodeNCreateRsp(d)
+	case 0x150:
+		return decodeNDeleteRq(d)
+	case 0x8150:
+		return decodeNDeleteRsp(d)
 	default:
 		d.setError(fmt.Errorf("Unknown DIMSE command 0x%x", commandField))
 		return nil
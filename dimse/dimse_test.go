@@ -53,3 +53,68 @@ func TestCEchoRsp(t *testing.T) {
 		dimse.Status{Status: dimse.StatusCode(0x2345)},
 		nil})
 }
+
+func TestCCancelRq(t *testing.T) {
+	testDIMSE(t, &dimse.CCancelRq{0x1234, dimse.CommandDataSetTypeNull, nil})
+}
+
+func TestNEventReportRq(t *testing.T) {
+	testDIMSE(t, &dimse.NEventReportRq{"1.2.3", 0x1234, 1, "3.4.5", 2, nil})
+}
+
+func TestNEventReportRsp(t *testing.T) {
+	testDIMSE(t, &dimse.NEventReportRsp{"1.2.3", 0x1234, dimse.CommandDataSetTypeNull, "3.4.5", 2,
+		dimse.Status{Status: dimse.StatusSuccess},
+		nil})
+}
+
+func TestNGetRq(t *testing.T) {
+	testDIMSE(t, &dimse.NGetRq{"1.2.3", 0x1234, dimse.CommandDataSetTypeNull, "3.4.5", nil})
+}
+
+func TestNGetRsp(t *testing.T) {
+	testDIMSE(t, &dimse.NGetRsp{"1.2.3", 0x1234, 1, "3.4.5",
+		dimse.Status{Status: dimse.StatusNoSuchAttribute},
+		nil})
+}
+
+func TestNSetRq(t *testing.T) {
+	testDIMSE(t, &dimse.NSetRq{"1.2.3", 0x1234, 1, "3.4.5", nil})
+}
+
+func TestNSetRsp(t *testing.T) {
+	testDIMSE(t, &dimse.NSetRsp{"", 0x1234, dimse.CommandDataSetTypeNull, "",
+		dimse.Status{Status: dimse.StatusSuccess},
+		nil})
+}
+
+func TestNActionRq(t *testing.T) {
+	testDIMSE(t, &dimse.NActionRq{"1.2.3", 0x1234, 1, "3.4.5", 1, nil})
+}
+
+func TestNActionRsp(t *testing.T) {
+	testDIMSE(t, &dimse.NActionRsp{"1.2.3", 0x1234, dimse.CommandDataSetTypeNull, "3.4.5", 1,
+		dimse.Status{Status: dimse.StatusNoSuchActionType},
+		nil})
+}
+
+func TestNCreateRq(t *testing.T) {
+	// The SOP instance UID may be left for the performer to allocate.
+	testDIMSE(t, &dimse.NCreateRq{"1.2.3", 0x1234, 1, "", nil})
+}
+
+func TestNCreateRsp(t *testing.T) {
+	testDIMSE(t, &dimse.NCreateRsp{"1.2.3", 0x1234, 1, "3.4.5",
+		dimse.Status{Status: dimse.StatusSuccess},
+		nil})
+}
+
+func TestNDeleteRq(t *testing.T) {
+	testDIMSE(t, &dimse.NDeleteRq{"1.2.3", 0x1234, dimse.CommandDataSetTypeNull, "3.4.5", nil})
+}
+
+func TestNDeleteRsp(t *testing.T) {
+	testDIMSE(t, &dimse.NDeleteRsp{"1.2.3", 0x1234, dimse.CommandDataSetTypeNull, "3.4.5",
+		dimse.Status{Status: dimse.StatusProcessingFailure},
+		nil})
+}
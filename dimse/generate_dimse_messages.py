@@ -92,7 +92,101 @@ MESSAGES = [
             Type.RESPONSE, 0x8030,
             [Field('MessageIDBeingRespondedTo', 'MessageID', True),
              Field('CommandDataSetType', 'uint16', True),
-	     Field('Status', 'Status', True)])
+	     Field('Status', 'Status', True)]),
+    # P3.7 9.3.2.3. The same message cancels C-FIND, C-GET, and C-MOVE.
+    Message('CCancelRq',
+            Type.REQUEST, 0x0fff,
+            [Field('MessageIDBeingRespondedTo', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True)]),
+    # P3.7 10.3.1
+    Message('NEventReportRq',
+            Type.REQUEST, 0x0100,
+            [Field('AffectedSOPClassUID', 'string', True),
+             Field('MessageID', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('AffectedSOPInstanceUID', 'string', True),
+             Field('EventTypeID', 'uint16', True)]),
+    Message('NEventReportRsp',
+            Type.RESPONSE, 0x8100,
+            [Field('AffectedSOPClassUID', 'string', False),
+             Field('MessageIDBeingRespondedTo', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('AffectedSOPInstanceUID', 'string', False),
+             Field('EventTypeID', 'uint16', False),
+             Field('Status', 'Status', True)]),
+    # P3.7 10.3.2. The AttributeIdentifierList, if any, is stored in Extra.
+    Message('NGetRq',
+            Type.REQUEST, 0x0110,
+            [Field('RequestedSOPClassUID', 'string', True),
+             Field('MessageID', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('RequestedSOPInstanceUID', 'string', True)]),
+    Message('NGetRsp',
+            Type.RESPONSE, 0x8110,
+            [Field('AffectedSOPClassUID', 'string', False),
+             Field('MessageIDBeingRespondedTo', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('AffectedSOPInstanceUID', 'string', False),
+             Field('Status', 'Status', True)]),
+    # P3.7 10.3.3
+    Message('NSetRq',
+            Type.REQUEST, 0x0120,
+            [Field('RequestedSOPClassUID', 'string', True),
+             Field('MessageID', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('RequestedSOPInstanceUID', 'string', True)]),
+    Message('NSetRsp',
+            Type.RESPONSE, 0x8120,
+            [Field('AffectedSOPClassUID', 'string', False),
+             Field('MessageIDBeingRespondedTo', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('AffectedSOPInstanceUID', 'string', False),
+             Field('Status', 'Status', True)]),
+    # P3.7 10.3.4
+    Message('NActionRq',
+            Type.REQUEST, 0x0130,
+            [Field('RequestedSOPClassUID', 'string', True),
+             Field('MessageID', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('RequestedSOPInstanceUID', 'string', True),
+             Field('ActionTypeID', 'uint16', True)]),
+    Message('NActionRsp',
+            Type.RESPONSE, 0x8130,
+            [Field('AffectedSOPClassUID', 'string', False),
+             Field('MessageIDBeingRespondedTo', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('AffectedSOPInstanceUID', 'string', False),
+             Field('ActionTypeID', 'uint16', False),
+             Field('Status', 'Status', True)]),
+    # P3.7 10.3.5. AffectedSOPInstanceUID is empty if the requestor wants
+    # the performer to allocate one.
+    Message('NCreateRq',
+            Type.REQUEST, 0x0140,
+            [Field('AffectedSOPClassUID', 'string', True),
+             Field('MessageID', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('AffectedSOPInstanceUID', 'string', False)]),
+    Message('NCreateRsp',
+            Type.RESPONSE, 0x8140,
+            [Field('AffectedSOPClassUID', 'string', False),
+             Field('MessageIDBeingRespondedTo', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('AffectedSOPInstanceUID', 'string', False),
+             Field('Status', 'Status', True)]),
+    # P3.7 10.3.6
+    Message('NDeleteRq',
+            Type.REQUEST, 0x0150,
+            [Field('RequestedSOPClassUID', 'string', True),
+             Field('MessageID', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('RequestedSOPInstanceUID', 'string', True)]),
+    Message('NDeleteRsp',
+            Type.RESPONSE, 0x8150,
+            [Field('AffectedSOPClassUID', 'string', False),
+             Field('MessageIDBeingRespondedTo', 'MessageID', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('AffectedSOPInstanceUID', 'string', False),
+             Field('Status', 'Status', True)]),
 ]
 
 def generate_go_definition(m: Message, out: IO[str]):
@@ -135,9 +229,11 @@ def generate_go_definition(m: Message, out: IO[str]):
 
     print('', file=out)
     print(f'func (v *{m.name}) GetMessageID() MessageID {{', file=out)
-    if m.type == Type.REQUEST:
+    if any(f.name == 'MessageID' for f in m.fields):
         print(f'	return v.MessageID', file=out)
     else:
+        # Responses, and C-CANCEL, which refers to the request being
+        # canceled.
         print(f'	return v.MessageIDBeingRespondedTo', file=out)
     print('}', file=out)
 
@@ -4,26 +4,37 @@ package dimse
 
 import "fmt"
 
-const _StatusCode_name = "StatusSuccessStatusInvalidAttributeValueStatusAttributeListErrorStatusSOPClassNotSupportedStatusInvalidArgumentValueStatusAttributeValueOutOfRangeStatusInvalidObjectInstanceStatusNotAuthorizedStatusUnrecognizedOperationCStoreOutOfResourcesCMoveOutOfResourcesUnableToCalculateNumberOfMatchesCMoveOutOfResourcesUnableToPerformSubOperationsCMoveMoveDestinationUnknownCStoreDataSetDoesNotMatchSOPClassCStoreCannotUnderstandStatusCancelStatusPending"
+const _StatusCode_name = "StatusSuccessStatusOptionalAttributesNotSupportedStatusNoSuchAttributeStatusInvalidAttributeValueStatusAttributeListErrorStatusProcessingFailureStatusDuplicateSOPInstanceStatusSOPClassNotSupportedStatusNoSuchEventTypeStatusInvalidArgumentValueStatusAttributeValueOutOfRangeStatusInvalidObjectInstanceStatusNoSuchSOPClassStatusClassInstanceConflictStatusMissingAttributeStatusMissingAttributeValueStatusNoSuchActionTypeStatusNotAuthorizedStatusUnrecognizedOperationCStoreOutOfResourcesCMoveOutOfResourcesUnableToCalculateNumberOfMatchesCMoveOutOfResourcesUnableToPerformSubOperationsCMoveMoveDestinationUnknownCStoreDataSetDoesNotMatchSOPClassCMoveSubOperationsCompleteWithFailuresCStoreCannotUnderstandStatusCancelStatusPending"
 
 var _StatusCode_map = map[StatusCode]string{
 	0:     _StatusCode_name[0:13],
-	262:   _StatusCode_name[13:40],
-	263:   _StatusCode_name[40:64],
-	274:   _StatusCode_name[64:90],
-	277:   _StatusCode_name[90:116],
-	278:   _StatusCode_name[116:146],
-	279:   _StatusCode_name[146:173],
-	292:   _StatusCode_name[173:192],
-	529:   _StatusCode_name[192:219],
-	42752: _StatusCode_name[219:239],
-	42753: _StatusCode_name[239:290],
-	42754: _StatusCode_name[290:337],
-	43009: _StatusCode_name[337:364],
-	43264: _StatusCode_name[364:397],
-	49152: _StatusCode_name[397:419],
-	65024: _StatusCode_name[419:431],
-	65280: _StatusCode_name[431:444],
+	1:     _StatusCode_name[13:49],
+	261:   _StatusCode_name[49:70],
+	262:   _StatusCode_name[70:97],
+	263:   _StatusCode_name[97:121],
+	272:   _StatusCode_name[121:144],
+	273:   _StatusCode_name[144:170],
+	274:   _StatusCode_name[170:196],
+	275:   _StatusCode_name[196:217],
+	277:   _StatusCode_name[217:243],
+	278:   _StatusCode_name[243:273],
+	279:   _StatusCode_name[273:300],
+	280:   _StatusCode_name[300:320],
+	281:   _StatusCode_name[320:347],
+	288:   _StatusCode_name[347:369],
+	289:   _StatusCode_name[369:396],
+	291:   _StatusCode_name[396:418],
+	292:   _StatusCode_name[418:437],
+	529:   _StatusCode_name[437:464],
+	42752: _StatusCode_name[464:484],
+	42753: _StatusCode_name[484:535],
+	42754: _StatusCode_name[535:582],
+	43009: _StatusCode_name[582:609],
+	43264: _StatusCode_name[609:642],
+	45056: _StatusCode_name[642:680],
+	49152: _StatusCode_name[680:702],
+	65024: _StatusCode_name[702:714],
+	65280: _StatusCode_name[714:727],
 }
 
 func (i StatusCode) String() string {
@@ -1,23 +1,37 @@
 package netdicom
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
 	"flag"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/grailbio/go-dicom"
 	"github.com/grailbio/go-dicom/dicomio"
 	"github.com/grailbio/go-dicom/dicomtag"
 	"github.com/grailbio/go-dicom/dicomuid"
 	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/pdu"
 	"github.com/grailbio/go-netdicom/sopclass"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -30,18 +44,27 @@ var cstoreStatus = dimse.Success // status returned by the cstore handler
 var nEchoRequests int
 var once sync.Once
 
+// The AE title that the provider maps to itself for C-MOVE tests.
+const testMoveDestination = "testmovedest"
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 	var err error
+	remoteAEs := map[string]string{}
 	provider, err = NewServiceProvider(ServiceProviderParams{
-		CEcho:  onCEchoRequest,
-		CStore: onCStoreRequest,
-		CFind:  onCFindRequest,
-		CGet:   onCGetRequest,
+		RemoteAEs: remoteAEs,
+		CEcho:     onCEchoRequest,
+		CStore:    onCStoreRequest,
+		CFind:     onCFindRequest,
+		CMove:     onCGetRequest,
+		CGet:      onCGetRequest,
 	}, ":0")
 	if err != nil {
 		panic(err)
 	}
+	// C-MOVE requests in the tests ask the provider to send the datasets
+	// back to itself.
+	remoteAEs[testMoveDestination] = provider.ListenAddr().String()
 	go provider.Run()
 	os.Exit(m.Run())
 }
@@ -186,6 +209,14 @@ func mustNewServiceUser(t *testing.T, sopClasses []string) *ServiceUser {
 	return su
 }
 
+// Similar to mustNewServiceUser, but connects to "sp".
+func mustNewServiceUserAt(t *testing.T, sp *ServiceProvider, sopClasses []string) *ServiceUser {
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopClasses})
+	require.NoError(t, err)
+	require.NoError(t, su.ConnectContext(context.Background(), sp.ListenAddr().String()))
+	return su
+}
+
 func TestStore(t *testing.T) {
 	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
 	su := mustNewServiceUser(t, sopclass.StorageClasses)
@@ -215,6 +246,10 @@ func TestStoreFailure0(t *testing.T) {
 	if err == nil || strings.Index(err.Error(), "Foohah") < 0 {
 		log.Panic(err)
 	}
+	var dimseErr *DIMSEError
+	require.True(t, errors.As(err, &dimseErr))
+	assert.Equal(t, "C-STORE", dimseErr.Op)
+	assert.Equal(t, dimse.StatusNotAuthorized, dimseErr.Status.Status)
 }
 
 func getProviderPort() string {
@@ -302,6 +337,78 @@ func TestStoreFailure1(t *testing.T) {
 	}
 }
 
+// rewriteFaultInjector replaces the first occurrence of "from" with "to" in
+// every PDU sent, to simulate a malformed peer.
+type rewriteFaultInjector struct {
+	from, to []byte
+}
+
+func (fi *rewriteFaultInjector) onStateTransition(oldState stateType, event *stateEvent, action *stateAction, newState stateType) {
+}
+
+func (fi *rewriteFaultInjector) onSend(data []byte) faultInjectorAction {
+	if i := bytes.Index(data, fi.from); i >= 0 {
+		copy(data[i:], fi.to)
+	}
+	return faultInjectorContinue
+}
+
+func (fi *rewriteFaultInjector) String() string {
+	return "rewriteFaultInjector"
+}
+
+// Encoding of a DIMSE command element of type US, in implicit VR little
+// endian.
+func encodedUInt16Element(tag dicomtag.Tag, v uint16) []byte {
+	return []byte{
+		byte(tag.Group), byte(tag.Group >> 8),
+		byte(tag.Element), byte(tag.Element >> 8),
+		2, 0, 0, 0,
+		byte(v), byte(v >> 8)}
+}
+
+// The provider responds to C-STORE with a C-ECHO response. The client should
+// report an error instead of crashing.
+func TestStoreWrongResponse(t *testing.T) {
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	SetProviderFaultInjector(&rewriteFaultInjector{
+		from: encodedUInt16Element(dicomtag.CommandField, dimse.CommandFieldCStoreRsp),
+		to:   encodedUInt16Element(dicomtag.CommandField, dimse.CommandFieldCEchoRsp),
+	})
+	defer SetProviderFaultInjector(nil)
+
+	su := mustNewServiceUser(t, sopclass.StorageClasses)
+	defer su.Release()
+	err := su.CStore(dataset)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "wrong response")
+}
+
+// The provider reports a failure in the final C-FIND response. The client
+// should report it as a *DIMSEError instead of crashing.
+func TestFindFailureStatus(t *testing.T) {
+	SetProviderFaultInjector(&rewriteFaultInjector{
+		from: encodedUInt16Element(dicomtag.Status, uint16(dimse.StatusSuccess)),
+		to:   encodedUInt16Element(dicomtag.Status, uint16(dimse.CFindUnableToProcess)),
+	})
+	defer SetProviderFaultInjector(nil)
+
+	su := mustNewServiceUser(t, sopclass.QRFindClasses)
+	defer su.Release()
+	filter := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.PatientName, "foohah"),
+	}
+	var lastErr error
+	for result := range su.CFind(QRLevelPatient, filter) {
+		if result.Err != nil {
+			lastErr = result.Err
+		}
+	}
+	var dimseErr *DIMSEError
+	require.True(t, errors.As(lastErr, &dimseErr), "error: %v", lastErr)
+	assert.Equal(t, dimse.CFindUnableToProcess, dimseErr.Status.Status)
+}
+
 func TestEcho(t *testing.T) {
 	su := mustNewServiceUser(t, sopclass.VerificationClasses)
 	defer su.Release()
@@ -372,6 +479,83 @@ func TestCGet(t *testing.T) {
 	checkFileBodiesEqual(t, expected, ds)
 }
 
+func TestCMove(t *testing.T) {
+	cstoreData = nil
+	su := mustNewServiceUser(t, sopclass.QRMoveClasses)
+	defer su.Release()
+	filter := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.PatientName, "foohah"),
+	}
+	var results []CMoveProgress
+	for result := range su.CMove(QRLevelPatient, filter, testMoveDestination) {
+		log.Printf("Got C-MOVE progress: %+v", result)
+		require.NoError(t, result.Err)
+		results = append(results, result)
+	}
+	require.True(t, len(results) > 0, "No C-MOVE response received")
+	final := results[len(results)-1]
+	require.Equal(t, dimse.StatusSuccess, final.Status.Status)
+	require.Equal(t, 1, final.Completed)
+	require.Equal(t, 0, final.Failed)
+
+	ds, err := getCStoreData()
+	require.NoError(t, err)
+	expected := mustReadDICOMFile("testdata/reportsi.dcm")
+	checkFileBodiesEqual(t, expected, ds)
+}
+
+// If some C-MOVE sub-operations fail, the final progress reports the warning
+// status with the counters, not an error.
+func TestCMovePartialFailure(t *testing.T) {
+	paths := []string{"testdata/reportsi.dcm", "testdata/IM-0001-0003.dcm"}
+	_, failedInstanceUID := getSOPUIDs(t, mustReadDICOMFile(paths[1]))
+	dest, err := NewServiceProvider(ServiceProviderParams{
+		CStore: func(connState ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			if sopInstanceUID == failedInstanceUID {
+				return dimse.Status{Status: dimse.CStoreOutOfResources}
+			}
+			return dimse.Success
+		},
+	}, ":0")
+	require.NoError(t, err)
+	go dest.Run()
+	defer dest.Close()
+	sp := startTestProvider(t, ServiceProviderParams{
+		RemoteAEs: map[string]string{testMoveDestination: dest.ListenAddr().String()},
+		CMove: func(connState ConnectionState, transferSyntaxUID string, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+			for i, path := range paths {
+				ch <- CMoveResult{Remaining: len(paths) - i - 1, Path: path, DataSet: mustReadDICOMFile(path)}
+			}
+			close(ch)
+		},
+	})
+	defer sp.Close()
+
+	su := mustNewServiceUserAt(t, sp, sopclass.QRMoveClasses)
+	defer su.Release()
+	var final CMoveProgress
+	for result := range su.CMove(QRLevelPatient, []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "foohah")}, testMoveDestination) {
+		require.NoError(t, result.Err)
+		final = result
+	}
+	assert.Equal(t, dimse.CMoveSubOperationsCompleteWithFailures, final.Status.Status)
+	assert.Equal(t, 1, final.Completed)
+	assert.Equal(t, 1, final.Failed)
+}
+
+func TestCMoveUnknownDestination(t *testing.T) {
+	su := mustNewServiceUser(t, sopclass.QRMoveClasses)
+	defer su.Release()
+	filter := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.PatientName, "foohah"),
+	}
+	var lastErr error
+	for result := range su.CMove(QRLevelPatient, filter, "nonexistentdest") {
+		lastErr = result.Err
+	}
+	require.Error(t, lastErr)
+}
+
 func TestReleaseWithoutConnect(t *testing.T) {
 	su, err := NewServiceUser(ServiceUserParams{
 		SOPClasses: sopclass.StorageClasses})
@@ -392,3 +576,1893 @@ func TestNonexistentServer(t *testing.T) {
 }
 
 // TODO(saito) Test that the state machine shuts down propelry.
+
+// A server that accepts a connection but never responds should not hang the
+// client past its deadline.
+func TestConnectContextTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ioutil.ReadAll(conn)
+	}()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = su.ConnectContext(ctx, listener.Addr().String())
+	var ctxErr *ContextError
+	require.True(t, errors.As(err, &ctxErr), "Expect ContextError: %v", err)
+	require.True(t, ctxErr.Timeout())
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	// The association is unusable after the abort.
+	require.Error(t, su.CEcho())
+}
+
+// Start a provider that runs "policy" on every association request.
+func startPolicyProvider(t *testing.T, policy AssociationPolicy) *ServiceProvider {
+	return startTestProvider(t, ServiceProviderParams{AssociationPolicy: policy})
+}
+
+// Start a provider with the given params. C-ECHO and C-STORE callbacks are
+// filled in.
+func startTestProvider(t *testing.T, params ServiceProviderParams) *ServiceProvider {
+	params.CEcho = onCEchoRequest
+	params.CStore = onCStoreRequest
+	sp, err := NewServiceProvider(params, ":0")
+	require.NoError(t, err)
+	go sp.Run()
+	return sp
+}
+
+func TestAssociationPolicyReject(t *testing.T) {
+	var req *AssociationRequest
+	sp := startPolicyProvider(t, func(r *AssociationRequest) *pdu.AAssociateRj {
+		req = r
+		return &pdu.AAssociateRj{
+			Result: pdu.ResultRejectedPermanent,
+			Source: pdu.SourceULServiceUser,
+			Reason: pdu.RejectReasonCallingAETitleNotRecognized,
+		}
+	})
+	su, err := NewServiceUser(ServiceUserParams{
+		CalledAETitle:  "policytest",
+		CallingAETitle: "badae",
+		SOPClasses:     sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.Error(t, su.CEcho())
+	require.NotNil(t, req)
+	assert.Equal(t, "policytest", req.CalledAETitle)
+	assert.Equal(t, "badae", req.CallingAETitle)
+	assert.NotNil(t, req.RemoteAddr)
+	require.Equal(t, len(sopclass.VerificationClasses), len(req.PresentationContexts))
+	pc := req.PresentationContexts[0]
+	assert.Equal(t, dicomuid.VerificationSOPClass, pc.AbstractSyntaxUID)
+	assert.Equal(t, pdu.PresentationContextAccepted, pc.Result)
+	assert.Equal(t, pc.TransferSyntaxUIDs[0], pc.TransferSyntaxUID)
+}
+
+func TestAssociationRejectedError(t *testing.T) {
+	sp := startPolicyProvider(t, func(r *AssociationRequest) *pdu.AAssociateRj {
+		return &pdu.AAssociateRj{
+			Result: pdu.ResultRejectedTransient,
+			Source: pdu.SourceULServiceProviderACSE,
+			Reason: pdu.RejectReasonNone,
+		}
+	})
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	err = su.CEcho()
+	require.Error(t, err)
+	var rejectErr *AssociationRejectedError
+	require.True(t, errors.As(err, &rejectErr), "error: %v", err)
+	assert.Equal(t, pdu.ResultRejectedTransient, rejectErr.Result)
+	assert.Equal(t, pdu.SourceULServiceProviderACSE, rejectErr.Source)
+	assert.Equal(t, pdu.RejectReasonNone, rejectErr.Reason)
+	assert.True(t, rejectErr.Temporary())
+}
+
+// The client sends an A-ASSOCIATE-RQ with a blank AE title. The provider
+// should reject the association instead of crashing.
+func TestBlankAETitle(t *testing.T) {
+	blank := []byte("                ")
+	for _, test := range []struct {
+		called bool
+		reason pdu.RejectReasonType
+	}{
+		{true, pdu.RejectReasonCalledAETitleNotRecognized},
+		{false, pdu.RejectReasonCallingAETitleNotRecognized},
+	} {
+		params := ServiceUserParams{
+			CalledAETitle:  "blankcalled",
+			CallingAETitle: "blankcalling",
+			SOPClasses:     sopclass.VerificationClasses,
+		}
+		title := params.CallingAETitle
+		if test.called {
+			title = params.CalledAETitle
+		}
+		SetUserFaultInjector(&rewriteFaultInjector{
+			from: []byte(title + strings.Repeat(" ", 16-len(title))),
+			to:   blank,
+		})
+		su, err := NewServiceUser(params)
+		require.NoError(t, err)
+		err = su.ConnectContext(context.Background(), provider.ListenAddr().String())
+		SetUserFaultInjector(nil)
+		require.Error(t, err)
+		var rejectErr *AssociationRejectedError
+		require.True(t, errors.As(err, &rejectErr), "error: %v", err)
+		assert.Equal(t, pdu.ResultRejectedPermanent, rejectErr.Result)
+		assert.Equal(t, pdu.SourceULServiceUser, rejectErr.Source)
+		assert.Equal(t, test.reason, rejectErr.Reason)
+		su.Release()
+	}
+	su := mustNewServiceUser(t, sopclass.VerificationClasses)
+	defer su.Release()
+	require.NoError(t, su.CEcho())
+}
+
+func TestAssociationPolicyRejectContext(t *testing.T) {
+	sp := startPolicyProvider(t, func(r *AssociationRequest) *pdu.AAssociateRj {
+		for _, pc := range r.PresentationContexts {
+			if pc.AbstractSyntaxUID == dicomuid.VerificationSOPClass {
+				pc.Result = pdu.PresentationContextProviderRejectionAbstractSyntaxNotSupported
+			}
+		}
+		return nil
+	})
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: append(append([]string{}, sopclass.VerificationClasses...), sopclass.StorageClasses...)})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.Error(t, su.CEcho())
+	ds := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	require.NoError(t, su.CStore(ds))
+}
+
+func TestProviderTransferSyntaxPreference(t *testing.T) {
+	var picked string
+	sp := startTestProvider(t, ServiceProviderParams{
+		TransferSyntaxes: []string{dicomuid.ExplicitVRLittleEndian, dicomuid.ImplicitVRLittleEndian},
+		AssociationPolicy: func(r *AssociationRequest) *pdu.AAssociateRj {
+			picked = r.PresentationContexts[0].TransferSyntaxUID
+			return nil
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.VerificationClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian}})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+	assert.Equal(t, dicomuid.ExplicitVRLittleEndian, picked)
+}
+
+func TestProviderTransferSyntaxNotSupported(t *testing.T) {
+	var result pdu.PresentationContextResult
+	sp := startTestProvider(t, ServiceProviderParams{
+		SOPTransferSyntaxes: map[string][]string{
+			dicomuid.VerificationSOPClass: {dicomuid.ExplicitVRBigEndian},
+		},
+		AssociationPolicy: func(r *AssociationRequest) *pdu.AAssociateRj {
+			result = r.PresentationContexts[0].Result
+			return nil
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.VerificationClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian}})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.Error(t, su.CEcho())
+	assert.Equal(t, pdu.PresentationContextProviderRejectionTransferSyntaxNotSupported, result)
+}
+
+// A policy that sets an undefined result rejects the context instead of
+// crashing the provider.
+func TestAssociationPolicyInvalidResult(t *testing.T) {
+	sp := startPolicyProvider(t, func(r *AssociationRequest) *pdu.AAssociateRj {
+		if r.CallingAETitle == "invalid" {
+			for _, pc := range r.PresentationContexts {
+				pc.Result = 0xff
+			}
+		}
+		return nil
+	})
+	defer sp.Close()
+	require.Error(t, echoWithAETitles(t, sp, "", "invalid"))
+	require.NoError(t, echoWithAETitles(t, sp, "", "valid"))
+}
+
+// Try C-ECHO against "sp" using the given AE titles.
+func echoWithAETitles(t *testing.T, sp *ServiceProvider, calledAETitle, callingAETitle string) error {
+	su, err := NewServiceUser(ServiceUserParams{
+		CalledAETitle:  calledAETitle,
+		CallingAETitle: callingAETitle,
+		SOPClasses:     sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	return su.CEcho()
+}
+
+func TestProviderCheckCalledAETitle(t *testing.T) {
+	sp := startTestProvider(t, ServiceProviderParams{
+		AETitle:            "testserver",
+		CheckCalledAETitle: true,
+	})
+	require.NoError(t, echoWithAETitles(t, sp, "testserver", "testclient"))
+	require.Error(t, echoWithAETitles(t, sp, "otherserver", "testclient"))
+}
+
+func TestProviderAllowedPeers(t *testing.T) {
+	sp := startTestProvider(t, ServiceProviderParams{
+		AllowedPeers: []AllowedPeer{
+			{AETitle: "testclient", Host: "localhost"},
+			{AETitle: "remoteclient", Host: "192.0.2.1"},
+			{AETitle: "anyhostclient"},
+		},
+	})
+	require.NoError(t, echoWithAETitles(t, sp, "testserver", "testclient"))
+	require.NoError(t, echoWithAETitles(t, sp, "testserver", "anyhostclient"))
+	require.Error(t, echoWithAETitles(t, sp, "testserver", "remoteclient"))
+	require.Error(t, echoWithAETitles(t, sp, "testserver", "unknownclient"))
+}
+
+var testCommitRefs = []SOPReference{
+	{SOPClassUID: "1.2.840.10008.5.1.4.1.1.2", SOPInstanceUID: "1.2.3.4.1"},
+	{SOPClassUID: "1.2.840.10008.5.1.4.1.1.2", SOPInstanceUID: "1.2.3.4.2"},
+}
+
+// Commit all but the last instance.
+func commitAllButLast(refs []SOPReference) StorageCommitmentResult {
+	result := StorageCommitmentResult{Committed: refs[:len(refs)-1]}
+	result.Failed = append(result.Failed, StorageCommitmentFailure{
+		SOPReference:  refs[len(refs)-1],
+		FailureReason: dimse.StatusProcessingFailure,
+	})
+	return result
+}
+
+func waitForCommitReport(t *testing.T, ch chan StorageCommitmentResult, transactionUID string) {
+	select {
+	case result := <-ch:
+		assert.Equal(t, transactionUID, result.TransactionUID)
+		assert.Equal(t, testCommitRefs[:1], result.Committed)
+		require.Equal(t, 1, len(result.Failed))
+		assert.Equal(t, testCommitRefs[1], result.Failed[0].SOPReference)
+		assert.Equal(t, dimse.StatusProcessingFailure, result.Failed[0].FailureReason)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for storage commitment report")
+	}
+}
+
+func newCommitReportCallback(ch chan StorageCommitmentResult) StorageCommitmentReportCallback {
+	return func(conn ConnectionState, result StorageCommitmentResult) dimse.Status {
+		ch <- result
+		return dimse.Success
+	}
+}
+
+func TestStorageCommitment(t *testing.T) {
+	sp := startTestProvider(t, ServiceProviderParams{
+		StorageCommitment: func(conn ConnectionState, transactionUID string, refs []SOPReference) StorageCommitmentResult {
+			return commitAllButLast(refs)
+		},
+	})
+	reportCh := make(chan StorageCommitmentResult, 1)
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:              sopclass.StorageCommitmentClasses,
+		StorageCommitmentReport: newCommitReportCallback(reportCh)})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	transactionUID, err := su.StorageCommitment(testCommitRefs)
+	require.NoError(t, err)
+	waitForCommitReport(t, reportCh, transactionUID)
+}
+
+// The SCP sends the report on a new association if the requestor has released
+// the original one.
+func TestStorageCommitmentOnNewAssociation(t *testing.T) {
+	reportCh := make(chan StorageCommitmentResult, 1)
+	rolesCh := make(chan []*RoleSelection, 1)
+	receiver := startTestProvider(t, ServiceProviderParams{
+		StorageCommitmentReport: newCommitReportCallback(reportCh),
+		AssociationPolicy: func(req *AssociationRequest) *pdu.AAssociateRj {
+			rolesCh <- req.RoleSelections
+			return nil
+		},
+	})
+	sp := startTestProvider(t, ServiceProviderParams{
+		AETitle:   "commitscp",
+		RemoteAEs: map[string]string{"commitscu": receiver.ListenAddr().String()},
+		StorageCommitment: func(conn ConnectionState, transactionUID string, refs []SOPReference) StorageCommitmentResult {
+			assert.Equal(t, "commitscu", conn.CallingAETitle)
+			// Wait for the requestor to release the association.
+			<-conn.Context.Done()
+			return commitAllButLast(refs)
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{
+		CalledAETitle:  "commitscp",
+		CallingAETitle: "commitscu",
+		SOPClasses:     sopclass.StorageCommitmentClasses})
+	require.NoError(t, err)
+	su.Connect(sp.ListenAddr().String())
+	transactionUID, err := su.StorageCommitment(testCommitRefs)
+	require.NoError(t, err)
+	su.Release()
+	waitForCommitReport(t, reportCh, transactionUID)
+	// The SCP proposes the SCP role on the new association. P3.4 J.3.3.
+	roles := <-rolesCh
+	require.Equal(t, 1, len(roles))
+	assert.Equal(t, RoleSelection{
+		SOPClassUID: sopclass.StorageCommitmentClasses[0],
+		SCURole:     true,
+		SCPRole:     true,
+	}, *roles[0])
+}
+
+func TestMPPS(t *testing.T) {
+	var mu sync.Mutex
+	statuses := map[string]string{}
+	getStatus := func(elems []*dicom.Element) string {
+		elem, err := dicom.FindElementByTag(elems, dicomtag.PerformedProcedureStepStatus)
+		require.NoError(t, err)
+		return elem.MustGetString()
+	}
+	sp := startTestProvider(t, ServiceProviderParams{
+		MPPSCreate: func(conn ConnectionState, sopInstanceUID string, elems []*dicom.Element) dimse.Status {
+			mu.Lock()
+			defer mu.Unlock()
+			statuses[sopInstanceUID] = getStatus(elems)
+			return dimse.Success
+		},
+		MPPSSet: func(conn ConnectionState, sopInstanceUID string, elems []*dicom.Element) dimse.Status {
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := statuses[sopInstanceUID]; !ok {
+				return dimse.Status{Status: dimse.StatusInvalidObjectInstance}
+			}
+			statuses[sopInstanceUID] = getStatus(elems)
+			return dimse.Success
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.MPPSClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	uid, err := su.MPPSCreate("", []*dicom.Element{
+		dicom.MustNewElement(dicomtag.PerformedProcedureStepStatus, "IN PROGRESS")})
+	require.NoError(t, err)
+	require.NotEqual(t, "", uid)
+	require.NoError(t, su.MPPSSet(uid, []*dicom.Element{
+		dicom.MustNewElement(dicomtag.PerformedProcedureStepStatus, "COMPLETED")}))
+	require.Error(t, su.MPPSSet("1.2.3.4", []*dicom.Element{
+		dicom.MustNewElement(dicomtag.PerformedProcedureStepStatus, "COMPLETED")}))
+	mu.Lock()
+	assert.Equal(t, map[string]string{uid: "COMPLETED"}, statuses)
+	mu.Unlock()
+}
+
+func TestWorklistFind(t *testing.T) {
+	sp := startTestProvider(t, ServiceProviderParams{
+		WorklistFind: func(conn ConnectionState, transferSyntaxUID string, filters []*dicom.Element, ch chan CFindResult) {
+			defer close(ch)
+			_, err := dicom.FindElementByTag(filters, dicomtag.QueryRetrieveLevel)
+			if err == nil {
+				ch <- CFindResult{Err: errors.New("Unexpected QueryRetrieveLevel in a worklist query")}
+				return
+			}
+			seq, err := dicom.FindElementByTag(filters, dicomtag.ScheduledProcedureStepSequence)
+			if err != nil {
+				ch <- CFindResult{Err: err}
+				return
+			}
+			item := seq.Value[0].(*dicom.Element)
+			var modality string
+			for _, v := range item.Value {
+				if elem := v.(*dicom.Element); elem.Tag == dicomtag.Modality {
+					modality = elem.MustGetString()
+				}
+			}
+			if modality != "CT" {
+				return
+			}
+			ch <- CFindResult{Elements: []*dicom.Element{
+				dicom.MustNewElement(dicomtag.PatientName, "Doe^John"),
+				newSequenceElement(dicomtag.ScheduledProcedureStepSequence, [][]*dicom.Element{{
+					dicom.MustNewElement(dicomtag.Modality, "CT"),
+					dicom.MustNewElement(dicomtag.ScheduledStationAETitle, "CT01"),
+				}}),
+			}}
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.WorklistFindClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	find := func(modality string) [][]*dicom.Element {
+		var results [][]*dicom.Element
+		for result := range su.WorklistFind(
+			[]*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "")},
+			[]*dicom.Element{
+				dicom.MustNewElement(dicomtag.ScheduledStationAETitle, ""),
+				dicom.MustNewElement(dicomtag.Modality, modality),
+			}) {
+			require.NoError(t, result.Err)
+			results = append(results, result.Elements)
+		}
+		return results
+	}
+	results := find("CT")
+	require.Equal(t, 1, len(results))
+	elem, err := dicom.FindElementByTag(results[0], dicomtag.PatientName)
+	require.NoError(t, err)
+	assert.Equal(t, "Doe^John", elem.MustGetString())
+	_, err = dicom.FindElementByTag(results[0], dicomtag.ScheduledProcedureStepSequence)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(find("MR")))
+}
+
+// Issue C-ECHO and C-FIND requests on one association from multiple goroutines.
+func TestConcurrentOperations(t *testing.T) {
+	var nEchos int32
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status {
+			atomic.AddInt32(&nEchos, 1)
+			return dimse.Success
+		},
+		CFind: onCFindRequest,
+	}, ":0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: append(append([]string{}, sopclass.VerificationClasses...), sopclass.QRFindClasses...)})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	const n = 8
+	filter := []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "foohah")}
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := su.CEcho(); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			var namesFound []string
+			for result := range su.CFind(QRLevelPatient, filter) {
+				if result.Err != nil {
+					t.Error(result.Err)
+					continue
+				}
+				for _, elem := range result.Elements {
+					namesFound = append(namesFound, elem.MustGetString())
+				}
+			}
+			if len(namesFound) != 2 {
+				t.Error(namesFound)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(n), atomic.LoadInt32(&nEchos))
+}
+
+func TestAsyncOpsWindow(t *testing.T) {
+	started := make(chan AsyncOpsWindow, 16)
+	release := make(chan struct{})
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status {
+			started <- conn.AsyncOpsWindow
+			<-release
+			return dimse.Success
+		},
+		AsyncOpsWindow: &AsyncOpsWindow{MaxOpsInvoked: 2, MaxOpsPerformed: 4},
+	}, ":0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:     sopclass.VerificationClasses,
+		AsyncOpsWindow: &AsyncOpsWindow{MaxOpsInvoked: 8, MaxOpsPerformed: 1}})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(context.Background(), sp.ListenAddr().String()))
+	assert.Equal(t, AsyncOpsWindow{MaxOpsInvoked: 4, MaxOpsPerformed: 1}, su.AsyncOpsWindow())
+
+	const n = 6
+	errCh := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() { errCh <- su.CEcho() }()
+	}
+	// Four requests run concurrently. The rest wait for them to finish.
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, AsyncOpsWindow{MaxOpsInvoked: 1, MaxOpsPerformed: 4}, <-started)
+	}
+	select {
+	case <-started:
+		t.Error("Too many C-ECHO requests running concurrently")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	for i := 0; i < n; i++ {
+		require.NoError(t, <-errCh)
+	}
+}
+
+// Returns a C-FIND handler that sends one result, then blocks until "release"
+// is closed. "started" receives a value each time the handler runs.
+func blockingCFind(started, release chan struct{}) func(ConnectionState, string, string, []*dicom.Element, chan CFindResult) {
+	return func(connState ConnectionState, transferSyntaxUID string, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+		started <- struct{}{}
+		ch <- CFindResult{
+			Elements: []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "johndoe")},
+		}
+		<-release
+		close(ch)
+	}
+}
+
+// Check that "err" reports a C-CANCEL acknowledged by the peer.
+func requireCanceled(t *testing.T, err error) {
+	var contextErr *ContextError
+	require.True(t, errors.As(err, &contextErr), "Unexpected error: %v", err)
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+// Canceling the context of CFindContext sends C-CANCEL, and the provider stops
+// the C-FIND with a Cancel status.
+func TestCFindCancel(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	sp := startTestProvider(t, ServiceProviderParams{CFind: blockingCFind(started, release)})
+	defer sp.Close()
+	defer close(release)
+
+	su := mustNewServiceUserAt(t, sp, append(append([]string{}, sopclass.QRFindClasses...), sopclass.VerificationClasses...))
+	defer su.Release()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var results []CFindResult
+	for result := range su.CFindContext(ctx, QRLevelPatient, []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "foohah")}) {
+		results = append(results, result)
+		cancel()
+	}
+	require.Equal(t, 2, len(results))
+	require.NoError(t, results[0].Err)
+	requireCanceled(t, results[1].Err)
+	// The association survives the cancellation.
+	require.NoError(t, su.CEcho())
+}
+
+// Canceling the context of CGetContext stops the C-GET once the provider
+// acknowledges it. The datasets received earlier are still passed to the
+// callback.
+func TestCGetCancel(t *testing.T) {
+	release := make(chan struct{})
+	sp := startTestProvider(t, ServiceProviderParams{
+		CGet: func(connState ConnectionState, transferSyntaxUID string, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+			path := "testdata/reportsi.dcm"
+			ch <- CMoveResult{Remaining: 1, Path: path, DataSet: mustReadDICOMFile(path)}
+			<-release
+			close(ch)
+		},
+	})
+	defer sp.Close()
+	defer close(release)
+
+	su := mustNewServiceUserAt(t, sp, sopclass.QRGetClasses)
+	defer su.Release()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n := 0
+	err := su.CGetContext(ctx, QRLevelPatient,
+		[]*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "foohah")},
+		func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			n++
+			cancel()
+			return dimse.Success
+		})
+	requireCanceled(t, err)
+	assert.Equal(t, 1, n)
+}
+
+// Canceling the context of CMoveContext stops the C-MOVE. The final progress
+// reports the sub-operations done and the ones left undone.
+func TestCMoveCancel(t *testing.T) {
+	release := make(chan struct{})
+	sp := startTestProvider(t, ServiceProviderParams{
+		RemoteAEs: map[string]string{testMoveDestination: provider.ListenAddr().String()},
+		CMove: func(connState ConnectionState, transferSyntaxUID string, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+			path := "testdata/reportsi.dcm"
+			ch <- CMoveResult{Remaining: 1, Path: path, DataSet: mustReadDICOMFile(path)}
+			<-release
+			close(ch)
+		},
+	})
+	defer sp.Close()
+	defer close(release)
+
+	su := mustNewServiceUserAt(t, sp, sopclass.QRMoveClasses)
+	defer su.Release()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var results []CMoveProgress
+	for result := range su.CMoveContext(ctx, QRLevelPatient, []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "foohah")}, testMoveDestination) {
+		results = append(results, result)
+		cancel()
+	}
+	require.Equal(t, 2, len(results))
+	require.NoError(t, results[0].Err)
+	final := results[1]
+	requireCanceled(t, final.Err)
+	assert.Equal(t, dimse.StatusCancel, final.Status.Status)
+	assert.Equal(t, 1, final.Completed)
+	assert.Equal(t, 1, final.Remaining)
+}
+
+// cancelIgnoredFaultInjector makes the C-CANCEL requests sent refer to a
+// nonexistent command, so the peer ignores them.
+type cancelIgnoredFaultInjector struct{}
+
+func (fi *cancelIgnoredFaultInjector) onStateTransition(oldState stateType, event *stateEvent, action *stateAction, newState stateType) {
+}
+
+func (fi *cancelIgnoredFaultInjector) onSend(data []byte) faultInjectorAction {
+	if !bytes.Contains(data, encodedUInt16Element(dicomtag.CommandField, dimse.CommandFieldCCancelRq)) {
+		return faultInjectorContinue
+	}
+	header := encodedUInt16Element(dicomtag.MessageIDBeingRespondedTo, 0)[:8]
+	if i := bytes.Index(data, header); i >= 0 {
+		data[i+8], data[i+9] = 0xff, 0xff
+	}
+	return faultInjectorContinue
+}
+
+func (fi *cancelIgnoredFaultInjector) String() string {
+	return "cancelIgnoredFaultInjector"
+}
+
+// If the provider doesn't acknowledge C-CANCEL within cancelGracePeriod, the
+// client aborts the association.
+func TestCancelGracePeriod(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	sp := startTestProvider(t, ServiceProviderParams{CFind: blockingCFind(started, release)})
+	defer sp.Close()
+	defer close(release)
+	SetUserFaultInjector(&cancelIgnoredFaultInjector{})
+	defer SetUserFaultInjector(nil)
+	oldGracePeriod := cancelGracePeriod
+	cancelGracePeriod = 100 * time.Millisecond
+	defer func() { cancelGracePeriod = oldGracePeriod }()
+
+	su := mustNewServiceUserAt(t, sp, append(append([]string{}, sopclass.QRFindClasses...), sopclass.VerificationClasses...))
+	defer su.Release()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var results []CFindResult
+	for result := range su.CFindContext(ctx, QRLevelPatient, []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "foohah")}) {
+		results = append(results, result)
+		cancel()
+	}
+	require.Equal(t, 2, len(results))
+	require.NoError(t, results[0].Err)
+	requireCanceled(t, results[1].Err)
+	require.Error(t, su.CEcho())
+}
+
+// commandSentFaultInjector reports each DIMSE command of type "commandField"
+// sent through "sent".
+type commandSentFaultInjector struct {
+	commandField uint16
+	sent         chan struct{}
+}
+
+func (fi *commandSentFaultInjector) onStateTransition(oldState stateType, event *stateEvent, action *stateAction, newState stateType) {
+}
+
+func (fi *commandSentFaultInjector) onSend(data []byte) faultInjectorAction {
+	if bytes.Contains(data, encodedUInt16Element(dicomtag.CommandField, fi.commandField)) {
+		fi.sent <- struct{}{}
+	}
+	return faultInjectorContinue
+}
+
+func (fi *commandSentFaultInjector) String() string {
+	return "commandSentFaultInjector"
+}
+
+// A request canceled while it waits for a slot in the provider's asynchronous
+// operations window is answered with a Cancel status, and never runs.
+func TestCancelQueuedRequest(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	sp := startTestProvider(t, ServiceProviderParams{
+		CFind:          blockingCFind(started, release),
+		AsyncOpsWindow: &AsyncOpsWindow{MaxOpsInvoked: 1, MaxOpsPerformed: 1},
+	})
+	defer sp.Close()
+	// Make the client believe that the provider performs two operations
+	// at a time, so that the second request waits in the provider.
+	SetProviderFaultInjector(&rewriteFaultInjector{
+		from: []byte{pdu.ItemTypeAsynchronousOperationsWindow, 0, 0, 4, 0, 1, 0, 1},
+		to:   []byte{pdu.ItemTypeAsynchronousOperationsWindow, 0, 0, 4, 0, 2, 0, 1},
+	})
+	defer SetProviderFaultInjector(nil)
+	fi := &commandSentFaultInjector{commandField: dimse.CommandFieldCFindRq, sent: make(chan struct{}, 2)}
+	SetUserFaultInjector(fi)
+	defer SetUserFaultInjector(nil)
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:     sopclass.QRFindClasses,
+		AsyncOpsWindow: &AsyncOpsWindow{MaxOpsInvoked: 2, MaxOpsPerformed: 1}})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(context.Background(), sp.ListenAddr().String()))
+	require.Equal(t, 2, su.AsyncOpsWindow().MaxOpsInvoked)
+
+	filter := []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "foohah")}
+	first := su.CFind(QRLevelPatient, filter)
+	<-started
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	second := su.CFindContext(ctx, QRLevelPatient, filter)
+	<-fi.sent
+	<-fi.sent
+	cancel()
+	var results []CFindResult
+	for result := range second {
+		results = append(results, result)
+	}
+	require.Equal(t, 1, len(results))
+	requireCanceled(t, results[0].Err)
+
+	close(release)
+	for result := range first {
+		require.NoError(t, result.Err)
+	}
+	assert.Equal(t, 0, len(started), "The canceled request ran")
+}
+
+// The provider must not send datasets through C-GET unless the client takes the
+// SCP role for them.
+func TestCGetSCPRole(t *testing.T) {
+	var proposed []RoleSelection
+	sp := startTestProvider(t, ServiceProviderParams{
+		CGet: onCGetRequest,
+		AssociationPolicy: func(req *AssociationRequest) *pdu.AAssociateRj {
+			proposed = nil
+			for _, rs := range req.RoleSelections {
+				proposed = append(proposed, *rs)
+				if req.CallingAETitle == "noscp" {
+					rs.SCPRole = false
+				}
+			}
+			return nil
+		},
+	})
+	defer sp.Close()
+	cget := func(callingAETitle string, scpRoleSOPClasses []string) (int, error) {
+		su, err := NewServiceUser(ServiceUserParams{
+			CallingAETitle:    callingAETitle,
+			SOPClasses:        sopclass.QRGetClasses,
+			SCPRoleSOPClasses: scpRoleSOPClasses})
+		require.NoError(t, err)
+		defer su.Release()
+		su.Connect(sp.ListenAddr().String())
+		n := 0
+		err = su.CGet(QRLevelPatient,
+			[]*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "foohah")},
+			func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+				n++
+				return dimse.Success
+			})
+		return n, err
+	}
+	// Without the SCP role, the sole sub-operation fails, so does the C-GET.
+	requireCGetStatus := func(n int, err error, status dimse.StatusCode) {
+		assert.Equal(t, 0, n)
+		var dimseErr *DIMSEError
+		require.True(t, errors.As(err, &dimseErr), "Unexpected error: %v", err)
+		assert.Equal(t, status, dimseErr.Status.Status)
+	}
+	n, err := cget("norole", []string{})
+	requireCGetStatus(n, err, dimse.CMoveOutOfResourcesUnableToPerformSubOperations)
+	assert.Equal(t, 0, len(proposed))
+
+	// By default, the client takes the SCP role for the storage classes.
+	n, err = cget("default", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	require.Equal(t, len(sopclass.StorageClasses), len(proposed))
+	assert.Equal(t, RoleSelection{SOPClassUID: sopclass.StorageClasses[0], SCURole: true, SCPRole: true}, proposed[0])
+
+	n, err = cget("scp", sopclass.StorageClasses)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	n, err = cget("noscp", sopclass.StorageClasses)
+	requireCGetStatus(n, err, dimse.CMoveOutOfResourcesUnableToPerformSubOperations)
+}
+
+// Each side allocates message IDs on its own, so a C-GET sub-operation from the
+// provider may carry the same ID as another request outstanding on the client.
+// Both must complete.
+func TestCGetMessageIDCollision(t *testing.T) {
+	path := "testdata/reportsi.dcm"
+	echoStarted := make(chan struct{}, 1)
+	release := make(chan struct{})
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status {
+			echoStarted <- struct{}{}
+			select {
+			case <-release:
+			case <-time.After(10 * time.Second):
+			}
+			return dimse.Success
+		},
+		CGet: func(connState ConnectionState, transferSyntaxUID string, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+			for i := 0; i < 2; i++ {
+				ch <- CMoveResult{Remaining: 1 - i, Path: path, DataSet: mustReadDICOMFile(path)}
+			}
+			close(ch)
+		},
+		AsyncOpsWindow: &AsyncOpsWindow{MaxOpsInvoked: 2, MaxOpsPerformed: 2},
+	}, ":0")
+	require.NoError(t, err)
+	go sp.Run()
+	defer sp.Close()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:     append(append([]string{}, sopclass.QRGetClasses...), sopclass.VerificationClasses...),
+		AsyncOpsWindow: &AsyncOpsWindow{MaxOpsInvoked: 2, MaxOpsPerformed: 2}})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(context.Background(), sp.ListenAddr().String()))
+
+	// The C-GET and the provider's first sub-operation get the first
+	// message ID on each side. The C-ECHO started during the first
+	// sub-operation gets the second ID on the client, and it is still
+	// running when the second sub-operation arrives with the second ID on
+	// the provider.
+	echoErr := make(chan error, 1)
+	n := 0
+	err = su.CGet(QRLevelPatient,
+		[]*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "foohah")},
+		func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			n++
+			if n == 1 {
+				go func() { echoErr <- su.CEcho() }()
+				<-echoStarted
+			} else {
+				close(release)
+			}
+			return dimse.Success
+		})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	require.NoError(t, <-echoErr)
+}
+
+// With a window of 2, a C-FIND runs while the C-GET sub-operations arrive.
+// The responses to both requests, and the sub-operations, must reach the
+// right operation even when their message IDs collide.
+func TestCFindDuringCGet(t *testing.T) {
+	path := "testdata/reportsi.dcm"
+	subOpDone := make(chan struct{})
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CFind: func(conn ConnectionState, transferSyntaxUID string, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+			ch <- CFindResult{Elements: []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "foo")}}
+			// Send the second result after the next sub-operation.
+			select {
+			case <-subOpDone:
+			case <-time.After(10 * time.Second):
+			}
+			ch <- CFindResult{Elements: []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "bar")}}
+			close(ch)
+		},
+		CGet: func(connState ConnectionState, transferSyntaxUID string, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+			for i := 0; i < 3; i++ {
+				ch <- CMoveResult{Remaining: 2 - i, Path: path, DataSet: mustReadDICOMFile(path)}
+			}
+			close(ch)
+		},
+		AsyncOpsWindow: &AsyncOpsWindow{MaxOpsInvoked: 2, MaxOpsPerformed: 2},
+	}, ":0")
+	require.NoError(t, err)
+	go sp.Run()
+	defer sp.Close()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:     append(append([]string{}, sopclass.QRGetClasses...), sopclass.QRFindClasses...),
+		AsyncOpsWindow: &AsyncOpsWindow{MaxOpsInvoked: 2, MaxOpsPerformed: 2}})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(context.Background(), sp.ListenAddr().String()))
+	require.Equal(t, AsyncOpsWindow{MaxOpsInvoked: 2, MaxOpsPerformed: 2}, su.AsyncOpsWindow())
+
+	filter := []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "foohah")}
+	findStarted := make(chan struct{})
+	var findResults []CFindResult
+	findDone := make(chan struct{})
+	n := 0
+	err = su.CGet(QRLevelPatient, filter,
+		func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			n++
+			switch n {
+			case 1:
+				go func() {
+					defer close(findDone)
+					for result := range su.CFind(QRLevelPatient, filter) {
+						if len(findResults) == 0 {
+							close(findStarted)
+						}
+						findResults = append(findResults, result)
+					}
+					if len(findResults) == 0 {
+						close(findStarted)
+					}
+				}()
+				<-findStarted
+			case 2:
+				close(subOpDone)
+			}
+			return dimse.Success
+		})
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	<-findDone
+	require.Equal(t, 2, len(findResults))
+	for _, result := range findResults {
+		require.NoError(t, result.Err)
+	}
+}
+
+// The provider reports a warning if some, but not all, of the C-GET
+// sub-operations fail. As for C-MOVE, the warning is not an error.
+func TestCGetPartialFailure(t *testing.T) {
+	paths := []string{"testdata/reportsi.dcm", "testdata/IM-0001-0003.dcm"}
+	sp := startTestProvider(t, ServiceProviderParams{
+		CGet: func(connState ConnectionState, transferSyntaxUID string, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+			for i, path := range paths {
+				ch <- CMoveResult{Remaining: len(paths) - i - 1, Path: path, DataSet: mustReadDICOMFile(path)}
+			}
+			close(ch)
+		},
+	})
+	defer sp.Close()
+	// Take the SCP role only for the SOP class of the first file.
+	sopClassUID, _ := getSOPUIDs(t, mustReadDICOMFile(paths[0]))
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:        sopclass.QRGetClasses,
+		SCPRoleSOPClasses: []string{sopClassUID}})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	n := 0
+	err = su.CGet(QRLevelPatient,
+		[]*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "foohah")},
+		func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			n++
+			return dimse.Success
+		})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestUserIdentity(t *testing.T) {
+	identities := make(chan *UserIdentity, 1)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: func(conn ConnectionState) dimse.Status {
+			identities <- conn.UserIdentity
+			return dimse.Success
+		},
+		Authenticate: func(req *AssociationRequest) ([]byte, error) {
+			id := req.UserIdentity
+			switch {
+			case id == nil:
+				return nil, errors.New("No identity")
+			case id.Type == pdu.UserIdentityJWT:
+				return []byte("signed:" + string(id.PrimaryField)), nil
+			case id.Type == pdu.UserIdentityUsernamePasscode && string(id.PrimaryField) == "alice" && string(id.SecondaryField) == "secret":
+				return nil, nil
+			}
+			return nil, errors.New("Bad credentials")
+		},
+	}, ":0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	connect := func(id *UserIdentity) (*ServiceUser, error) {
+		su, err := NewServiceUser(ServiceUserParams{
+			SOPClasses:   sopclass.VerificationClasses,
+			UserIdentity: id})
+		require.NoError(t, err)
+		return su, su.ConnectContext(context.Background(), sp.ListenAddr().String())
+	}
+
+	su, err := connect(NewUsernamePasscodeIdentity("alice", "secret"))
+	require.NoError(t, err)
+	require.NoError(t, su.CEcho())
+	id := <-identities
+	require.NotNil(t, id)
+	assert.Equal(t, pdu.UserIdentityUsernamePasscode, id.Type)
+	assert.Equal(t, "alice", string(id.PrimaryField))
+	assert.Nil(t, su.UserIdentityResponse())
+	su.Release()
+
+	su, err = connect(&UserIdentity{
+		Type:                      pdu.UserIdentityJWT,
+		PrimaryField:              []byte("token"),
+		PositiveResponseRequested: true})
+	require.NoError(t, err)
+	assert.Equal(t, "signed:token", string(su.UserIdentityResponse()))
+	su.Release()
+
+	for _, id := range []*UserIdentity{nil, NewUsernamePasscodeIdentity("alice", "wrong")} {
+		su, err = connect(id)
+		assert.Error(t, err)
+		su.Release()
+	}
+
+	// The identity must fit in the 16-bit length of the sub-item.
+	_, err = NewServiceUser(ServiceUserParams{
+		SOPClasses: sopclass.VerificationClasses,
+		UserIdentity: &UserIdentity{
+			Type:         pdu.UserIdentityJWT,
+			PrimaryField: make([]byte, pdu.MaxUserIdentityLength+1)}})
+	assert.Error(t, err)
+	// It must also fit in the user information item, along with the other
+	// sub-items.
+	_, err = NewServiceUser(ServiceUserParams{
+		SOPClasses: sopclass.VerificationClasses,
+		UserIdentity: &UserIdentity{
+			Type:         pdu.UserIdentityJWT,
+			PrimaryField: make([]byte, pdu.MaxUserIdentityLength)}})
+	assert.Error(t, err)
+}
+
+func TestExtendedNegotiation(t *testing.T) {
+	var common []CommonExtendedNegotiation
+	accepted := make(chan []byte, 1)
+	sp := startTestProvider(t, ServiceProviderParams{
+		CFind: func(conn ConnectionState, transferSyntaxUID string, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+			accepted <- conn.ExtendedNegotiation[sopClassUID]
+			close(ch)
+		},
+		AssociationPolicy: func(req *AssociationRequest) *pdu.AAssociateRj {
+			for _, ext := range req.ExtendedNegotiations {
+				if ext.SOPClassUID == dicomuid.StudyRootQRFind && len(ext.Info) > CFindExtRelationalQueries {
+					// Support relational queries only.
+					ext.Response = []byte{ext.Info[CFindExtRelationalQueries]}
+				}
+			}
+			for _, c := range req.CommonExtendedNegotiations {
+				common = append(common, *c)
+			}
+			return nil
+		},
+	})
+	commonExt := CommonExtendedNegotiation{
+		SOPClassUID:                "1.2.3.4",
+		ServiceClassUID:            "1.2.840.10008.4.2",
+		RelatedGeneralSOPClassUIDs: []string{"1.2.840.10008.5.1.4.1.1.7"},
+	}
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: sopclass.QRFindClasses,
+		ExtendedNegotiation: map[string][]byte{
+			dicomuid.StudyRootQRFind:   {1, 0, 1},
+			dicomuid.PatientRootQRFind: {1},
+		},
+		CommonExtendedNegotiation: []CommonExtendedNegotiation{commonExt},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(context.Background(), sp.ListenAddr().String()))
+	assert.Equal(t, []byte{1}, su.ExtendedNegotiation(dicomuid.StudyRootQRFind))
+	assert.Nil(t, su.ExtendedNegotiation(dicomuid.PatientRootQRFind))
+	assert.Equal(t, []CommonExtendedNegotiation{commonExt}, common)
+
+	for result := range su.CFind(QRLevelStudy, nil) {
+		require.NoError(t, result.Err)
+	}
+	assert.Equal(t, []byte{1}, <-accepted)
+}
+
+// The client ignores an extended negotiation response for a SOP class it
+// didn't propose. P3.7 D.3.3.5.
+func TestUnsolicitedExtendedNegotiation(t *testing.T) {
+	sp := startTestProvider(t, ServiceProviderParams{
+		AssociationPolicy: func(req *AssociationRequest) *pdu.AAssociateRj {
+			for _, ext := range req.ExtendedNegotiations {
+				ext.Response = ext.Info
+			}
+			return nil
+		},
+	})
+	// The A-ASSOCIATE-AC carries the SOP class UID only in the extended
+	// negotiation response, so this rewrites the SOP class of the response.
+	SetProviderFaultInjector(&rewriteFaultInjector{
+		from: []byte(dicomuid.StudyRootQRFind),
+		to:   []byte(dicomuid.PatientRootQRFind),
+	})
+	defer SetProviderFaultInjector(nil)
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:          sopclass.QRFindClasses,
+		ExtendedNegotiation: map[string][]byte{dicomuid.StudyRootQRFind: {1}},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(context.Background(), sp.ListenAddr().String()))
+	assert.Nil(t, su.ExtendedNegotiation(dicomuid.StudyRootQRFind))
+	assert.Nil(t, su.ExtendedNegotiation(dicomuid.PatientRootQRFind))
+}
+
+// The provider must ignore sub-items it doesn't know about. P3.8 9.3.1.
+func TestUnknownSubItems(t *testing.T) {
+	vendorItem := &pdu.SubItemUnsupported{Type: 0xf0, Data: []byte{1, 2, 3}}
+	rq := &pdu.AAssociate{
+		Type:            pdu.TypeAAssociateRq,
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   "UNKNOWNITEMSTEST",
+		CallingAETitle:  "UNKNOWNITEMSTEST",
+		Items: []pdu.SubItem{
+			&pdu.ApplicationContextItem{Name: pdu.DICOMApplicationContextItemName},
+			&pdu.PresentationContextItem{
+				Type:      pdu.ItemTypePresentationContextRequest,
+				ContextID: 1,
+				Items: []pdu.SubItem{
+					&pdu.AbstractSyntaxSubItem{Name: dicomuid.VerificationSOPClass},
+					&pdu.TransferSyntaxSubItem{Name: dicomuid.ImplicitVRLittleEndian},
+					vendorItem,
+				}},
+			&pdu.UserInformationItem{Items: []pdu.SubItem{
+				&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: 16384},
+				vendorItem,
+			}},
+			vendorItem,
+		},
+	}
+	data, err := pdu.EncodePDU(rq)
+	require.NoError(t, err)
+	// The unknown items survive decoding, so a proxy can forward them.
+	decoded, err := pdu.ReadPDU(bytes.NewReader(data), DefaultMaxPDUSize)
+	require.NoError(t, err)
+	assert.Equal(t, rq, decoded)
+
+	conn, err := net.Dial("tcp", provider.ListenAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(data)
+	require.NoError(t, err)
+	resp, err := pdu.ReadPDU(conn, DefaultMaxPDUSize)
+	require.NoError(t, err)
+	ac, ok := resp.(*pdu.AAssociate)
+	require.True(t, ok, "Expect A-ASSOCIATE-AC, but found %v", resp)
+	assert.Equal(t, pdu.Type(pdu.TypeAAssociateAc), ac.Type)
+	found := false
+	for _, item := range ac.Items {
+		if pc, ok := item.(*pdu.PresentationContextItem); ok {
+			assert.Equal(t, pdu.PresentationContextAccepted, pc.Result)
+			found = true
+		}
+	}
+	assert.True(t, found, "No presentation context in %v", ac)
+}
+
+// Wait until cond returns true, polling it.
+func waitUntil(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProviderAbortAssociation(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{CEcho: onCEchoRequest}, ":0")
+	require.NoError(t, err)
+	runErr := make(chan error, 1)
+	go func() { runErr <- sp.Run() }()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		CallingAETitle: "aborttest",
+		SOPClasses:     sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(context.Background(), sp.ListenAddr().String()))
+	require.NoError(t, su.CEcho())
+
+	assocs := sp.Associations()
+	require.Equal(t, 1, len(assocs))
+	assert.Equal(t, "aborttest", assocs[0].CallingAETitle)
+	assert.Equal(t, 0, assocs[0].ActiveCommands)
+	require.True(t, sp.AbortAssociation(assocs[0].ID))
+	waitUntil(t, func() bool { return len(sp.Associations()) == 0 })
+	assert.False(t, sp.AbortAssociation(assocs[0].ID))
+
+	// The ServiceUser may take a moment to notice the abort.
+	var abortErr *AssociationAbortedError
+	waitUntil(t, func() bool { return errors.As(su.CEcho(), &abortErr) })
+	assert.Equal(t, pdu.SourceType(0), abortErr.Source)
+
+	require.NoError(t, sp.Close())
+	assert.Equal(t, ErrProviderClosed, <-runErr)
+}
+
+// Shutdown aborts the idle associations right away, and the busy ones once
+// their commands finish.
+func TestProviderShutdown(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho: onCEchoRequest,
+		CStore: func(connState ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			started <- struct{}{}
+			<-release
+			return dimse.Success
+		},
+	}, ":0")
+	require.NoError(t, err)
+	runErr := make(chan error, 1)
+	go func() { runErr <- sp.Run() }()
+
+	idleUser, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer idleUser.Release()
+	require.NoError(t, idleUser.ConnectContext(context.Background(), sp.ListenAddr().String()))
+	require.NoError(t, idleUser.CEcho())
+
+	busyUser, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses})
+	require.NoError(t, err)
+	defer busyUser.Release()
+	busyUser.Connect(sp.ListenAddr().String())
+	storeErr := make(chan error, 1)
+	go func() { storeErr <- busyUser.CStore(mustReadDICOMFile("testdata/IM-0001-0003.dcm")) }()
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- sp.Shutdown(context.Background()) }()
+	waitUntil(t, func() bool { return len(sp.Associations()) == 1 })
+	assert.Error(t, idleUser.CEcho())
+	assert.Equal(t, 1, sp.Associations()[0].ActiveCommands)
+
+	close(release)
+	require.NoError(t, <-storeErr)
+	require.NoError(t, <-shutdownErr)
+	assert.Equal(t, ErrProviderClosed, <-runErr)
+	assert.Equal(t, 0, len(sp.Associations()))
+}
+
+// slowSendFaultInjector delays every P-DATA-TF PDU sent, and closes "started"
+// once "n" of them have been sent.
+type slowSendFaultInjector struct {
+	delay   time.Duration
+	n       int
+	started chan struct{}
+	sent    int
+}
+
+func (fi *slowSendFaultInjector) onStateTransition(oldState stateType, event *stateEvent, action *stateAction, newState stateType) {
+}
+
+func (fi *slowSendFaultInjector) onSend(data []byte) faultInjectorAction {
+	if pdu.Type(data[0]) == pdu.TypePDataTf {
+		if fi.sent++; fi.sent == fi.n+1 {
+			close(fi.started)
+		}
+		time.Sleep(fi.delay)
+	}
+	return faultInjectorContinue
+}
+
+func (fi *slowSendFaultInjector) String() string {
+	return "slowSendFaultInjector"
+}
+
+// Shutdown waits for a C-STORE whose data is still arriving, even though the
+// C-STORE command hasn't started yet.
+func TestProviderShutdownWhileReceiving(t *testing.T) {
+	sp := startTestProvider(t, ServiceProviderParams{MaxPDUSize: 4096})
+	fi := &slowSendFaultInjector{delay: 20 * time.Millisecond, n: 3, started: make(chan struct{})}
+	SetUserFaultInjector(fi)
+	defer SetUserFaultInjector(nil)
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(context.Background(), sp.ListenAddr().String()))
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	storeErr := make(chan error, 1)
+	go func() { storeErr <- su.CStore(dataset) }()
+	<-fi.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	require.NoError(t, sp.Shutdown(ctx))
+	require.NoError(t, <-storeErr)
+	out, err := getCStoreData()
+	require.NoError(t, err)
+	checkFileBodiesEqual(t, dataset, out)
+}
+
+// Shutdown aborts the busy associations once its context expires.
+func TestProviderShutdownDeadline(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CStore: func(connState ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			started <- struct{}{}
+			<-release
+			return dimse.Success
+		},
+	}, ":0")
+	require.NoError(t, err)
+	go sp.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	storeErr := make(chan error, 1)
+	go func() { storeErr <- su.CStore(mustReadDICOMFile("testdata/IM-0001-0003.dcm")) }()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, sp.Shutdown(ctx))
+	assert.Error(t, <-storeErr)
+}
+
+func TestAssociationLimits(t *testing.T) {
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		CEcho:                       onCEchoRequest,
+		MaxAssociations:             2,
+		MaxAssociationsPerCallingAE: 1,
+	}, ":0")
+	require.NoError(t, err)
+	go sp.Run()
+	defer sp.Close()
+
+	connect := func(aeTitle string) (*ServiceUser, error) {
+		su, err := NewServiceUser(ServiceUserParams{
+			CallingAETitle: aeTitle,
+			SOPClasses:     sopclass.VerificationClasses})
+		require.NoError(t, err)
+		return su, su.ConnectContext(context.Background(), sp.ListenAddr().String())
+	}
+	checkRejected := func(err error) {
+		var rejectErr *AssociationRejectedError
+		require.True(t, errors.As(err, &rejectErr), "error: %v", err)
+		assert.True(t, rejectErr.Temporary())
+		assert.Equal(t, pdu.SourceULServiceProviderPresentation, rejectErr.Source)
+		assert.Equal(t, pdu.RejectReasonLocalLimitExceeded, rejectErr.Reason)
+	}
+
+	su1, err := connect("limitae1")
+	require.NoError(t, err)
+	// Same AE.
+	su, err := connect("limitae1")
+	checkRejected(err)
+	su.Release()
+	su2, err := connect("limitae2")
+	require.NoError(t, err)
+	defer su2.Release()
+	// Too many in total.
+	su, err = connect("limitae3")
+	checkRejected(err)
+	su.Release()
+
+	// The slot is freed once the association finishes.
+	su1.Release()
+	waitUntil(t, func() bool { return len(sp.Associations()) == 1 })
+	su3, err := connect("limitae3")
+	require.NoError(t, err)
+	defer su3.Release()
+	require.NoError(t, su3.CEcho())
+}
+
+// Create a self-signed certificate for "localhost", usable by both the
+// server and the client. Returns the certificate and a pool that trusts it.
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+func TestTLS(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+	var clientCerts [][]*x509.Certificate
+	var mu sync.Mutex
+	remoteAEs := map[string]string{}
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		},
+		RemoteAEs:       remoteAEs,
+		RemoteTLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool},
+		CEcho: func(connState ConnectionState) dimse.Status {
+			mu.Lock()
+			clientCerts = append(clientCerts, connState.TLS.PeerCertificates)
+			mu.Unlock()
+			return dimse.Success
+		},
+		CStore: onCStoreRequest,
+		CMove:  onCGetRequest,
+	}, "localhost:0")
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(sp.ListenAddr().String())
+	require.NoError(t, err)
+	serverAddr := net.JoinHostPort("localhost", port)
+	remoteAEs[testMoveDestination] = serverAddr
+	go sp.Run()
+	defer sp.Close()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: append(append([]string{}, sopclass.VerificationClasses...), sopclass.QRMoveClasses...),
+		TLSConfig:  &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(context.Background(), serverAddr))
+	require.NoError(t, su.CEcho())
+	state, ok := su.TLSConnectionState()
+	require.True(t, ok)
+	require.Equal(t, 1, len(state.PeerCertificates))
+	assert.True(t, cert.Leaf.Equal(state.PeerCertificates[0]))
+	mu.Lock()
+	require.Equal(t, 1, len(clientCerts))
+	assert.True(t, cert.Leaf.Equal(clientCerts[0][0]))
+	mu.Unlock()
+
+	// The C-STORE sub-association also runs TLS.
+	cstoreData = nil
+	var final CMoveProgress
+	for result := range su.CMove(QRLevelPatient, nil, testMoveDestination) {
+		require.NoError(t, result.Err)
+		final = result
+	}
+	require.Equal(t, 1, final.Completed)
+	ds, err := getCStoreData()
+	require.NoError(t, err)
+	checkFileBodiesEqual(t, mustReadDICOMFile("testdata/reportsi.dcm"), ds)
+
+	// A client without the certificate can't connect.
+	su2, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: sopclass.VerificationClasses,
+		TLSConfig:  &tls.Config{RootCAs: pool},
+	})
+	require.NoError(t, err)
+	defer su2.Release()
+	su2.Connect(serverAddr)
+	assert.Error(t, su2.CEcho())
+}
+
+func TestCertificateAETitles(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+	_, err := NewServiceProvider(ServiceProviderParams{
+		CertificateAETitles: map[string][]string{"localhost": {"certae"}},
+	}, ":0")
+	require.Error(t, err, "CertificateAETitles requires TLS")
+
+	sp, err := NewServiceProvider(ServiceProviderParams{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		},
+		CertificateAETitles: map[string][]string{"localhost": {"otherae", "certae"}},
+		CEcho:               onCEchoRequest,
+	}, "localhost:0")
+	require.NoError(t, err)
+	go sp.Run()
+	defer sp.Close()
+	_, port, err := net.SplitHostPort(sp.ListenAddr().String())
+	require.NoError(t, err)
+
+	connect := func(aeTitle string) error {
+		su, err := NewServiceUser(ServiceUserParams{
+			CallingAETitle: aeTitle,
+			SOPClasses:     sopclass.VerificationClasses,
+			TLSConfig:      &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool},
+		})
+		require.NoError(t, err)
+		defer su.Release()
+		if err := su.ConnectContext(context.Background(), net.JoinHostPort("localhost", port)); err != nil {
+			return err
+		}
+		return su.CEcho()
+	}
+	require.NoError(t, connect("certae"))
+	err = connect("spoofae")
+	var rejectErr *AssociationRejectedError
+	require.True(t, errors.As(err, &rejectErr), "error: %v", err)
+	assert.Equal(t, pdu.RejectReasonCallingAETitleNotRecognized, rejectErr.Reason)
+	assert.False(t, rejectErr.Temporary())
+}
+
+// Read from conn until it's closed, or an A-ABORT PDU arrives. Fails if
+// neither happens within "limit".
+func waitForAbortOrClose(t *testing.T, conn net.Conn, limit time.Duration) {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(limit)))
+	v, err := pdu.ReadPDU(conn, DefaultMaxPDUSize)
+	if err == nil {
+		_, ok := v.(*pdu.AAbort)
+		require.True(t, ok, "Unexpected PDU: %v", v)
+		return
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("Connection still open after %v", limit)
+	}
+}
+
+func TestARTIMTimeout(t *testing.T) {
+	sp := startTestProvider(t, ServiceProviderParams{ARTIMTimeout: 100 * time.Millisecond})
+	defer sp.Close()
+	conn, err := net.Dial("tcp", sp.ListenAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	// No A-ASSOCIATE-RQ is sent.
+	waitForAbortOrClose(t, conn, 5*time.Second)
+}
+
+func TestReadTimeout(t *testing.T) {
+	sp := startTestProvider(t, ServiceProviderParams{ReadTimeout: 100 * time.Millisecond})
+	defer sp.Close()
+	conn, err := net.Dial("tcp", sp.ListenAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	// Send only the first byte of an A-ASSOCIATE-RQ.
+	_, err = conn.Write([]byte{byte(pdu.TypeAAssociateRq)})
+	require.NoError(t, err)
+	waitForAbortOrClose(t, conn, 5*time.Second)
+}
+
+// actionRecorder records the names of the state machine actions run.
+type actionRecorder struct {
+	mu      sync.Mutex
+	actions map[string]bool
+}
+
+func (fi *actionRecorder) onStateTransition(oldState stateType, event *stateEvent, action *stateAction, newState stateType) {
+	fi.mu.Lock()
+	fi.actions[action.Name] = true
+	fi.mu.Unlock()
+}
+
+func (fi *actionRecorder) onSend(data []byte) faultInjectorAction {
+	return faultInjectorContinue
+}
+
+func (fi *actionRecorder) String() string {
+	return "actionRecorder"
+}
+
+func (fi *actionRecorder) ran(name string) bool {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.actions[name]
+}
+
+func TestUserIdleTimeout(t *testing.T) {
+	sp := startTestProvider(t, ServiceProviderParams{})
+	defer sp.Close()
+	fi := &actionRecorder{actions: map[string]bool{}}
+	SetProviderFaultInjector(fi)
+	defer SetProviderFaultInjector(nil)
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:  sopclass.VerificationClasses,
+		IdleTimeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(context.Background(), sp.ListenAddr().String()))
+	require.NoError(t, su.CEcho())
+	waitUntil(t, func() bool { return len(sp.Associations()) == 0 })
+	err = su.CEcho()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Connection failed")
+	var abortErr *AssociationAbortedError
+	assert.False(t, errors.As(err, &abortErr), "Unexpected error: %v", err)
+
+	// Release after the idle release is a no-op.
+	su.Release()
+	su.Release()
+	// AR-2 is run when the A-RELEASE-RQ arrives, and AA-3 when an A-ABORT
+	// arrives.
+	assert.True(t, fi.ran("AR-2"))
+	assert.False(t, fi.ran("AA-3"))
+}
+
+func TestProviderIdleTimeout(t *testing.T) {
+	sp := startTestProvider(t, ServiceProviderParams{IdleTimeout: 100 * time.Millisecond})
+	defer sp.Close()
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(context.Background(), sp.ListenAddr().String()))
+	require.NoError(t, su.CEcho())
+	waitUntil(t, func() bool { return len(sp.Associations()) == 0 })
+	var abortErr *AssociationAbortedError
+	waitUntil(t, func() bool { return errors.As(su.CEcho(), &abortErr) })
+}
+
+// pduSizeFaultInjector records the length of the largest P-DATA-TF PDU sent,
+// and of the A-ASSOCIATE-RQ PDU.
+type pduSizeFaultInjector struct {
+	mu         sync.Mutex
+	maxLen     int
+	assocRqLen int
+}
+
+func (fi *pduSizeFaultInjector) onStateTransition(oldState stateType, event *stateEvent, action *stateAction, newState stateType) {
+}
+
+func (fi *pduSizeFaultInjector) onSend(data []byte) faultInjectorAction {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	switch pdu.Type(data[0]) {
+	case pdu.TypePDataTf:
+		if n := len(data) - 6; n > fi.maxLen {
+			fi.maxLen = n
+		}
+	case pdu.TypeAAssociateRq:
+		fi.assocRqLen = len(data) - 6
+	}
+	return faultInjectorContinue
+}
+
+func (fi *pduSizeFaultInjector) String() string {
+	return "pduSizeFaultInjector"
+}
+
+func TestMaxPDUSize(t *testing.T) {
+	_, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses, MaxPDUSize: 100})
+	require.Error(t, err)
+
+	sp := startTestProvider(t, ServiceProviderParams{MaxPDUSize: 4096})
+	defer sp.Close()
+	fi := &pduSizeFaultInjector{}
+	SetUserFaultInjector(fi)
+	defer SetUserFaultInjector(nil)
+
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: sopclass.StorageClasses,
+		MaxPDUSize: UnlimitedPDUSize})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(context.Background(), sp.ListenAddr().String()))
+	require.NoError(t, su.CStore(dataset))
+	out, err := getCStoreData()
+	require.NoError(t, err)
+	checkFileBodiesEqual(t, dataset, out)
+
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	assert.True(t, fi.maxLen > 0)
+	assert.True(t, fi.maxLen <= 4096, "PDU length %d", fi.maxLen)
+}
+
+// The max PDU size applies only to P-DATA-TF PDUs. The provider should accept
+// an A-ASSOCIATE-RQ much larger than that. P3.8 D.1.
+func TestMaxPDUSizeLargeAssociateRequest(t *testing.T) {
+	sp := startTestProvider(t, ServiceProviderParams{MaxPDUSize: minMaxPDUSize})
+	defer sp.Close()
+	fi := &pduSizeFaultInjector{}
+	SetUserFaultInjector(fi)
+	defer SetUserFaultInjector(nil)
+
+	sopClasses := append([]string{}, sopclass.VerificationClasses...)
+	sopClasses = append(sopClasses, sopclass.StorageClasses...)
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(context.Background(), sp.ListenAddr().String()))
+	require.NoError(t, su.CEcho())
+
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	assert.True(t, fi.assocRqLen > 2*minMaxPDUSize, "A-ASSOCIATE-RQ length %d", fi.assocRqLen)
+}
+
+// The provider advertises 4096 bytes, but the client is told 65536 bytes. The
+// provider should abort the association once it receives a larger PDU.
+func TestMaxPDUSizeExceeded(t *testing.T) {
+	sp := startTestProvider(t, ServiceProviderParams{MaxPDUSize: 4096})
+	defer sp.Close()
+	SetProviderFaultInjector(&rewriteFaultInjector{
+		from: []byte{byte(pdu.ItemTypeUserInformationMaximumLength), 0, 0, 4, 0, 0, 0x10, 0},
+		to:   []byte{byte(pdu.ItemTypeUserInformationMaximumLength), 0, 0, 4, 0, 1, 0, 0},
+	})
+	defer SetProviderFaultInjector(nil)
+
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(context.Background(), sp.ListenAddr().String()))
+	require.Error(t, su.CStore(dataset))
+	waitUntil(t, func() bool { return len(sp.Associations()) == 0 })
+}
+
+// Encode the body of "ds", i.e., the elements other than the meta
+// information, in the given transfer syntax.
+func encodeDataSetBody(t *testing.T, ds *dicom.DataSet, transferSyntaxUID string) []byte {
+	e := dicomio.NewBytesEncoderWithTransferSyntax(transferSyntaxUID)
+	for _, elem := range ds.Elements {
+		if elem.Tag.Group != dicomtag.MetadataGroup {
+			dicom.WriteElement(e, elem)
+		}
+	}
+	require.NoError(t, e.Error())
+	return e.Bytes()
+}
+
+// Return the SOP class and instance UIDs of "ds".
+func getSOPUIDs(t *testing.T, ds *dicom.DataSet) (string, string) {
+	sopClassUID, err := ds.FindElementByTag(dicomtag.MediaStorageSOPClassUID)
+	require.NoError(t, err)
+	sopInstanceUID, err := ds.FindElementByTag(dicomtag.MediaStorageSOPInstanceUID)
+	require.NoError(t, err)
+	return sopClassUID.MustGetString(), sopInstanceUID.MustGetString()
+}
+
+func TestCStoreStream(t *testing.T) {
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	sopClassUID, sopInstanceUID := getSOPUIDs(t, dataset)
+	body := encodeDataSetBody(t, dataset, dicomuid.ExplicitVRLittleEndian)
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.StorageClasses,
+		TransferSyntaxes: []string{dicomuid.ExplicitVRLittleEndian}})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(context.Background(), provider.ListenAddr().String()))
+
+	// The data must be in the negotiated transfer syntax.
+	err = su.CStoreStream(context.Background(), sopClassUID, sopInstanceUID, dicomuid.ImplicitVRLittleEndian, bytes.NewReader(body))
+	require.Error(t, err)
+
+	cstoreData = nil
+	require.NoError(t, su.CStoreStream(context.Background(), sopClassUID, sopInstanceUID, dicomuid.ExplicitVRLittleEndian, bytes.NewReader(body)))
+	out, err := getCStoreData()
+	require.NoError(t, err)
+	checkFileBodiesEqual(t, dataset, out)
+}
+
+// cancelReader calls cancel after the first read.
+type cancelReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.cancel()
+	return n, err
+}
+
+// CStoreStream notices an expired context between reads, and aborts the
+// association.
+func TestCStoreStreamContext(t *testing.T) {
+	sp := startTestProvider(t, ServiceProviderParams{MaxPDUSize: 4096})
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	sopClassUID, sopInstanceUID := getSOPUIDs(t, dataset)
+	body := encodeDataSetBody(t, dataset, dicomuid.ExplicitVRLittleEndian)
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.StorageClasses,
+		TransferSyntaxes: []string{dicomuid.ExplicitVRLittleEndian}})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(context.Background(), sp.ListenAddr().String()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &cancelReader{r: bytes.NewReader(body), cancel: cancel}
+	err = su.CStoreStream(ctx, sopClassUID, sopInstanceUID, dicomuid.ExplicitVRLittleEndian, r)
+	var contextErr *ContextError
+	require.True(t, errors.As(err, &contextErr), "Unexpected error: %v", err)
+	assert.True(t, errors.Is(err, context.Canceled))
+	require.Error(t, su.CEcho())
+}
+
+// errorReader returns err on every read.
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+// A read error in the middle of the data aborts the association.
+func TestCStoreStreamReadError(t *testing.T) {
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	sopClassUID, sopInstanceUID := getSOPUIDs(t, dataset)
+	body := encodeDataSetBody(t, dataset, dicomuid.ExplicitVRLittleEndian)
+	// Small PDUs, so that a part of the data is sent before the error.
+	sp := startTestProvider(t, ServiceProviderParams{MaxPDUSize: 4096})
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.StorageClasses,
+		TransferSyntaxes: []string{dicomuid.ExplicitVRLittleEndian}})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(context.Background(), sp.ListenAddr().String()))
+
+	readErr := errors.New("test read error")
+	r := io.MultiReader(bytes.NewReader(body[:len(body)/2]), &errorReader{readErr})
+	err = su.CStoreStream(context.Background(), sopClassUID, sopInstanceUID, dicomuid.ExplicitVRLittleEndian, r)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, readErr), "Unexpected error: %v", err)
+	require.Error(t, su.CEcho())
+}
+
+// A read error before any data is sent fails the request, but the
+// association stays usable.
+func TestCStoreStreamFirstReadError(t *testing.T) {
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	sopClassUID, sopInstanceUID := getSOPUIDs(t, dataset)
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       append(append([]string{}, sopclass.StorageClasses...), sopclass.VerificationClasses...),
+		TransferSyntaxes: []string{dicomuid.ExplicitVRLittleEndian}})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(context.Background(), provider.ListenAddr().String()))
+
+	readErr := errors.New("test read error")
+	err = su.CStoreStream(context.Background(), sopClassUID, sopInstanceUID, dicomuid.ExplicitVRLittleEndian, &errorReader{readErr})
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, readErr), "Unexpected error: %v", err)
+	require.NoError(t, su.CEcho())
+}
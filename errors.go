@@ -0,0 +1,83 @@
+package netdicom
+
+// This file defines the errors that report a failure of the peer, so that the
+// caller can tell a rejected association from an aborted one, or from a
+// DIMSE operation that failed.
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/pdu"
+)
+
+// AssociationRejectedError is returned when the peer rejects the
+// A-ASSOCIATE request with an A-ASSOCIATE-RJ PDU. P3.8 9.3.4.
+type AssociationRejectedError struct {
+	Result pdu.RejectResultType
+	Source pdu.SourceType
+	Reason pdu.RejectReasonType
+}
+
+func (e *AssociationRejectedError) Error() string {
+	return fmt.Sprintf("dicom: association rejected: result %v, source %v, reason %v", e.Result, e.Source, e.Reason)
+}
+
+// Temporary reports whether the peer rejected the association transiently, in
+// which case the request may succeed if retried later.
+func (e *AssociationRejectedError) Temporary() bool {
+	return e.Result == pdu.ResultRejectedTransient
+}
+
+// AssociationAbortedError is returned when the association is aborted by an
+// A-ABORT PDU. P3.8 9.3.8. Source is 0 if the peer's service-user aborted the
+// association, and 2 if the service-provider (the DICOM UL of either side)
+// did so, e.g., on a protocol error. Reason is meaningful only in the latter
+// case.
+type AssociationAbortedError struct {
+	Source pdu.SourceType
+	Reason pdu.AbortReasonType
+}
+
+func (e *AssociationAbortedError) Error() string {
+	source := "service-provider"
+	if e.Source == 0 {
+		source = "service-user"
+	}
+	return fmt.Sprintf("dicom: association aborted by %s: reason %v", source, e.Reason)
+}
+
+// DIMSEError is returned when the peer responds to a DIMSE request with a
+// status other than success, pending, or cancel.
+type DIMSEError struct {
+	// Op is the operation that failed, e.g., "C-STORE".
+	Op string
+	// Status is the status found in the response.
+	Status dimse.Status
+}
+
+func (e *DIMSEError) Error() string {
+	if e.Status.ErrorComment == "" {
+		return fmt.Sprintf("dicom: %s failed: %v", e.Op, e.Status.Status)
+	}
+	return fmt.Sprintf("dicom: %s failed: %v: %s", e.Op, e.Status.Status, e.Status.ErrorComment)
+}
+
+// Returned by runCStoreOnAssociation when the association closes before the
+// C-STORE response arrives.
+var errConnectionClosed = errors.New("dicom.cstore: Connection closed while waiting for C-STORE response")
+
+// Returned by runCStoreStream when reading the C-STORE data fails.
+type streamReadError struct {
+	err error
+	// sent is true if a part of the request was sent before the read
+	// failed.
+	sent bool
+}
+
+func (e *streamReadError) Error() string {
+	return fmt.Sprintf("dicom.cstore: Failed to read C-STORE data: %v", e.err)
+}
+
+func (e *streamReadError) Unwrap() error { return e.err }
@@ -0,0 +1,49 @@
+package netdicom
+
+// This file implements SOP Class Extended Negotiation and SOP Class Common
+// Extended Negotiation. P3.7 D.3.3.5, D.3.3.6.
+
+// ExtendedNegotiation holds the service-class-specific information proposed
+// for a SOP class in an A-ASSOCIATE-RQ.
+type ExtendedNegotiation struct {
+	SOPClassUID string
+	// Info is the service class application information proposed by the
+	// requestor. For C-FIND, the bytes are indexed by the CFindExt*
+	// constants.
+	Info []byte
+	// Response, if non-nil, is sent back in the A-ASSOCIATE-AC as the
+	// information accepted by the server. AssociationPolicy may set it. If
+	// nil, the server doesn't respond, meaning that none of the options is
+	// supported.
+	Response []byte
+}
+
+// CommonExtendedNegotiation relates a SOP class to its service class and to
+// general SOP classes, e.g., a private storage SOP class to the standard
+// storage service. The server doesn't respond to it.
+type CommonExtendedNegotiation struct {
+	SOPClassUID                string
+	ServiceClassUID            string
+	RelatedGeneralSOPClassUIDs []string
+}
+
+// Indexes of the C-FIND extended negotiation information. Each byte is 1 if
+// the option is proposed or accepted, 0 otherwise. P3.4 C.3.5.
+const (
+	CFindExtRelationalQueries = iota
+	CFindExtDateTimeMatching
+	CFindExtFuzzySemanticMatching
+	CFindExtTimezoneQueryAdjustment
+)
+
+// ExtendedNegotiation returns the service class application information
+// accepted by the peer for the SOP class, or nil if the peer didn't respond
+// to ServiceUserParams.ExtendedNegotiation for the class.
+func (su *ServiceUser) ExtendedNegotiation(sopClassUID string) []byte {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	if su.cm == nil {
+		return nil
+	}
+	return su.cm.extendedNegotiationResponses[sopClassUID]
+}
@@ -0,0 +1,108 @@
+package netdicom
+
+// This file implements the limits on the number of associations accepted by a
+// ServiceProvider.
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/grailbio/go-dicom/dicomlog"
+	"github.com/grailbio/go-netdicom/pdu"
+)
+
+// associationLimiter counts the associations accepted by a ServiceProvider,
+// in total, per calling AE title, and per remote IP address. Thread safe.
+type associationLimiter struct {
+	maxTotal, maxPerAE, maxPerIP int
+
+	mu    sync.Mutex
+	total int            // guarded by mu
+	perAE map[string]int // guarded by mu
+	perIP map[string]int // guarded by mu
+}
+
+// Create a limiter for params. Returns nil if params sets no limit.
+func newAssociationLimiter(params *ServiceProviderParams) *associationLimiter {
+	if params.MaxAssociations <= 0 && params.MaxAssociationsPerCallingAE <= 0 && params.MaxAssociationsPerIP <= 0 {
+		return nil
+	}
+	return &associationLimiter{
+		maxTotal: params.MaxAssociations,
+		maxPerAE: params.MaxAssociationsPerCallingAE,
+		maxPerIP: params.MaxAssociationsPerIP,
+		perAE:    map[string]int{},
+		perIP:    map[string]int{},
+	}
+}
+
+// Reserve a slot for an association from the given AE and IP address. Returns
+// false if any of the limits is reached. On success, the caller must call
+// release with the same args once the association finishes.
+func (l *associationLimiter) acquire(callingAETitle, ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return false
+	}
+	if l.maxPerAE > 0 && l.perAE[callingAETitle] >= l.maxPerAE {
+		return false
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return false
+	}
+	l.total++
+	l.perAE[callingAETitle]++
+	l.perIP[ip]++
+	return true
+}
+
+func (l *associationLimiter) release(callingAETitle, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perAE[callingAETitle]--; l.perAE[callingAETitle] == 0 {
+		delete(l.perAE, callingAETitle)
+	}
+	if l.perIP[ip]--; l.perIP[ip] == 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// Extract the IP address from addr. Returns addr.String() if it isn't an
+// IP:port pair.
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Reserve a slot in sm.limiter for the association requested by "v". Returns
+// non-nil if a limit is reached, and the association is to be rejected.
+// P3.8 9.3.4.
+func checkAssociationLimits(sm *stateMachine, v *pdu.AAssociate) *pdu.AAssociateRj {
+	if sm.limiter == nil {
+		return nil
+	}
+	callingAETitle := strings.TrimSpace(v.CallingAETitle)
+	var ip string
+	if sm.conn != nil {
+		ip = remoteIP(sm.conn.RemoteAddr())
+	}
+	if !sm.limiter.acquire(callingAETitle, ip) {
+		dicomlog.Vprintf(0, "dicom.stateMachine(%s): Too many associations from %v (%v)", sm.label, callingAETitle, ip)
+		return &pdu.AAssociateRj{
+			Result: pdu.ResultRejectedTransient,
+			Source: pdu.SourceULServiceProviderPresentation,
+			Reason: pdu.RejectReasonLocalLimitExceeded,
+		}
+	}
+	sm.releaseLimit = func() { sm.limiter.release(callingAETitle, ip) }
+	return nil
+}
@@ -0,0 +1,212 @@
+package netdicom
+
+// This file implements the Modality Performed Procedure Step (MPPS) service
+// using N-CREATE and N-SET. P3.4 F.7.
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/sopclass"
+)
+
+// MPPSCreateCallback is called by the server on an N-CREATE request for an
+// MPPS instance. sopInstanceUID is the UID of the new instance. It is
+// allocated by the server if the requestor didn't specify one. "elems" is the
+// dataset sent by the requestor. The callback should return dimse.Success if
+// the instance was created.
+type MPPSCreateCallback func(
+	conn ConnectionState,
+	sopInstanceUID string,
+	elems []*dicom.Element) dimse.Status
+
+// MPPSSetCallback is called by the server on an N-SET request for an MPPS
+// instance. "elems" lists the attributes to be updated. The callback should
+// return dimse.Success if the instance was updated.
+type MPPSSetCallback func(
+	conn ConnectionState,
+	sopInstanceUID string,
+	elems []*dicom.Element) dimse.Status
+
+// Read the dataset of an N-CREATE or N-SET request.
+func readNDataSet(hasData bool, data []byte, transferSyntaxUID string) ([]*dicom.Element, dimse.Status) {
+	if !hasData {
+		return nil, dimse.Success
+	}
+	elems, err := readElementsInBytes(data, transferSyntaxUID)
+	if err != nil {
+		return nil, dimse.Status{
+			Status:       dimse.StatusProcessingFailure,
+			ErrorComment: err.Error(),
+		}
+	}
+	return elems, dimse.Success
+}
+
+func handleNCreate(
+	params ServiceProviderParams,
+	connState ConnectionState,
+	c *dimse.NCreateRq, data []byte,
+	cs *serviceCommandState) {
+	sopInstanceUID := c.AffectedSOPInstanceUID
+	var status dimse.Status
+	switch {
+	case c.AffectedSOPClassUID != sopclass.MPPSClasses[0]:
+		status = dimse.Status{
+			Status:       dimse.StatusNoSuchSOPClass,
+			ErrorComment: fmt.Sprintf("N-CREATE not supported for %v", c.AffectedSOPClassUID),
+		}
+	case params.MPPSCreate == nil:
+		status = dimse.Status{
+			Status:       dimse.StatusUnrecognizedOperation,
+			ErrorComment: "No callback found for N-CREATE",
+		}
+	default:
+		var elems []*dicom.Element
+		elems, status = readNDataSet(c.HasData(), data, cs.context.transferSyntaxUID)
+		if status.Status == dimse.StatusSuccess {
+			if sopInstanceUID == "" {
+				sopInstanceUID = newDICOMUID()
+			}
+			status = params.MPPSCreate(connState, sopInstanceUID, elems)
+		}
+	}
+	cs.sendMessage(&dimse.NCreateRsp{
+		AffectedSOPClassUID:       c.AffectedSOPClassUID,
+		MessageIDBeingRespondedTo: c.MessageID,
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		AffectedSOPInstanceUID:    sopInstanceUID,
+		Status:                    status,
+	}, nil)
+}
+
+func handleNSet(
+	params ServiceProviderParams,
+	connState ConnectionState,
+	c *dimse.NSetRq, data []byte,
+	cs *serviceCommandState) {
+	var status dimse.Status
+	switch {
+	case c.RequestedSOPClassUID != sopclass.MPPSClasses[0]:
+		status = dimse.Status{
+			Status:       dimse.StatusNoSuchSOPClass,
+			ErrorComment: fmt.Sprintf("N-SET not supported for %v", c.RequestedSOPClassUID),
+		}
+	case params.MPPSSet == nil:
+		status = dimse.Status{
+			Status:       dimse.StatusUnrecognizedOperation,
+			ErrorComment: "No callback found for N-SET",
+		}
+	default:
+		var elems []*dicom.Element
+		elems, status = readNDataSet(c.HasData(), data, cs.context.transferSyntaxUID)
+		if status.Status == dimse.StatusSuccess {
+			status = params.MPPSSet(connState, c.RequestedSOPInstanceUID, elems)
+		}
+	}
+	cs.sendMessage(&dimse.NSetRsp{
+		AffectedSOPClassUID:       c.RequestedSOPClassUID,
+		MessageIDBeingRespondedTo: c.MessageID,
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		AffectedSOPInstanceUID:    c.RequestedSOPInstanceUID,
+		Status:                    status,
+	}, nil)
+}
+
+// Send an N-CREATE or N-SET request for an MPPS instance, and wait for the
+// response. "newRequest" creates the request given the message ID, and "op"
+// is used in error messages.
+func (su *ServiceUser) runMPPSCommand(
+	op string,
+	elems []*dicom.Element,
+	newRequest func(sopClassUID string, messageID dimse.MessageID) dimse.Message) (dimse.Message, error) {
+	err := su.startOp(context.Background(), op)
+	if err != nil {
+		return nil, err
+	}
+	defer su.finishOp()
+	context, err := su.cm.lookupByAbstractSyntaxUID(sopclass.MPPSClasses[0])
+	if err != nil {
+		return nil, err
+	}
+	payload, err := writeElementsToBytes(elems, context.transferSyntaxUID)
+	if err != nil {
+		return nil, err
+	}
+	cs, err := su.disp.newCommand(su.cm, context)
+	if err != nil {
+		return nil, err
+	}
+	defer su.disp.deleteCommand(cs)
+	cs.sendMessage(newRequest(context.abstractSyntaxUID, cs.messageID), payload)
+	event, ok := <-cs.upcallCh
+	if !ok {
+		return nil, su.closedError(op)
+	}
+	s := event.command.GetStatus()
+	if s == nil {
+		return nil, fmt.Errorf("Received %s response without status: %v", op, event.command)
+	}
+	if s.Status != dimse.StatusSuccess {
+		return nil, &DIMSEError{Op: op, Status: *s}
+	}
+	return event.command, nil
+}
+
+// MPPSCreate issues an N-CREATE request to create an MPPS instance with the
+// attributes in "elems". sopInstanceUID is the UID of the new instance. If it
+// is empty, the peer allocates one. Returns the UID of the instance created.
+//
+// ServiceUserParams.SOPClasses must include sopclass.MPPSClasses.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) MPPSCreate(sopInstanceUID string, elems []*dicom.Element) (string, error) {
+	resp, err := su.runMPPSCommand("N-CREATE", elems,
+		func(sopClassUID string, messageID dimse.MessageID) dimse.Message {
+			return &dimse.NCreateRq{
+				AffectedSOPClassUID:    sopClassUID,
+				MessageID:              messageID,
+				CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
+				AffectedSOPInstanceUID: sopInstanceUID,
+			}
+		})
+	if err != nil {
+		return "", err
+	}
+	rsp, ok := resp.(*dimse.NCreateRsp)
+	if !ok {
+		return "", fmt.Errorf("Found wrong response for N-CREATE: %v", resp)
+	}
+	if rsp.AffectedSOPInstanceUID != "" {
+		sopInstanceUID = rsp.AffectedSOPInstanceUID
+	}
+	if sopInstanceUID == "" {
+		return "", fmt.Errorf("N-CREATE response lacks the SOP instance UID: %v", rsp)
+	}
+	return sopInstanceUID, nil
+}
+
+// MPPSSet issues an N-SET request to update the attributes of an MPPS
+// instance, e.g., to set PerformedProcedureStepStatus to "COMPLETED".
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) MPPSSet(sopInstanceUID string, elems []*dicom.Element) error {
+	resp, err := su.runMPPSCommand("N-SET", elems,
+		func(sopClassUID string, messageID dimse.MessageID) dimse.Message {
+			return &dimse.NSetRq{
+				RequestedSOPClassUID:    sopClassUID,
+				MessageID:               messageID,
+				CommandDataSetType:      dimse.CommandDataSetTypeNonNull,
+				RequestedSOPInstanceUID: sopInstanceUID,
+			}
+		})
+	if err != nil {
+		return err
+	}
+	if _, ok := resp.(*dimse.NSetRsp); !ok {
+		return fmt.Errorf("Found wrong response for N-SET: %v", resp)
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ package pdu
 //go:generate stringer -type RejectResultType
 //go:generate stringer -type SourceType
 //go:generate stringer -type Type
+//go:generate stringer -type UserIdentityType
 
 // Implements message types defined in P3.8. It sits below the DIMSE layer.
 //
@@ -53,17 +54,21 @@ type SubItem interface {
 
 // Possible Type field values for SubItem.
 const (
-	ItemTypeApplicationContext           = 0x10
-	ItemTypePresentationContextRequest   = 0x20
-	ItemTypePresentationContextResponse  = 0x21
-	ItemTypeAbstractSyntax               = 0x30
-	ItemTypeTransferSyntax               = 0x40
-	ItemTypeUserInformation              = 0x50
-	ItemTypeUserInformationMaximumLength = 0x51
-	ItemTypeImplementationClassUID       = 0x52
-	ItemTypeAsynchronousOperationsWindow = 0x53
-	ItemTypeRoleSelection                = 0x54
-	ItemTypeImplementationVersionName    = 0x55
+	ItemTypeApplicationContext                = 0x10
+	ItemTypePresentationContextRequest        = 0x20
+	ItemTypePresentationContextResponse       = 0x21
+	ItemTypeAbstractSyntax                    = 0x30
+	ItemTypeTransferSyntax                    = 0x40
+	ItemTypeUserInformation                   = 0x50
+	ItemTypeUserInformationMaximumLength      = 0x51
+	ItemTypeImplementationClassUID            = 0x52
+	ItemTypeAsynchronousOperationsWindow      = 0x53
+	ItemTypeRoleSelection                     = 0x54
+	ItemTypeImplementationVersionName         = 0x55
+	ItemTypeSOPClassExtendedNegotiation       = 0x56
+	ItemTypeSOPClassCommonExtendedNegotiation = 0x57
+	ItemTypeUserIdentityRequest               = 0x58
+	ItemTypeUserIdentityResponse              = 0x59
 )
 
 func decodeSubItem(d *dicomio.Decoder) SubItem {
@@ -93,12 +98,24 @@ func decodeSubItem(d *dicomio.Decoder) SubItem {
 		return decodeRoleSelectionSubItem(d, length)
 	case ItemTypeImplementationVersionName:
 		return decodeImplementationVersionNameSubItem(d, length)
+	case ItemTypeSOPClassExtendedNegotiation:
+		return decodeSOPClassExtendedNegotiationSubItem(d, length)
+	case ItemTypeSOPClassCommonExtendedNegotiation:
+		return decodeSOPClassCommonExtendedNegotiationSubItem(d, length)
+	case ItemTypeUserIdentityRequest:
+		return decodeUserIdentitySubItem(d, length)
+	case ItemTypeUserIdentityResponse:
+		return decodeUserIdentityResponseSubItem(d, length)
 	default:
-		d.SetError(fmt.Errorf("Unknown item type: 0x%x", itemType))
-		return nil
+		// Keep the item verbatim, so that the receiver can ignore it,
+		// or a proxy can forward it. P3.8 9.3.1.
+		return &SubItemUnsupported{Type: itemType, Data: d.ReadBytes(int(length))}
 	}
 }
 
+// The max length of an item or a sub-item, excluding the header.
+const maxItemLength = 0xffff
+
 func encodeSubItemHeader(e *dicomio.Encoder, itemType byte, length uint16) {
 	e.WriteByte(itemType)
 	e.WriteZeros(1)
@@ -120,6 +137,10 @@ func (v *UserInformationItem) Write(e *dicomio.Encoder) {
 		return
 	}
 	itemBytes := itemEncoder.Bytes()
+	if len(itemBytes) > maxItemLength {
+		e.SetError(fmt.Errorf("UserInformationItem too long: %dB", len(itemBytes)))
+		return
+	}
 	encodeSubItemHeader(e, ItemTypeUserInformation, uint16(len(itemBytes)))
 	e.WriteBytes(itemBytes)
 }
@@ -232,6 +253,185 @@ func (v *RoleSelectionSubItem) String() string {
 	return fmt.Sprintf("RoleSelection{sopclassuid: %v, scu: %v, scp: %v}", v.SOPClassUID, v.SCURole, v.SCPRole)
 }
 
+// PS3.7 Annex D.3.3.5
+type SOPClassExtendedNegotiationSubItem struct {
+	SOPClassUID string
+	// Service-class-specific information, e.g., the C-FIND options defined
+	// in PS3.4 C.3.5.
+	ServiceClassApplicationInformation []byte
+}
+
+func decodeSOPClassExtendedNegotiationSubItem(d *dicomio.Decoder, length uint16) *SOPClassExtendedNegotiationSubItem {
+	v := &SOPClassExtendedNegotiationSubItem{}
+	uidLen := d.ReadUInt16()
+	if int(length) < 2+int(uidLen) {
+		d.SetError(fmt.Errorf("SOPClassExtendedNegotiationSubItem too short: %dB", length))
+		return v
+	}
+	v.SOPClassUID = d.ReadString(int(uidLen))
+	v.ServiceClassApplicationInformation = d.ReadBytes(int(length) - 2 - int(uidLen))
+	return v
+}
+
+func (v *SOPClassExtendedNegotiationSubItem) Write(e *dicomio.Encoder) {
+	encodeSubItemHeader(e, ItemTypeSOPClassExtendedNegotiation,
+		uint16(2+len(v.SOPClassUID)+len(v.ServiceClassApplicationInformation)))
+	e.WriteUInt16(uint16(len(v.SOPClassUID)))
+	e.WriteString(v.SOPClassUID)
+	e.WriteBytes(v.ServiceClassApplicationInformation)
+}
+
+func (v *SOPClassExtendedNegotiationSubItem) String() string {
+	return fmt.Sprintf("SOPClassExtendedNegotiation{sopclassuid: %v, info: %v}",
+		v.SOPClassUID, v.ServiceClassApplicationInformation)
+}
+
+// PS3.7 Annex D.3.3.6. It is sent only in A-ASSOCIATE-RQ.
+type SOPClassCommonExtendedNegotiationSubItem struct {
+	SOPClassUID                string
+	ServiceClassUID            string
+	RelatedGeneralSOPClassUIDs []string
+}
+
+func decodeSOPClassCommonExtendedNegotiationSubItem(d *dicomio.Decoder, length uint16) *SOPClassCommonExtendedNegotiationSubItem {
+	v := &SOPClassCommonExtendedNegotiationSubItem{}
+	v.SOPClassUID = d.ReadString(int(d.ReadUInt16()))
+	v.ServiceClassUID = d.ReadString(int(d.ReadUInt16()))
+	relatedLen := d.ReadUInt16()
+	d.PushLimit(int64(relatedLen))
+	defer d.PopLimit()
+	for !d.EOF() {
+		uid := d.ReadString(int(d.ReadUInt16()))
+		if d.Error() != nil {
+			break
+		}
+		v.RelatedGeneralSOPClassUIDs = append(v.RelatedGeneralSOPClassUIDs, uid)
+	}
+	return v
+}
+
+func (v *SOPClassCommonExtendedNegotiationSubItem) Write(e *dicomio.Encoder) {
+	relatedLen := 0
+	for _, uid := range v.RelatedGeneralSOPClassUIDs {
+		relatedLen += 2 + len(uid)
+	}
+	encodeSubItemHeader(e, ItemTypeSOPClassCommonExtendedNegotiation,
+		uint16(2+len(v.SOPClassUID)+2+len(v.ServiceClassUID)+2+relatedLen))
+	e.WriteUInt16(uint16(len(v.SOPClassUID)))
+	e.WriteString(v.SOPClassUID)
+	e.WriteUInt16(uint16(len(v.ServiceClassUID)))
+	e.WriteString(v.ServiceClassUID)
+	e.WriteUInt16(uint16(relatedLen))
+	for _, uid := range v.RelatedGeneralSOPClassUIDs {
+		e.WriteUInt16(uint16(len(uid)))
+		e.WriteString(uid)
+	}
+}
+
+func (v *SOPClassCommonExtendedNegotiationSubItem) String() string {
+	return fmt.Sprintf("SOPClassCommonExtendedNegotiation{sopclassuid: %v, serviceclassuid: %v, related: %v}",
+		v.SOPClassUID, v.ServiceClassUID, v.RelatedGeneralSOPClassUIDs)
+}
+
+// UserIdentityType specifies the form of the credentials in a
+// UserIdentitySubItem. PS3.7 Annex D.3.3.7.1
+type UserIdentityType byte
+
+const (
+	UserIdentityUsername         UserIdentityType = 1
+	UserIdentityUsernamePasscode UserIdentityType = 2
+	UserIdentityKerberos         UserIdentityType = 3
+	UserIdentitySAML             UserIdentityType = 4
+	UserIdentityJWT              UserIdentityType = 5
+)
+
+// PS3.7 Annex D.3.3.7.1
+type UserIdentitySubItem struct {
+	Type                      UserIdentityType
+	PositiveResponseRequested bool
+	// Username, Kerberos service ticket, SAML assertion, or JSON web
+	// token, depending on Type.
+	PrimaryField []byte
+	// Passcode. Nonempty only when Type is UserIdentityUsernamePasscode.
+	SecondaryField []byte
+}
+
+func decodeUserIdentitySubItem(d *dicomio.Decoder, length uint16) *UserIdentitySubItem {
+	v := &UserIdentitySubItem{}
+	d.PushLimit(int64(length))
+	defer d.PopLimit()
+	v.Type = UserIdentityType(d.ReadByte())
+	v.PositiveResponseRequested = d.ReadByte() == 1
+	v.PrimaryField = d.ReadBytes(int(d.ReadUInt16()))
+	v.SecondaryField = d.ReadBytes(int(d.ReadUInt16()))
+	if d.Error() == nil && !d.EOF() {
+		d.SetError(fmt.Errorf("UserIdentitySubItem: fields don't fill the item length %d", length))
+	}
+	return v
+}
+
+// MaxUserIdentityLength is the max total length of PrimaryField and
+// SecondaryField of a UserIdentitySubItem. The enclosing UserInformationItem
+// has the same length limit, so the actual limit is lower by the size of the
+// other sub-items.
+const MaxUserIdentityLength = maxItemLength - (1 + 1 + 2 + 2)
+
+func (v *UserIdentitySubItem) Write(e *dicomio.Encoder) {
+	if n := len(v.PrimaryField) + len(v.SecondaryField); n > MaxUserIdentityLength {
+		e.SetError(fmt.Errorf("UserIdentitySubItem too long: %dB", n))
+		return
+	}
+	encodeSubItemHeader(e, ItemTypeUserIdentityRequest,
+		uint16(1+1+2+len(v.PrimaryField)+2+len(v.SecondaryField)))
+	e.WriteByte(byte(v.Type))
+	if v.PositiveResponseRequested {
+		e.WriteByte(1)
+	} else {
+		e.WriteByte(0)
+	}
+	e.WriteUInt16(uint16(len(v.PrimaryField)))
+	e.WriteBytes(v.PrimaryField)
+	e.WriteUInt16(uint16(len(v.SecondaryField)))
+	e.WriteBytes(v.SecondaryField)
+}
+
+func (v *UserIdentitySubItem) String() string {
+	// Don't log the credentials.
+	return fmt.Sprintf("UserIdentity{type: %v, positiveresponse: %v, primary: %dbytes, secondary: %dbytes}",
+		v.Type, v.PositiveResponseRequested, len(v.PrimaryField), len(v.SecondaryField))
+}
+
+// PS3.7 Annex D.3.3.7.2
+type UserIdentityResponseSubItem struct {
+	// Kerberos server ticket, SAML response, or JSON web token, depending
+	// on the type of the request. Empty for the username types.
+	ServerResponse []byte
+}
+
+func decodeUserIdentityResponseSubItem(d *dicomio.Decoder, length uint16) *UserIdentityResponseSubItem {
+	d.PushLimit(int64(length))
+	defer d.PopLimit()
+	v := &UserIdentityResponseSubItem{ServerResponse: d.ReadBytes(int(d.ReadUInt16()))}
+	if d.Error() == nil && !d.EOF() {
+		d.SetError(fmt.Errorf("UserIdentityResponseSubItem: fields don't fill the item length %d", length))
+	}
+	return v
+}
+
+func (v *UserIdentityResponseSubItem) Write(e *dicomio.Encoder) {
+	if len(v.ServerResponse) > maxItemLength-2 {
+		e.SetError(fmt.Errorf("UserIdentityResponseSubItem too long: %dB", len(v.ServerResponse)))
+		return
+	}
+	encodeSubItemHeader(e, ItemTypeUserIdentityResponse, uint16(2+len(v.ServerResponse)))
+	e.WriteUInt16(uint16(len(v.ServerResponse)))
+	e.WriteBytes(v.ServerResponse)
+}
+
+func (v *UserIdentityResponseSubItem) String() string {
+	return fmt.Sprintf("UserIdentityResponse{response: %dbytes}", len(v.ServerResponse))
+}
+
 // PS3.7 Annex D.3.3.2.3
 type ImplementationVersionNameSubItem subItemWithName
 
@@ -247,7 +447,9 @@ func (v *ImplementationVersionNameSubItem) String() string {
 	return fmt.Sprintf("ImplementationVersionName{name: \"%s\"}", v.Name)
 }
 
-// Container for subitems that this package doesnt' support
+// SubItemUnsupported holds a subitem of a type that this package doesn't
+// support, e.g., a vendor extension. Data is the body of the item, without the
+// 4-byte header.
 type SubItemUnsupported struct {
 	Type byte
 	Data []byte
@@ -387,7 +589,9 @@ func (v *PresentationContextItem) Write(e *dicomio.Encoder) {
 	itemBytes := itemEncoder.Bytes()
 	encodeSubItemHeader(e, v.Type, uint16(4+len(itemBytes)))
 	e.WriteByte(v.ContextID)
-	e.WriteZeros(3)
+	e.WriteZeros(1)
+	e.WriteByte(byte(v.Result))
+	e.WriteZeros(1)
 	e.WriteBytes(itemBytes)
 }
 
@@ -475,8 +679,13 @@ func EncodePDU(pdu PDU) ([]byte, error) {
 	return append(header[:], payload...), nil
 }
 
+// The maximum length of the PDUs other than P-DATA-TF accepted by ReadPDU.
+const maxNonDataPDUSize = 4 << 20
+
 // EncodePDU reads a "pdu" from a stream. maxPDUSize defines the maximum
-// possible PDU size, in bytes, accepted by the caller.
+// length, in bytes, of a P-DATA-TF PDU accepted by the caller. If maxPDUSize is
+// 0, the length is not limited. Per P3.8 D.1, maxPDUSize doesn't apply to other
+// PDU types, e.g., A-ASSOCIATE-RQ; they are only limited to 4MiB.
 func ReadPDU(in io.Reader, maxPDUSize int) (PDU, error) {
 	var pduType Type
 	var skip byte
@@ -493,9 +702,13 @@ func ReadPDU(in io.Reader, maxPDUSize int) (PDU, error) {
 	if err != nil {
 		return nil, err
 	}
-	if length >= uint32(maxPDUSize)*2 {
-		// Avoid using too much memory. *2 is just an arbitrary slack.
-		return nil, fmt.Errorf("Invalid length %d; it's much larger than max PDU size of %d", length, maxPDUSize)
+	if pduType == TypePDataTf {
+		if maxPDUSize > 0 && uint64(length) > uint64(maxPDUSize) {
+			return nil, fmt.Errorf("Invalid P-DATA-TF length %d; it's larger than max PDU size of %d", length, maxPDUSize)
+		}
+	} else if length > maxNonDataPDUSize {
+		// Avoid using too much memory.
+		return nil, fmt.Errorf("Invalid length %d of PDU type %d; it's larger than %d", length, pduType, maxNonDataPDUSize)
 	}
 	d := dicomio.NewDecoder(
 		&io.LimitedReader{R: in, N: int64(length)},
@@ -655,6 +868,11 @@ const (
 	RejectReasonApplicationContextNameNotSupported RejectReasonType = 2
 	RejectReasonCallingAETitleNotRecognized        RejectReasonType = 3
 	RejectReasonCalledAETitleNotRecognized         RejectReasonType = 7
+
+	// Reasons used with SourceULServiceProviderPresentation. They share
+	// the values with the ones above.
+	RejectReasonTemporaryCongestion RejectReasonType = 1
+	RejectReasonLocalLimitExceeded  RejectReasonType = 2
 )
 
 // Possible values for AAssociateRj.Source
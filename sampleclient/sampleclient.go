@@ -1,4 +1,4 @@
-// A sample program for issuing C-STORE or C-FIND to a remote server.
+// A sample program for issuing C-STORE, C-FIND, C-GET or C-MOVE to a remote server.
 package main
 
 import (
@@ -19,6 +19,7 @@ var (
 	remoteAETitleFlag = flag.String("remote-ae-title", "testserver", "AE title of the server")
 	findFlag          = flag.Bool("find", false, "Issue a C-FIND.")
 	getFlag           = flag.Bool("get", false, "Issue a C-GET.")
+	moveFlag          = flag.String("move", "", "If set, issue a C-MOVE to copy the matching datasets to this AE title.")
 	seriesFlag        = flag.String("series", "", "Study series UID to retrieve in C-{FIND,GET}.")
 	studyFlag         = flag.String("study", "", "Study instance UID to retrieve in C-{FIND,GET}.")
 )
@@ -93,6 +94,20 @@ func cGet() {
 	log.Printf("C-GET finished: %v", err)
 }
 
+func cMove(moveDestination string) {
+	su := newServiceUser(sopclass.QRMoveClasses)
+	defer su.Release()
+	qrLevel, args := generateCFindElements()
+	for progress := range su.CMove(qrLevel, args, moveDestination) {
+		if progress.Err != nil {
+			log.Printf("C-MOVE error: %v", progress.Err)
+			continue
+		}
+		log.Printf("C-MOVE progress: remaining=%d completed=%d failed=%d warning=%d",
+			progress.Remaining, progress.Completed, progress.Failed, progress.Warning)
+	}
+}
+
 func cFind() {
 	su := newServiceUser(sopclass.QRFindClasses)
 	defer su.Release()
@@ -117,7 +132,9 @@ func main() {
 		cFind()
 	} else if *getFlag {
 		cGet()
+	} else if *moveFlag != "" {
+		cMove(*moveFlag)
 	} else {
-		log.Panic("Either -store, -get, or -find must be set")
+		log.Panic("Either -store, -get, -move, or -find must be set")
 	}
 }
@@ -7,6 +7,7 @@ package main
 // It starts a DICOM server and serves files under <directory>.
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"flag"
@@ -14,11 +15,13 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/grailbio/go-dicom"
 	"github.com/grailbio/go-dicom/dicomio"
@@ -366,5 +369,22 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	sp.Run()
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		// Let the running C-STOREs finish on Ctrl-C.
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt)
+		<-sigCh
+		log.Printf("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := sp.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown: %v", err)
+		}
+	}()
+	if err := sp.Run(); err != netdicom.ErrProviderClosed {
+		log.Panic(err)
+	}
+	<-shutdownDone
 }
@@ -1,8 +1,10 @@
 package netdicom
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/grailbio/go-dicom/dicomlog"
 	"github.com/grailbio/go-netdicom/dimse"
@@ -15,17 +17,55 @@ type serviceDispatcher struct {
 
 	mu sync.Mutex
 
-	// Set of active DIMSE commands running. Keys are message IDs.
-	activeCommands map[dimse.MessageID]*serviceCommandState // guarded by mu
+	// Held while sending a DIMSE message to the statemachine, so that the
+	// fragments of a streamed message aren't interleaved with other
+	// messages.
+	sendMu sync.Mutex
+
+	// DIMSE commands running. Keys are message IDs. "invoked" holds the
+	// requests sent by this side, and "performed" holds the requests sent
+	// by the peer. They are kept apart, since each side allocates message
+	// IDs on its own. A response is matched with "invoked" by its
+	// MessageIDBeingRespondedTo, and a request with "performed" by its
+	// MessageID.
+	invoked   map[dimse.MessageID]*serviceCommandState // guarded by mu
+	performed map[dimse.MessageID]*serviceCommandState // guarded by mu
 
 	// A callback to be called when a dimse request message arrives. Keys
 	// are DIMSE CommandField. The callback typically creates a new command
-	// by calling findOrCreateCommand.
+	// by calling newPeerCommand.
 	callbacks map[int]serviceCallback // guarded by mu
 
 	// The last message ID used in newCommand(). Used to avoid creating duplicate
 	// IDs.
 	lastMessageID dimse.MessageID
+
+	// Set by close(). No new command can be created once set.
+	closed bool // guarded by mu
+	// Set by finish(). The upcall channels of the commands are closed
+	// once set.
+	finished bool // guarded by mu
+	// Set by watchIdle when the association is found idle. No new command
+	// can be created once set.
+	idle bool // guarded by mu
+	// Closed by close().
+	done chan struct{}
+
+	// When the last command finished. Used to detect idle associations.
+	lastActivity time.Time // guarded by mu
+
+	// The number of DIMSE messages whose first fragment has arrived, but
+	// that handleEvent hasn't handled yet. An association receiving a
+	// message isn't idle, even though the message hasn't started a command
+	// yet.
+	receiving int // guarded by mu
+
+	// Hold one token per operation outstanding, as bounded by the
+	// asynchronous operations window. invokeSlots is for the requests sent
+	// by this side, and performSlots is for the requests received. nil
+	// means unlimited. Set once the handshake completes.
+	invokeSlots  chan struct{} // guarded by mu
+	performSlots chan struct{} // guarded by mu
 }
 
 type serviceCallback func(msg dimse.Message, data []byte, cs *serviceCommandState)
@@ -34,11 +74,34 @@ type serviceCallback func(msg dimse.Message, data []byte, cs *serviceCommandStat
 type serviceCommandState struct {
 	disp      *serviceDispatcher  // Parent.
 	messageID dimse.MessageID     // Command's MessageID.
+	peer      bool                // The request was sent by the peer.
 	context   contextManagerEntry // Transfersyntax/sopclass for this command.
 	cm        *contextManager     // For looking up context -> transfersyntax/sopclass mappings
 
 	// upcallCh streams command+data for this messageID.
 	upcallCh chan upcallEvent
+
+	// ctx is canceled when the peer sends C-CANCEL for this command, or when
+	// the command finishes.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newServiceCommandState(
+	disp *serviceDispatcher,
+	msgID dimse.MessageID,
+	cm *contextManager,
+	entry contextManagerEntry) *serviceCommandState {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &serviceCommandState{
+		disp:      disp,
+		messageID: msgID,
+		cm:        cm,
+		context:   entry,
+		upcallCh:  make(chan upcallEvent, 128),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
 }
 
 // Send a command+data combo to the remote peer. data may be nil.
@@ -53,33 +116,38 @@ func (cs *serviceCommandState) sendMessage(cmd dimse.Message, data []byte) {
 		command:            cmd,
 		data:               data,
 	}
-	cs.disp.downcallCh <- stateEvent{
+	cs.disp.sendPayload(payload)
+}
+
+// Send a DIMSE message to the statemachine. It waits while a streamed message
+// is being sent.
+func (disp *serviceDispatcher) sendPayload(payload *stateEventDIMSEPayload) {
+	disp.sendMu.Lock()
+	disp.downcallCh <- stateEvent{
 		event:        evt09,
 		pdu:          nil,
 		conn:         nil,
 		dimsePayload: payload,
 	}
+	disp.sendMu.Unlock()
 }
 
-func (disp *serviceDispatcher) findOrCreateCommand(
+// Create a serviceCommandState for the request "msgID" sent by the peer.
+// Returns an error if the peer already has a request with the same ID running.
+func (disp *serviceDispatcher) newPeerCommand(
 	msgID dimse.MessageID,
 	cm *contextManager,
-	context contextManagerEntry) (*serviceCommandState, bool) {
+	context contextManagerEntry) (*serviceCommandState, error) {
 	disp.mu.Lock()
 	defer disp.mu.Unlock()
-	if cs, ok := disp.activeCommands[msgID]; ok {
-		return cs, true
+	if _, ok := disp.performed[msgID]; ok {
+		return nil, fmt.Errorf("dicom.serviceDispatcher(%s): Duplicate message ID %v from the peer", disp.label, msgID)
 	}
-	cs := &serviceCommandState{
-		disp:      disp,
-		messageID: msgID,
-		cm:        cm,
-		context:   context,
-		upcallCh:  make(chan upcallEvent, 128),
-	}
-	disp.activeCommands[msgID] = cs
+	cs := newServiceCommandState(disp, msgID, cm, context)
+	cs.peer = true
+	disp.performed[msgID] = cs
 	dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Start command %+v", disp.label, cs)
-	return cs, false
+	return cs, nil
 }
 
 // Create a new serviceCommandState with an unused message ID.  Returns an error
@@ -88,20 +156,17 @@ func (disp *serviceDispatcher) newCommand(
 	cm *contextManager, context contextManagerEntry) (*serviceCommandState, error) {
 	disp.mu.Lock()
 	defer disp.mu.Unlock()
+	if disp.closed || disp.idle {
+		return nil, fmt.Errorf("dicom.serviceDispatcher(%s): Association already closed", disp.label)
+	}
 
 	for msgID := disp.lastMessageID + 1; msgID != disp.lastMessageID; msgID++ {
-		if _, ok := disp.activeCommands[msgID]; ok {
+		if _, ok := disp.invoked[msgID]; ok {
 			continue
 		}
 
-		cs := &serviceCommandState{
-			disp:      disp,
-			messageID: msgID,
-			cm:        cm,
-			context:   context,
-			upcallCh:  make(chan upcallEvent, 128),
-		}
-		disp.activeCommands[msgID] = cs
+		cs := newServiceCommandState(disp, msgID, cm, context)
+		disp.invoked[msgID] = cs
 		disp.lastMessageID = msgID
 		dicomlog.Vprintf(1, "dicom.serviceDispatcher: Start new command %+v", cs)
 		return cs, nil
@@ -112,10 +177,86 @@ func (disp *serviceDispatcher) newCommand(
 func (disp *serviceDispatcher) deleteCommand(cs *serviceCommandState) {
 	disp.mu.Lock()
 	dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Finish provider command %v", disp.label, cs.messageID)
-	if _, ok := disp.activeCommands[cs.messageID]; !ok {
+	commands := disp.invoked
+	if cs.peer {
+		commands = disp.performed
+	}
+	if _, ok := commands[cs.messageID]; !ok {
 		panic(fmt.Sprintf("cs %+v", cs))
 	}
-	delete(disp.activeCommands, cs.messageID)
+	delete(commands, cs.messageID)
+	disp.lastActivity = time.Now()
+	disp.mu.Unlock()
+	cs.cancel()
+}
+
+// Call onIdle once no command has run for "timeout". Stops when the dispatcher
+// is closed. newCommand fails once the association is found idle, so that
+// onIdle never interrupts a command.
+func (disp *serviceDispatcher) watchIdle(timeout time.Duration, onIdle func()) {
+	disp.mu.Lock()
+	disp.lastActivity = time.Now()
+	disp.mu.Unlock()
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+			case <-disp.done:
+				return
+			}
+			disp.mu.Lock()
+			busy := disp.busyLocked()
+			remaining := timeout - time.Since(disp.lastActivity)
+			if !busy && remaining <= 0 {
+				disp.idle = true
+			}
+			disp.mu.Unlock()
+			if !busy && remaining <= 0 {
+				dicomlog.Vprintf(0, "dicom.serviceDispatcher(%s): Association idle for %v", disp.label, timeout)
+				onIdle()
+				return
+			}
+			if busy {
+				// The timeout is counted from the end of the last
+				// command.
+				remaining = timeout
+			}
+			timer.Reset(remaining)
+		}
+	}()
+}
+
+// Returns the number of commands running.
+func (disp *serviceDispatcher) numActiveCommands() int {
+	disp.mu.Lock()
+	defer disp.mu.Unlock()
+	return len(disp.invoked) + len(disp.performed)
+}
+
+// Reports whether a command is running, or a message is arriving.
+func (disp *serviceDispatcher) busy() bool {
+	disp.mu.Lock()
+	defer disp.mu.Unlock()
+	return disp.busyLocked()
+}
+
+func (disp *serviceDispatcher) busyLocked() bool {
+	return len(disp.invoked) > 0 || len(disp.performed) > 0 || disp.receiving > 0
+}
+
+// Called by the statemachine when the first fragment of a DIMSE message
+// arrives. handleEvent undoes it once it handles the message.
+func (disp *serviceDispatcher) startReceiving() {
+	disp.mu.Lock()
+	disp.receiving++
+	disp.mu.Unlock()
+}
+
+func (disp *serviceDispatcher) finishReceiving() {
+	disp.mu.Lock()
+	disp.receiving--
 	disp.mu.Unlock()
 }
 
@@ -131,12 +272,60 @@ func (disp *serviceDispatcher) unregisterCallback(commandField int) {
 	disp.mu.Unlock()
 }
 
+// Create the slots that enforce the asynchronous operations window "w".
+func (disp *serviceDispatcher) setOpsWindow(w AsyncOpsWindow) {
+	newSlots := func(n int) chan struct{} {
+		if n == 0 {
+			return nil
+		}
+		return make(chan struct{}, n)
+	}
+	disp.mu.Lock()
+	disp.invokeSlots = newSlots(w.MaxOpsInvoked)
+	disp.performSlots = newSlots(w.MaxOpsPerformed)
+	disp.mu.Unlock()
+}
+
+// Wait until this side may invoke another operation. Returns ctx.Err() if ctx
+// expires first. On success, the caller must call releaseInvokeSlot once the
+// operation finishes.
+func (disp *serviceDispatcher) acquireInvokeSlot(ctx context.Context) error {
+	disp.mu.Lock()
+	slots := disp.invokeSlots
+	disp.mu.Unlock()
+	if slots == nil {
+		return nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (disp *serviceDispatcher) releaseInvokeSlot() {
+	disp.mu.Lock()
+	slots := disp.invokeSlots
+	disp.mu.Unlock()
+	if slots != nil {
+		<-slots
+	}
+}
+
 func (disp *serviceDispatcher) handleEvent(event upcallEvent) {
 	if event.eventType == upcallEventHandshakeCompleted {
+		disp.setOpsWindow(event.cm.opsWindow)
+		return
+	}
+	if event.eventType == upcallEventAssociationFailed {
+		dicomlog.Vprintf(0, "dicom.serviceDispatcher(%s): %v", disp.label, event.err)
 		return
 	}
 	doassert(event.eventType == upcallEventData)
 	doassert(event.command != nil)
+	// The message stays counted until it starts a command, if any.
+	defer disp.finishReceiving()
 	context, err := event.cm.lookupByContextID(event.contextID)
 	if err != nil {
 		dicomlog.Vprintf(0, "dicom.serviceDispatcher(%s): Invalid context ID %d: %v", disp.label, event.contextID, err)
@@ -144,38 +333,162 @@ func (disp *serviceDispatcher) handleEvent(event upcallEvent) {
 		return
 	}
 	messageID := event.command.GetMessageID()
-	dc, found := disp.findOrCreateCommand(messageID, event.cm, context)
-	if found {
-		dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Forwarding command to existing command: %+v %+v", disp.label, event.command, dc)
+	if event.command.GetStatus() != nil {
+		// A response to a request sent by this side.
+		disp.mu.Lock()
+		dc, found := disp.invoked[messageID]
+		disp.mu.Unlock()
+		if !found {
+			// A response to a command that has already finished.
+			err := fmt.Errorf("dicom.serviceDispatcher(%s): Response to unknown command: %v", disp.label, event.command)
+			dicomlog.Vprintf(0, "%v", err)
+			disp.downcallCh <- stateEvent{event: evt19, pdu: nil, err: err}
+			return
+		}
+		dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Forwarding response to command: %+v %+v", disp.label, event.command, dc)
+		// The upcall channels are closed only by finish(), which runs
+		// in this goroutine.
 		dc.upcallCh <- event
-		dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Done forwarding command to existing command: %+v %+v", disp.label, event.command, dc)
+		return
+	}
+	if _, ok := event.command.(*dimse.CCancelRq); ok {
+		// C-CANCEL doesn't start a new command. It tells a running
+		// command to stop.
+		disp.mu.Lock()
+		dc, found := disp.performed[messageID]
+		disp.mu.Unlock()
+		if !found {
+			dicomlog.Vprintf(0, "dicom.serviceDispatcher(%s): C-CANCEL for unknown command %v", disp.label, messageID)
+			return
+		}
+		dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Canceling command %v", disp.label, messageID)
+		dc.cancel()
+		return
+	}
+	dc, err := disp.newPeerCommand(messageID, event.cm, context)
+	if err != nil {
+		dicomlog.Vprintf(0, "%v", err)
+		disp.downcallCh <- stateEvent{event: evt19, pdu: nil, err: err}
 		return
 	}
 	disp.mu.Lock()
 	cb := disp.callbacks[event.command.CommandField()]
+	slots := disp.performSlots
 	disp.mu.Unlock()
+	if cb == nil {
+		// A request we don't implement.
+		err := fmt.Errorf("dicom.serviceDispatcher(%s): No handler for %v", disp.label, event.command)
+		dicomlog.Vprintf(0, "%v", err)
+		disp.deleteCommand(dc)
+		disp.downcallCh <- stateEvent{event: evt19, pdu: nil, err: err}
+		return
+	}
 	go func() {
+		if slots != nil {
+			// Requests beyond the window wait for earlier ones
+			// to finish.
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-dc.ctx.Done():
+				// Canceled by the peer, or the association
+				// closed, before the request started.
+				disp.cancelQueuedCommand(event.command, dc)
+				disp.deleteCommand(dc)
+				return
+			}
+		}
 		cb(event.command, event.data, dc)
 		disp.deleteCommand(dc)
 	}()
 }
 
-// Must be called exactly once to shut down the dispatcher.
+// Respond to the request "msg", which was canceled while waiting for a slot
+// in the asynchronous operations window, with a Cancel status. P3.7 9.3.2.3.
+// No response is sent if the association is closed, or if "msg" can't be
+// canceled.
+func (disp *serviceDispatcher) cancelQueuedCommand(msg dimse.Message, cs *serviceCommandState) {
+	disp.mu.Lock()
+	closed := disp.closed
+	disp.mu.Unlock()
+	if closed {
+		return
+	}
+	status := dimse.Status{Status: dimse.StatusCancel}
+	var resp dimse.Message
+	switch c := msg.(type) {
+	case *dimse.CFindRq:
+		resp = &dimse.CFindRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status}
+	case *dimse.CGetRq:
+		resp = &dimse.CGetRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status}
+	case *dimse.CMoveRq:
+		resp = &dimse.CMoveRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status}
+	default:
+		dicomlog.Vprintf(0, "dicom.serviceDispatcher(%s): Dropping canceled request %v", disp.label, msg)
+		return
+	}
+	dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Request %v canceled before it started", disp.label, msg)
+	cs.sendMessage(resp, nil)
+}
+
+// Shut down the dispatcher. No new command can be created afterwards, and the
+// running commands are canceled. It may be called from any goroutine. Calls
+// after the first one are no-ops.
 func (disp *serviceDispatcher) close() {
 	disp.mu.Lock()
-	for _, cs := range disp.activeCommands {
-		close(cs.upcallCh)
+	defer disp.mu.Unlock()
+	if disp.closed {
+		return
+	}
+	disp.closed = true
+	close(disp.done)
+	for _, commands := range []map[dimse.MessageID]*serviceCommandState{disp.invoked, disp.performed} {
+		for _, cs := range commands {
+			cs.cancel()
+		}
+	}
+}
+
+// Called by the goroutine that runs handleEvent once the statemachine stops
+// sending events. It closes the dispatcher, then the upcall channels of the
+// running commands, so that they see the end of the association. Only this
+// goroutine sends to the upcall channels, so none is closed while being sent
+// to.
+func (disp *serviceDispatcher) finish() {
+	disp.close()
+	disp.mu.Lock()
+	defer disp.mu.Unlock()
+	if disp.finished {
+		return
+	}
+	disp.finished = true
+	for _, commands := range []map[dimse.MessageID]*serviceCommandState{disp.invoked, disp.performed} {
+		for _, cs := range commands {
+			close(cs.upcallCh)
+		}
 	}
-	disp.mu.Unlock()
-	// TODO(saito): prevent new command from launching.
 }
 
 func newServiceDispatcher(label string) *serviceDispatcher {
 	return &serviceDispatcher{
 		label:          label,
 		downcallCh:     make(chan stateEvent, 128),
-		activeCommands: make(map[dimse.MessageID]*serviceCommandState),
+		invoked:        make(map[dimse.MessageID]*serviceCommandState),
+		performed:      make(map[dimse.MessageID]*serviceCommandState),
 		callbacks:      make(map[int]serviceCallback),
 		lastMessageID:  123,
+		done:           make(chan struct{}),
 	}
 }
@@ -3,14 +3,24 @@
 package netdicom
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"math"
 	"net"
+	"strings"
+	"sync"
+	"time"
 
 	dicom "github.com/grailbio/go-dicom"
 	"github.com/grailbio/go-dicom/dicomio"
 	"github.com/grailbio/go-dicom/dicomlog"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
 	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/pdu"
 	"github.com/grailbio/go-netdicom/sopclass"
 )
 
@@ -51,7 +61,14 @@ func handleCFind(
 	connState ConnectionState,
 	c *dimse.CFindRq, data []byte,
 	cs *serviceCommandState) {
-	if params.CFind == nil {
+	callback := params.CFind
+	if c.AffectedSOPClassUID == sopclass.WorklistFindClasses[0] && params.WorklistFind != nil {
+		worklistFind := params.WorklistFind
+		callback = func(conn ConnectionState, transferSyntaxUID string, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+			worklistFind(conn, transferSyntaxUID, filters, ch)
+		}
+	}
+	if callback == nil {
 		cs.sendMessage(&dimse.CFindRsp{
 			AffectedSOPClassUID:       c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo: c.MessageID,
@@ -75,9 +92,22 @@ func handleCFind(
 	status := dimse.Status{Status: dimse.StatusSuccess}
 	responseCh := make(chan CFindResult, 128)
 	go func() {
-		params.CFind(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, responseCh)
+		callback(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, responseCh)
 	}()
-	for resp := range responseCh {
+loop:
+	for {
+		var resp CFindResult
+		var ok bool
+		select {
+		case resp, ok = <-responseCh:
+		case <-cs.ctx.Done():
+			dicomlog.Vprintf(0, "dicom.serviceProvider: C-FIND canceled by the peer")
+			status = dimse.Status{Status: dimse.StatusCancel}
+			break loop
+		}
+		if !ok {
+			break
+		}
 		if resp.Err != nil {
 			status = dimse.Status{
 				Status:       dimse.CFindUnableToProcess,
@@ -112,6 +142,26 @@ func handleCFind(
 	}
 }
 
+// Returns the final status of a C-MOVE or C-GET, given the status so far and
+// the number of sub-operations that succeeded and failed. A failed
+// sub-operation turns success into a warning, or into a failure if no
+// sub-operation succeeded. P3.4 C.4.2.1.5, C.4.3.1.4.
+func subOperationsStatus(status dimse.Status, numSuccesses, numFailures uint16) dimse.Status {
+	if status.Status != dimse.StatusSuccess || numFailures == 0 {
+		return status
+	}
+	if numSuccesses == 0 {
+		return dimse.Status{
+			Status:       dimse.CMoveOutOfResourcesUnableToPerformSubOperations,
+			ErrorComment: fmt.Sprintf("All %d sub-operations failed", numFailures),
+		}
+	}
+	return dimse.Status{
+		Status:       dimse.CMoveSubOperationsCompleteWithFailures,
+		ErrorComment: fmt.Sprintf("%d of %d sub-operations failed", numFailures, numSuccesses+numFailures),
+	}
+}
+
 func handleCMove(
 	params ServiceProviderParams,
 	connState ConnectionState,
@@ -149,10 +199,22 @@ func handleCMove(
 	go func() {
 		params.CMove(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, responseCh)
 	}()
-	// responseCh :=
 	status := dimse.Status{Status: dimse.StatusSuccess}
-	var numSuccesses, numFailures uint16
-	for resp := range responseCh {
+	var numSuccesses, numFailures, numRemaining uint16
+loop:
+	for {
+		var resp CMoveResult
+		var ok bool
+		select {
+		case resp, ok = <-responseCh:
+		case <-cs.ctx.Done():
+			dicomlog.Vprintf(0, "dicom.serviceProvider: C-MOVE canceled by the peer")
+			status = dimse.Status{Status: dimse.StatusCancel}
+			break loop
+		}
+		if !ok {
+			break
+		}
 		if resp.Err != nil {
 			status = dimse.Status{
 				Status:       dimse.CFindUnableToProcess,
@@ -161,30 +223,37 @@ func handleCMove(
 			break
 		}
 		dicomlog.Vprintf(0, "dicom.serviceProvider: C-MOVE: Sending %v to %v(%s)", resp.Path, c.MoveDestination, remoteHostPort)
-		err := runCStoreOnNewAssociation(params.AETitle, c.MoveDestination, remoteHostPort, resp.DataSet)
+		err := runCStoreOnNewAssociation(params.AETitle, c.MoveDestination, remoteHostPort, params.RemoteTLSConfig, resp.DataSet)
 		if err != nil {
 			dicomlog.Vprintf(0, "dicom.serviceProvider: C-MOVE: C-store of %v to %v(%v) failed: %v", resp.Path, c.MoveDestination, remoteHostPort, err)
 			numFailures++
 		} else {
 			numSuccesses++
 		}
+		numRemaining = uint16(resp.Remaining)
 		cs.sendMessage(&dimse.CMoveRsp{
 			AffectedSOPClassUID:            c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo:      c.MessageID,
 			CommandDataSetType:             dimse.CommandDataSetTypeNull,
-			NumberOfRemainingSuboperations: uint16(resp.Remaining),
+			NumberOfRemainingSuboperations: numRemaining,
 			NumberOfCompletedSuboperations: numSuccesses,
 			NumberOfFailedSuboperations:    numFailures,
 			Status:                         dimse.Status{Status: dimse.StatusPending},
 		}, nil)
 	}
-	cs.sendMessage(&dimse.CMoveRsp{
+	final := &dimse.CMoveRsp{
 		AffectedSOPClassUID:            c.AffectedSOPClassUID,
 		MessageIDBeingRespondedTo:      c.MessageID,
 		CommandDataSetType:             dimse.CommandDataSetTypeNull,
 		NumberOfCompletedSuboperations: numSuccesses,
 		NumberOfFailedSuboperations:    numFailures,
-		Status:                         status}, nil)
+		Status:                         subOperationsStatus(status, numSuccesses, numFailures)}
+	if status.Status == dimse.StatusCancel {
+		// P3.4 C.4.2.1.6: a canceled C-MOVE reports the number of
+		// sub-operations that will no longer be performed.
+		final.NumberOfRemainingSuboperations = numRemaining
+	}
+	cs.sendMessage(final, nil)
 	// Drain the responses in case of errors
 	for range responseCh {
 	}
@@ -222,8 +291,21 @@ func handleCGet(
 		params.CGet(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, responseCh)
 	}()
 	status := dimse.Status{Status: dimse.StatusSuccess}
-	var numSuccesses, numFailures uint16
-	for resp := range responseCh {
+	var numSuccesses, numFailures, numRemaining uint16
+loop:
+	for {
+		var resp CMoveResult
+		var ok bool
+		select {
+		case resp, ok = <-responseCh:
+		case <-cs.ctx.Done():
+			dicomlog.Vprintf(0, "dicom.serviceProvider: C-GET canceled by the peer")
+			status = dimse.Status{Status: dimse.StatusCancel}
+			break loop
+		}
+		if !ok {
+			break
+		}
 		if resp.Err != nil {
 			status = dimse.Status{
 				Status:       dimse.CFindUnableToProcess,
@@ -231,15 +313,35 @@ func handleCGet(
 			}
 			break
 		}
+		if err := checkCGetSCPRole(cs.cm, resp.DataSet); err != nil {
+			dicomlog.Vprintf(0, "dicom.serviceProvider: C-GET: Can't send %v: %v", resp.Path, err)
+			numFailures++
+			numRemaining = uint16(resp.Remaining)
+			cs.sendMessage(&dimse.CGetRsp{
+				AffectedSOPClassUID:            c.AffectedSOPClassUID,
+				MessageIDBeingRespondedTo:      c.MessageID,
+				CommandDataSetType:             dimse.CommandDataSetTypeNull,
+				NumberOfRemainingSuboperations: numRemaining,
+				NumberOfCompletedSuboperations: numSuccesses,
+				NumberOfFailedSuboperations:    numFailures,
+				Status:                         dimse.Status{Status: dimse.StatusPending},
+			}, nil)
+			continue
+		}
+		if err := cs.disp.acquireInvokeSlot(cs.ctx); err != nil {
+			status = dimse.Status{Status: dimse.StatusCancel}
+			break
+		}
 		subCs, err := cs.disp.newCommand(cs.cm, cs.context /*not used*/)
 		if err != nil {
+			cs.disp.releaseInvokeSlot()
 			status = dimse.Status{
 				Status:       dimse.CFindUnableToProcess,
 				ErrorComment: err.Error(),
 			}
 			break
 		}
-		err = runCStoreOnAssociation(subCs.upcallCh, subCs.disp.downcallCh, subCs.cm, subCs.messageID, resp.DataSet)
+		err = runCStoreOnAssociation(subCs.ctx, subCs.upcallCh, subCs.disp, subCs.cm, subCs.messageID, resp.DataSet)
 		if err != nil {
 			dicomlog.Vprintf(0, "dicom.serviceProvider: C-GET: C-store of %v failed: %v", resp.Path, err)
 			numFailures++
@@ -247,24 +349,30 @@ func handleCGet(
 			dicomlog.Vprintf(0, "dicom.serviceProvider: C-GET: Sent %v", resp.Path)
 			numSuccesses++
 		}
+		numRemaining = uint16(resp.Remaining)
 		cs.sendMessage(&dimse.CGetRsp{
 			AffectedSOPClassUID:            c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo:      c.MessageID,
 			CommandDataSetType:             dimse.CommandDataSetTypeNull,
-			NumberOfRemainingSuboperations: uint16(resp.Remaining),
+			NumberOfRemainingSuboperations: numRemaining,
 			NumberOfCompletedSuboperations: numSuccesses,
 			NumberOfFailedSuboperations:    numFailures,
 			Status:                         dimse.Status{Status: dimse.StatusPending},
 		}, nil)
 		cs.disp.deleteCommand(subCs)
+		cs.disp.releaseInvokeSlot()
 	}
-	cs.sendMessage(&dimse.CGetRsp{
+	final := &dimse.CGetRsp{
 		AffectedSOPClassUID:            c.AffectedSOPClassUID,
 		MessageIDBeingRespondedTo:      c.MessageID,
 		CommandDataSetType:             dimse.CommandDataSetTypeNull,
 		NumberOfCompletedSuboperations: numSuccesses,
 		NumberOfFailedSuboperations:    numFailures,
-		Status:                         status}, nil)
+		Status:                         subOperationsStatus(status, numSuccesses, numFailures)}
+	if status.Status == dimse.StatusCancel {
+		final.NumberOfRemainingSuboperations = numRemaining
+	}
+	cs.sendMessage(final, nil)
 	// Drain the responses in case of errors
 	for range responseCh {
 	}
@@ -306,6 +414,10 @@ type ServiceProviderParams struct {
 	// If CFindCallback=nil, a C-FIND call will produce an error response.
 	CFind CFindCallback
 
+	// WorklistFind is called on a Modality Worklist C-FIND request. If nil,
+	// such a request is passed to CFind.
+	WorklistFind WorklistFindCallback
+
 	// CMove is called on C_MOVE request.
 	CMove CMoveCallback
 
@@ -318,15 +430,126 @@ type ServiceProviderParams struct {
 	// If CStoreCallback=nil, a C-STORE call will produce an error response.
 	CStore CStoreCallback
 
+	// StorageCommitment is called on a storage commitment request
+	// (N-ACTION). If nil, such a request will produce an error response.
+	// The result is reported to the requestor on the same association if
+	// it is still open, or else on a new association to the address
+	// listed in RemoteAEs.
+	StorageCommitment StorageCommitmentCallback
+
+	// StorageCommitmentReport is called when a storage commitment result
+	// (N-EVENT-REPORT) arrives, typically from an SCP that the application
+	// sent a request to using ServiceUser.StorageCommitment.
+	StorageCommitmentReport StorageCommitmentReportCallback
+
+	// MPPSCreate and MPPSSet are called on N-CREATE and N-SET requests for
+	// Modality Performed Procedure Step instances. If nil, such a request
+	// will produce an error response.
+	MPPSCreate MPPSCreateCallback
+	MPPSSet    MPPSSetCallback
+
 	// TLSConfig, if non-nil, enables TLS on the connection. See
 	// https://gist.github.com/michaljemala/d6f4e01c4834bf47a9c4 for an
 	// example for creating a TLS config from x509 cert files.
 	TLSConfig *tls.Config
+
+	// RemoteTLSConfig, if non-nil, enables TLS on the associations the
+	// server opens to RemoteAEs, i.e., for C-MOVE and for storage
+	// commitment reports. It is used as ServiceUserParams.TLSConfig.
+	RemoteTLSConfig *tls.Config
+
+	// CheckCalledAETitle, if true, makes the server reject associations
+	// whose called AE title differs from AETitle, with reason
+	// "called-AE-title-not-recognized".
+	CheckCalledAETitle bool
+
+	// AllowedPeers, if nonempty, lists the clients allowed to associate
+	// with the server. Associations from other clients are rejected with
+	// reason "calling-AE-title-not-recognized".
+	AllowedPeers []AllowedPeer
+
+	// CertificateAETitles, if nonempty, binds the calling AE titles to
+	// client certificates, so that a client can't claim the AE title of
+	// another. The key is a name in the verified client certificate:
+	// the subject common name, or a DNS, email, or URI subject alternative
+	// name. The value lists the calling AE titles the name may use. An
+	// association is rejected with reason
+	// "calling-AE-title-not-recognized" unless the certificate presented
+	// by the client has a name mapped to the calling AE title. It requires
+	// TLSConfig, with ClientAuth set to VerifyClientCertIfGiven or
+	// RequireAndVerifyClientCert.
+	CertificateAETitles map[string][]string
+
+	// MaxAssociations, if positive, limits the number of associations
+	// served at a time. MaxAssociationsPerCallingAE and
+	// MaxAssociationsPerIP limit those from one calling AE title and one
+	// client IP address, respectively. An association beyond a limit is
+	// rejected as transient with reason "local-limit-exceeded", so the
+	// client may retry later. The limits apply to the associations
+	// accepted by ServiceProvider.Run, not to RunProviderForConn.
+	MaxAssociations             int
+	MaxAssociationsPerCallingAE int
+	MaxAssociationsPerIP        int
+
+	// TransferSyntaxes lists the transfer syntaxes accepted by the
+	// server, the most preferred one first. For each presentation context,
+	// the server picks the first syntax in this list that is also proposed
+	// by the client. The context is rejected if there is none. If empty,
+	// the server accepts the first syntax proposed by the client.
+	TransferSyntaxes []string
+
+	// SOPTransferSyntaxes overrides TransferSyntaxes for particular SOP
+	// classes. The key is a SOP class UID, e.g., "1.2.840.10008.5.1.4.1.1.2".
+	SOPTransferSyntaxes map[string][]string
+
+	// AssociationPolicy, if non-nil, is called when an A-ASSOCIATE-RQ
+	// arrives. It decides whether to accept the association, and which of
+	// the proposed presentation contexts to accept. If nil, every
+	// presentation context is accepted.
+	AssociationPolicy AssociationPolicy
+
+	// AsyncOpsWindow, if non-nil, lets a client negotiate an asynchronous
+	// operations window up to the given limits. MaxOpsPerformed bounds
+	// the number of client requests served concurrently on one
+	// association; requests beyond the limit wait. If nil, the server
+	// doesn't negotiate the window, and requests are served one at a time.
+	AsyncOpsWindow *AsyncOpsWindow
+
+	// Authenticate, if non-nil, is called on every A-ASSOCIATE-RQ to check
+	// the user identity presented by the client. If nil, the identity is
+	// ignored.
+	Authenticate AuthenticateCallback
+
+	// Timeouts of the associations. See ServiceUserParams. An association
+	// that stays idle for IdleTimeout is aborted.
+	ARTIMTimeout time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// MaxPDUSize is the maximum length of the P-DATA-TF PDUs accepted
+	// from clients. See ServiceUserParams.
+	MaxPDUSize int
 }
 
-// DefaultMaxPDUSize is the the PDU size advertized by go-netdicom.
+// DefaultMaxPDUSize is the the PDU size advertized by go-netdicom when
+// ServiceUserParams.MaxPDUSize or ServiceProviderParams.MaxPDUSize is zero.
 const DefaultMaxPDUSize = 4 << 20
 
+// UnlimitedPDUSize, set in ServiceUserParams.MaxPDUSize or
+// ServiceProviderParams.MaxPDUSize, advertises that this side accepts PDUs of
+// any length.
+const UnlimitedPDUSize = -1
+
+// The smallest MaxPDUSize accepted in ServiceUserParams and
+// ServiceProviderParams.
+const minMaxPDUSize = 1024
+
+// DefaultARTIMTimeout is the value of the ARTIM timer used when
+// ServiceUserParams.ARTIMTimeout or ServiceProviderParams.ARTIMTimeout is
+// zero.
+const DefaultARTIMTimeout = 10 * time.Second
+
 // CStoreCallback is called C-STORE request.  sopInstanceUID is the UID of the
 // data.  sopClassUID is the data type requested
 // (e.g.,"1.2.840.10008.5.1.4.1.1.1.2"), and transferSyntaxUID is the encoding
@@ -367,6 +590,17 @@ type CFindCallback func(
 	filters []*dicom.Element,
 	ch chan CFindResult)
 
+// WorklistFindCallback implements a Modality Worklist C-FIND handler. P3.4
+// K.6.1. It works the same way as CFindCallback. Unlike CFindCallback,
+// "filters" does not contain QueryRetrieveLevel. The matching keys for the
+// scheduled procedure step are found in the item of
+// ScheduledProcedureStepSequence.
+type WorklistFindCallback func(
+	conn ConnectionState,
+	transferSyntaxUID string,
+	filters []*dicom.Element,
+	ch chan CFindResult)
+
 // CMoveCallback implements C-MOVE or C-GET handler.  sopClassUID is the data
 // type requested (e.g.,"1.2.840.10008.5.1.4.1.1.1.2"), and transferSyntaxUID is
 // the data encoding requested (e.g., "1.2.840.10008.1.2.1").  These args are
@@ -387,8 +621,185 @@ type ConnectionState struct {
 	// TLS connection state. It is nonempty only when the connection is set up
 	// over TLS.
 	TLS tls.ConnectionState
+
+	// AE titles of the association, with the space padding removed.
+	// CallingAETitle is the AE that requested the association.
+	CalledAETitle  string
+	CallingAETitle string
+
+	// Context is canceled when the peer cancels the request being served
+	// using C-CANCEL, or when the association shuts down. Long-running
+	// callbacks, such as CFindCallback and CMoveCallback, should stop
+	// producing results once the context is done.
+	Context context.Context
+
+	// AsyncOpsWindow is the asynchronous operations window negotiated with
+	// the peer, from the viewpoint of the server.
+	AsyncOpsWindow AsyncOpsWindow
+
+	// UserIdentity is the identity of the client accepted by
+	// ServiceProviderParams.Authenticate. It is nil if the client presented
+	// none, or Authenticate is nil.
+	UserIdentity *UserIdentity
+
+	// ExtendedNegotiation maps a SOP class UID to the service class
+	// application information accepted by AssociationPolicy, e.g., the
+	// C-FIND options that the server agreed to support.
+	ExtendedNegotiation map[string][]byte
 }
 
+// AllowedPeer identifies a client allowed to associate with the server.
+type AllowedPeer struct {
+	// AETitle is the calling AE title of the client.
+	AETitle string
+	// Host, if nonempty, restricts the network address of the client. It is
+	// either an IP address or a host name.
+	Host string
+}
+
+// List the names that identify the owner of "cert" in
+// ServiceProviderParams.CertificateAETitles.
+func certificateNames(cert *x509.Certificate) []string {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// Check if the client at "remoteAddr" matches "p".
+func (p *AllowedPeer) matches(callingAETitle string, remoteAddr net.Addr) bool {
+	if strings.TrimSpace(p.AETitle) != callingAETitle {
+		return false
+	}
+	if p.Host == "" {
+		return true
+	}
+	if remoteAddr == nil {
+		return false
+	}
+	remoteHost, _, err := net.SplitHostPort(remoteAddr.String())
+	if err != nil {
+		return false
+	}
+	remoteIP := net.ParseIP(remoteHost)
+	if ip := net.ParseIP(p.Host); ip != nil {
+		return ip.Equal(remoteIP)
+	}
+	addrs, err := net.LookupHost(p.Host)
+	if err != nil {
+		dicomlog.Vprintf(0, "dicom.serviceProvider: Failed to resolve allowed peer %v: %v", p.Host, err)
+		return false
+	}
+	for _, addr := range addrs {
+		if net.ParseIP(addr).Equal(remoteIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that the requestor of the association took the SCP role for the SOP
+// class of "ds". It is required to send "ds" in a C-STORE sub-operation of
+// C-GET. P3.4 C.4.3.3.
+func checkCGetSCPRole(cm *contextManager, ds *dicom.DataSet) error {
+	elem, err := ds.FindElementByTag(dicomtag.MediaStorageSOPClassUID)
+	if err != nil {
+		return err
+	}
+	sopClassUID, err := elem.GetString()
+	if err != nil {
+		return err
+	}
+	if !cm.requestorRole(sopClassUID).SCPRole {
+		return fmt.Errorf("dicom.serviceProvider: The peer hasn't taken the SCP role for %v", dicomuid.UIDString(sopClassUID))
+	}
+	return nil
+}
+
+// RoleSelection describes the roles that the requestor of an association
+// proposes to take for a SOP class. P3.7 D.3.3.4. Without a role selection,
+// the requestor is an SCU and the acceptor is an SCP. The requestor must take
+// the SCP role for storage SOP classes to receive datasets through C-GET.
+type RoleSelection struct {
+	SOPClassUID string
+	// SCURole and SCPRole are the roles of the requestor. AssociationPolicy
+	// can clear them to reject the proposal.
+	SCURole bool
+	SCPRole bool
+}
+
+// PresentationContext describes a presentation context proposed by the peer in
+// an A-ASSOCIATE-RQ. P3.8 9.3.2.2.
+type PresentationContext struct {
+	// ContextID is an odd number that identifies the context in the
+	// association.
+	ContextID byte
+	// AbstractSyntaxUID is the SOP class proposed, e.g.,
+	// "1.2.840.10008.5.1.4.1.1.2" for CT image storage.
+	AbstractSyntaxUID string
+	// TransferSyntaxUIDs lists the transfer syntaxes proposed by the peer,
+	// in the order found in the request.
+	TransferSyntaxUIDs []string
+
+	// Result and TransferSyntaxUID can be changed by AssociationPolicy.
+	// They initially reflect ServiceProviderParams.TransferSyntaxes and
+	// SOPTransferSyntaxes: the context is accepted with the most preferred
+	// syntax that the peer proposed, or rejected with
+	// PresentationContextProviderRejectionTransferSyntaxNotSupported and an
+	// empty TransferSyntaxUID if there is none. TransferSyntaxUID must be
+	// one of TransferSyntaxUIDs if the context is accepted. An undefined
+	// Result rejects the context.
+	Result            pdu.PresentationContextResult
+	TransferSyntaxUID string
+}
+
+// AssociationRequest describes an A-ASSOCIATE-RQ received by the provider.
+type AssociationRequest struct {
+	// Application-entity titles found in the request, with the space
+	// padding removed.
+	CalledAETitle  string
+	CallingAETitle string
+
+	// RemoteAddr is the network address of the peer.
+	RemoteAddr net.Addr
+
+	// TLS connection state. It is nonempty only when the connection is set up
+	// over TLS.
+	TLS tls.ConnectionState
+
+	// Presentation contexts proposed by the peer.
+	PresentationContexts []*PresentationContext
+
+	// Role selections proposed by the peer. They are accepted as proposed
+	// unless the policy changes them.
+	RoleSelections []*RoleSelection
+
+	// UserIdentity is the identity presented by the peer, or nil. When
+	// AssociationPolicy is called, it has been accepted by
+	// ServiceProviderParams.Authenticate; it is nil if Authenticate is nil.
+	UserIdentity *UserIdentity
+
+	// SOP class extended negotiations proposed by the peer. The policy
+	// accepts one by setting its Response.
+	ExtendedNegotiations []*ExtendedNegotiation
+	// SOP class common extended negotiations proposed by the peer.
+	CommonExtendedNegotiations []*CommonExtendedNegotiation
+}
+
+// AssociationPolicy is called when an A-ASSOCIATE-RQ arrives. It can accept
+// or reject each proposed context by updating the PresentationContexts in
+// "req", and each proposed role by updating the RoleSelections. It accepts SOP
+// class extended negotiations by setting their Response. Returning nil
+// accepts the association. Returning non-nil rejects the whole association,
+// and the value is sent to the peer as an A-ASSOCIATE-RJ.
+type AssociationPolicy func(req *AssociationRequest) *pdu.AAssociateRj
+
 // CEchoCallback implements C-ECHO callback. It typically just returns
 // dimse.Success.
 type CEchoCallback func(conn ConnectionState) dimse.Status
@@ -399,6 +810,35 @@ type ServiceProvider struct {
 	listener net.Listener
 	// Label is a unique string used in log messages to identify this provider.
 	label string
+
+	mu sync.Mutex
+	// Set by Close or Shutdown. No new association is accepted once set.
+	closed bool // guarded by mu
+	// Live associations. Keys are providerAssociation.label.
+	associations map[string]*providerAssociation // guarded by mu
+
+	// Enforces the ServiceProviderParams.MaxAssociations* limits. nil if
+	// there is no limit.
+	limiter *associationLimiter
+}
+
+// ErrProviderClosed is returned by ServiceProvider.Run after Close or Shutdown
+// is called.
+var ErrProviderClosed = errors.New("dicom.serviceProvider: closed")
+
+// AssociationInfo describes an association accepted by a ServiceProvider. See
+// ServiceProvider.Associations.
+type AssociationInfo struct {
+	// ID identifies the association in ServiceProvider.AbortAssociation.
+	ID         string
+	RemoteAddr net.Addr
+	// AE titles are empty until the A-ASSOCIATE handshake finishes.
+	CalledAETitle  string
+	CallingAETitle string
+	// StartTime is when the connection was accepted.
+	StartTime time.Time
+	// ActiveCommands is the number of DIMSE commands running.
+	ActiveCommands int
 }
 
 func writeElementsToBytes(elems []*dicom.Element, transferSyntaxUID string) ([]byte, error) {
@@ -441,11 +881,12 @@ func elementsString(elems []*dicom.Element) string {
 }
 
 // Send "ds" to remoteHostPort using C-STORE. Called as part of C-MOVE.
-func runCStoreOnNewAssociation(myAETitle, remoteAETitle, remoteHostPort string, ds *dicom.DataSet) error {
+func runCStoreOnNewAssociation(myAETitle, remoteAETitle, remoteHostPort string, tlsConfig *tls.Config, ds *dicom.DataSet) error {
 	su, err := NewServiceUser(ServiceUserParams{
 		CalledAETitle:  remoteAETitle,
 		CallingAETitle: myAETitle,
-		SOPClasses:     sopclass.StorageClasses})
+		SOPClasses:     sopclass.StorageClasses,
+		TLSConfig:      tlsConfig})
 	if err != nil {
 		return err
 	}
@@ -456,14 +897,98 @@ func runCStoreOnNewAssociation(myAETitle, remoteAETitle, remoteHostPort string,
 	return err
 }
 
+// Check the consistency of params, and canonicalize the transfer syntax UIDs.
+func validateServiceProviderParams(params *ServiceProviderParams) error {
+	if params.CheckCalledAETitle && params.AETitle == "" {
+		return fmt.Errorf("ServiceProviderParams.CheckCalledAETitle is set, but AETitle is empty")
+	}
+	for _, peer := range params.AllowedPeers {
+		if peer.AETitle == "" {
+			return fmt.Errorf("Empty AETitle in ServiceProviderParams.AllowedPeers: %+v", peer)
+		}
+	}
+	if params.ARTIMTimeout < 0 || params.ReadTimeout < 0 || params.WriteTimeout < 0 || params.IdleTimeout < 0 {
+		return fmt.Errorf("Negative timeout in ServiceProviderParams")
+	}
+	if err := validateMaxPDUSize(params.MaxPDUSize); err != nil {
+		return err
+	}
+	if len(params.CertificateAETitles) > 0 {
+		if params.TLSConfig == nil {
+			return fmt.Errorf("ServiceProviderParams.CertificateAETitles is set, but TLSConfig is nil")
+		}
+		if params.TLSConfig.ClientAuth != tls.VerifyClientCertIfGiven && params.TLSConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+			return fmt.Errorf("ServiceProviderParams.CertificateAETitles is set, but TLSConfig.ClientAuth doesn't verify client certificates: %v", params.TLSConfig.ClientAuth)
+		}
+	}
+	if params.AsyncOpsWindow != nil {
+		if err := params.AsyncOpsWindow.validate(); err != nil {
+			return err
+		}
+	}
+	canonicalize := func(uids []string) ([]string, error) {
+		var canonicalUIDs []string
+		for _, uid := range uids {
+			canonicalUID, err := dicomio.CanonicalTransferSyntaxUID(uid)
+			if err != nil {
+				return nil, err
+			}
+			canonicalUIDs = append(canonicalUIDs, canonicalUID)
+		}
+		return canonicalUIDs, nil
+	}
+	var err error
+	if params.TransferSyntaxes, err = canonicalize(params.TransferSyntaxes); err != nil {
+		return err
+	}
+	if len(params.SOPTransferSyntaxes) > 0 {
+		sopTransferSyntaxes := map[string][]string{}
+		for sopClassUID, uids := range params.SOPTransferSyntaxes {
+			if sopTransferSyntaxes[sopClassUID], err = canonicalize(uids); err != nil {
+				return err
+			}
+		}
+		params.SOPTransferSyntaxes = sopTransferSyntaxes
+	}
+	return nil
+}
+
+// Check ServiceUserParams.MaxPDUSize or ServiceProviderParams.MaxPDUSize.
+func validateMaxPDUSize(size int) error {
+	if size == 0 || size == UnlimitedPDUSize {
+		return nil
+	}
+	if size < minMaxPDUSize || int64(size) > math.MaxUint32 {
+		return fmt.Errorf("Invalid MaxPDUSize %d; it must be in range [%d, %d], or UnlimitedPDUSize", size, minMaxPDUSize, uint32(math.MaxUint32))
+	}
+	return nil
+}
+
+// Returns the PDU size to advertise given MaxPDUSize in the params. The
+// return value is 0 for UnlimitedPDUSize, per P3.8 D.1.
+func advertisedMaxPDUSize(size int) int {
+	switch size {
+	case 0:
+		return DefaultMaxPDUSize
+	case UnlimitedPDUSize:
+		return 0
+	}
+	return size
+}
+
 // NewServiceProvider creates a new DICOM server object.  "listenAddr" is the
 // TCP address to listen to. E.g., ":1234" will listen to port 1234 at all the
 // IP address that this machine can bind to.  Run() will actually start running
 // the service.
 func NewServiceProvider(params ServiceProviderParams, port string) (*ServiceProvider, error) {
+	if err := validateServiceProviderParams(&params); err != nil {
+		return nil, err
+	}
 	sp := &ServiceProvider{
-		params: params,
-		label:  newUID("sp"),
+		params:       params,
+		label:        newUID("sp"),
+		associations: map[string]*providerAssociation{},
+		limiter:      newAssociationLimiter(&params),
 	}
 	var err error
 	if params.TLSConfig != nil {
@@ -477,60 +1002,271 @@ func NewServiceProvider(params ServiceProviderParams, port string) (*ServiceProv
 	return sp, nil
 }
 
-func getConnState(conn net.Conn) (cs ConnectionState) {
+func getConnState(conn net.Conn, command *serviceCommandState) (cs ConnectionState) {
 	tlsConn, ok := conn.(*tls.Conn)
 	if ok {
 		cs.TLS = tlsConn.ConnectionState()
 	}
+	cs.CalledAETitle = command.cm.calledAETitle
+	cs.CallingAETitle = command.cm.callingAETitle
+	cs.Context = command.ctx
+	cs.AsyncOpsWindow = command.cm.opsWindow
+	cs.UserIdentity = command.cm.userIdentity
+	cs.ExtendedNegotiation = command.cm.extendedNegotiationResponses
 	return
 }
 
+// providerAssociation is the state of one connection accepted by a
+// ServiceProvider.
+type providerAssociation struct {
+	label     string
+	conn      net.Conn
+	disp      *serviceDispatcher
+	startTime time.Time
+	limiter   *associationLimiter // nil if there is no limit.
+
+	abortOnce sync.Once
+
+	mu sync.Mutex
+	cm *contextManager // Set after the handshake completes. Guarded by mu.
+}
+
+func newProviderAssociation(conn net.Conn) *providerAssociation {
+	label := newUID("sc")
+	return &providerAssociation{
+		label:     label,
+		conn:      conn,
+		disp:      newServiceDispatcher(label),
+		startTime: time.Now(),
+	}
+}
+
+func (a *providerAssociation) info() AssociationInfo {
+	info := AssociationInfo{
+		ID:             a.label,
+		RemoteAddr:     a.conn.RemoteAddr(),
+		StartTime:      a.startTime,
+		ActiveCommands: a.disp.numActiveCommands(),
+	}
+	a.mu.Lock()
+	if a.cm != nil {
+		info.CalledAETitle = a.cm.calledAETitle
+		info.CallingAETitle = a.cm.callingAETitle
+	}
+	a.mu.Unlock()
+	return info
+}
+
+// Send an A-ABORT to the peer and close the connection. Calls after the first
+// one are no-ops.
+func (a *providerAssociation) abort() {
+	a.abortOnce.Do(func() {
+		dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Aborting association (remote: %+v)", a.label, a.conn.RemoteAddr())
+		a.disp.downcallCh <- stateEvent{event: evt15}
+	})
+}
+
 // RunProviderForConn starts threads for running a DICOM server on "conn". This
 // function returns immediately; "conn" will be cleaned up in the background.
 func RunProviderForConn(conn net.Conn, params ServiceProviderParams) {
+	newProviderAssociation(conn).run(params)
+}
+
+func (a *providerAssociation) run(params ServiceProviderParams) {
+	conn := a.conn
 	upcallCh := make(chan upcallEvent, 128)
-	label := newUID("sc")
-	disp := newServiceDispatcher(label)
+	label := a.label
+	disp := a.disp
 	disp.registerCallback(dimse.CommandFieldCStoreRq,
 		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCStore(params.CStore, getConnState(conn), msg.(*dimse.CStoreRq), data, cs)
+			handleCStore(params.CStore, getConnState(conn, cs), msg.(*dimse.CStoreRq), data, cs)
 		})
 	disp.registerCallback(dimse.CommandFieldCFindRq,
 		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCFind(params, getConnState(conn), msg.(*dimse.CFindRq), data, cs)
+			handleCFind(params, getConnState(conn, cs), msg.(*dimse.CFindRq), data, cs)
 		})
 	disp.registerCallback(dimse.CommandFieldCMoveRq,
 		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCMove(params, getConnState(conn), msg.(*dimse.CMoveRq), data, cs)
+			handleCMove(params, getConnState(conn, cs), msg.(*dimse.CMoveRq), data, cs)
 		})
 	disp.registerCallback(dimse.CommandFieldCGetRq,
 		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCGet(params, getConnState(conn), msg.(*dimse.CGetRq), data, cs)
+			handleCGet(params, getConnState(conn, cs), msg.(*dimse.CGetRq), data, cs)
 		})
 	disp.registerCallback(dimse.CommandFieldCEchoRq,
 		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCEcho(params, getConnState(conn), msg.(*dimse.CEchoRq), data, cs)
+			handleCEcho(params, getConnState(conn, cs), msg.(*dimse.CEchoRq), data, cs)
+		})
+	disp.registerCallback(dimse.CommandFieldNActionRq,
+		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+			handleNAction(params, getConnState(conn, cs), msg.(*dimse.NActionRq), data, cs)
+		})
+	disp.registerCallback(dimse.CommandFieldNEventReportRq,
+		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+			handleNEventReport(params.StorageCommitmentReport, getConnState(conn, cs), msg.(*dimse.NEventReportRq), data, cs)
+		})
+	disp.registerCallback(dimse.CommandFieldNCreateRq,
+		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+			handleNCreate(params, getConnState(conn, cs), msg.(*dimse.NCreateRq), data, cs)
+		})
+	disp.registerCallback(dimse.CommandFieldNSetRq,
+		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+			handleNSet(params, getConnState(conn, cs), msg.(*dimse.NSetRq), data, cs)
 		})
-	go runStateMachineForServiceProvider(conn, upcallCh, disp.downcallCh, label)
+	go runStateMachineForServiceProvider(conn, params, a.limiter, upcallCh, disp.downcallCh, disp.startReceiving, label)
 	for event := range upcallCh {
+		if event.eventType == upcallEventHandshakeCompleted {
+			a.mu.Lock()
+			a.cm = event.cm
+			a.mu.Unlock()
+			if params.IdleTimeout > 0 {
+				disp.watchIdle(params.IdleTimeout, a.abort)
+			}
+		}
 		disp.handleEvent(event)
 	}
 	dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Finished connection %p (remote: %+v)", label, conn, conn.RemoteAddr())
-	disp.close()
+	disp.finish()
 }
 
 // Run listens to incoming connections, accepts them, and runs the DICOM
-// protocol. This function never returns.
-func (sp *ServiceProvider) Run() {
+// protocol. It returns ErrProviderClosed after Close or Shutdown is called, or
+// the error from the listener if it fails permanently.
+func (sp *ServiceProvider) Run() error {
+	var backoff time.Duration
 	for {
 		conn, err := sp.listener.Accept()
 		if err != nil {
+			if sp.isClosed() {
+				return ErrProviderClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// E.g., out of file descriptors. Retry after a while.
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else if backoff *= 2; backoff > time.Second {
+					backoff = time.Second
+				}
+				dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Accept error: %v; retrying in %v", sp.label, err, backoff)
+				time.Sleep(backoff)
+				continue
+			}
 			dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Accept error: %v", sp.label, err)
-			continue
+			return err
 		}
+		backoff = 0
 		dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Accepted connection %p (remote: %+v)", sp.label, conn, conn.RemoteAddr())
-		go func() { RunProviderForConn(conn, sp.params) }()
+		a := newProviderAssociation(conn)
+		a.limiter = sp.limiter
+		sp.mu.Lock()
+		if sp.closed {
+			sp.mu.Unlock()
+			conn.Close()
+			return ErrProviderClosed
+		}
+		sp.associations[a.label] = a
+		sp.mu.Unlock()
+		go func() {
+			a.run(sp.params)
+			sp.mu.Lock()
+			delete(sp.associations, a.label)
+			sp.mu.Unlock()
+		}()
+	}
+}
+
+func (sp *ServiceProvider) isClosed() bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.closed
+}
+
+// Stop accepting new connections. Returns the error from closing the
+// listener.
+func (sp *ServiceProvider) closeListener() error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.closed {
+		return nil
+	}
+	sp.closed = true
+	return sp.listener.Close()
+}
+
+// Associations lists the associations that are currently alive.
+func (sp *ServiceProvider) Associations() []AssociationInfo {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	infos := make([]AssociationInfo, 0, len(sp.associations))
+	for _, a := range sp.associations {
+		infos = append(infos, a.info())
+	}
+	return infos
+}
+
+// AbortAssociation sends an A-ABORT to the peer of the association with the
+// given AssociationInfo.ID, and closes the connection. The commands running
+// on the association fail. Returns false if the association is not found,
+// e.g., because it has already finished.
+func (sp *ServiceProvider) AbortAssociation(id string) bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	a, ok := sp.associations[id]
+	if ok {
+		a.abort()
+	}
+	return ok
+}
+
+// Close stops accepting new connections, and aborts all the live associations
+// immediately. Run returns ErrProviderClosed. Use Shutdown to let the
+// associations finish first.
+func (sp *ServiceProvider) Close() error {
+	err := sp.closeListener()
+	sp.abortAssociations(false)
+	return err
+}
+
+// How often Shutdown checks for the associations that became idle.
+var shutdownPollInterval = 100 * time.Millisecond
+
+// Shutdown stops accepting new connections, and waits for the live
+// associations to finish. An association that is neither running a command
+// nor receiving a message is aborted, so the DIMSE operations in flight, e.g.,
+// C-STOREs, finish first. If ctx expires before all the associations finish,
+// the remaining ones are aborted, and ctx.Err() is returned. Run returns
+// ErrProviderClosed.
+func (sp *ServiceProvider) Shutdown(ctx context.Context) error {
+	err := sp.closeListener()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if sp.abortAssociations(true) == 0 {
+			return err
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			sp.abortAssociations(false)
+			return ctx.Err()
+		}
+	}
+}
+
+// Abort the live associations. If idleOnly, only those without a running
+// command or a message being received are aborted. Returns the number of
+// associations that were alive. An aborted association is removed from
+// sp.associations once its connection closes.
+func (sp *ServiceProvider) abortAssociations(idleOnly bool) int {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for _, a := range sp.associations {
+		if idleOnly && a.disp.busy() {
+			continue
+		}
+		a.abort()
 	}
+	return len(sp.associations)
 }
 
 // ListenAddr returns the TCP address that the server is listening on. It is the
@@ -5,9 +5,14 @@ package netdicom
 //go:generate stringer -type QRLevel
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/grailbio/go-dicom"
 	"github.com/grailbio/go-dicom/dicomio"
@@ -15,6 +20,8 @@ import (
 	"github.com/grailbio/go-dicom/dicomtag"
 	"github.com/grailbio/go-dicom/dicomuid"
 	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/pdu"
+	"github.com/grailbio/go-netdicom/sopclass"
 )
 
 type serviceUserStatus int
@@ -36,20 +43,32 @@ const (
 //  // Disconnect
 //  user.Release()
 //
-// The ServiceUser class is thread compatible. That is, you cannot call C*
-// methods - say CStore and CFind requests - concurrently from two goroutines.
-// You must wait for CStore to finish before issuing CFind.
+// The ServiceUser class is thread safe. C* methods - say CStore and CFind
+// requests - may be called concurrently from multiple goroutines. The requests
+// are multiplexed on one association. The number of outstanding requests is
+// bounded by the asynchronous operations window (P3.7 D.3.3.3); requests
+// beyond the limit wait until an earlier one finishes.
 type ServiceUser struct {
-	label    string // For  logging
-	upcallCh chan upcallEvent
+	label     string // For  logging
+	upcallCh  chan upcallEvent
+	tlsConfig *tls.Config // ServiceUserParams.TLSConfig
 
-	mu   *sync.Mutex
-	cond *sync.Cond // Broadcast when status changes.
-	disp *serviceDispatcher
+	mu          *sync.Mutex
+	ready       chan struct{} // Closed when status leaves serviceUserInitial.
+	readyOnce   sync.Once
+	releaseOnce sync.Once // Sends A-RELEASE-RQ only once.
+	disp        *serviceDispatcher
+
+	// Serializes C-GET requests. The C-STORE sub-operations of a C-GET
+	// don't say which C-GET they belong to.
+	cgetMu sync.Mutex
 
 	// Following fields are guarded by mu.
 	status serviceUserStatus
 	cm     *contextManager // Set only after the handshake completes.
+	conn   net.Conn        // Set by Connect, ConnectContext, or SetConn.
+	// The reason the association was rejected or aborted, if any.
+	err error
 	// activeCommands map[uint16]*userCommandState // List of commands running
 }
 
@@ -74,6 +93,100 @@ type ServiceUserParams struct {
 	// spec is particularly moronic here, since we could just have specified
 	// the transfer syntax per data sent.
 	TransferSyntaxes []string
+
+	// SCPRoleSOPClasses lists the SOP classes for which the client proposes
+	// to take the SCP role in addition to the SCU role. P3.7 D.3.3.4. CGet
+	// requires the SCP role for the storage SOP classes of the datasets to
+	// be retrieved. If nil and SOPClasses includes a C-GET SOP class, the
+	// client proposes the SCP role for the storage SOP classes in
+	// SOPClasses. Set it to an empty, non-nil slice to propose no role.
+	SCPRoleSOPClasses []string
+
+	// StorageCommitmentReport is called when the peer reports the result
+	// of a StorageCommitment request on this association.
+	StorageCommitmentReport StorageCommitmentReportCallback
+
+	// AsyncOpsWindow, if non-nil, is proposed to the peer as the
+	// asynchronous operations window. MaxOpsInvoked is the number of
+	// operations the ServiceUser wants to have outstanding at a time. The
+	// peer may lower the values. If nil, the window is {1, 1}, i.e.,
+	// operations run one at a time.
+	AsyncOpsWindow *AsyncOpsWindow
+
+	// UserIdentity, if non-nil, is presented to the peer as the credentials
+	// of the client. It must fit in the user information item of the
+	// A-ASSOCIATE-RQ along with the other sub-items, so its fields may total
+	// somewhat less than pdu.MaxUserIdentityLength bytes. NewServiceUser
+	// reports an error if it doesn't fit.
+	UserIdentity *UserIdentity
+
+	// ExtendedNegotiation maps a SOP class UID to the service class
+	// application information proposed for the class, e.g., the C-FIND
+	// options indexed by the CFindExt* constants. The information accepted
+	// by the peer is reported by ServiceUser.ExtendedNegotiation.
+	ExtendedNegotiation map[string][]byte
+
+	// CommonExtendedNegotiation lists the SOP class common extended
+	// negotiations sent to the peer.
+	CommonExtendedNegotiation []CommonExtendedNegotiation
+
+	// TLSConfig, if non-nil, makes Connect and ConnectContext run TLS on
+	// the connection. Set Certificates to present a client certificate,
+	// RootCAs to verify the server certificate, and ServerName if it
+	// differs from the host part of the server address.
+	TLSConfig *tls.Config
+
+	// ARTIMTimeout is how long to wait for the peer to respond to
+	// A-ASSOCIATE and A-RELEASE requests, and to close the connection
+	// after an A-ABORT. If zero, DefaultARTIMTimeout is used. P3.8 9.1.5.
+	ARTIMTimeout time.Duration
+
+	// ReadTimeout, if positive, limits the time to receive a PDU once its
+	// first byte arrives. WriteTimeout, if positive, limits the time to
+	// send a PDU. On timeout, the association is aborted.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// IdleTimeout, if positive, releases the association once no DIMSE
+	// operation has run on it for the duration.
+	IdleTimeout time.Duration
+
+	// MaxPDUSize is the maximum length of the P-DATA-TF PDUs that this side
+	// is willing to receive. It is advertised to the peer, and a larger PDU
+	// aborts the association. If zero, DefaultMaxPDUSize is used. If
+	// UnlimitedPDUSize, no limit is advertised. P3.8 D.1.
+	MaxPDUSize int
+}
+
+// Returns the SOP classes for which the client takes the SCP role, unless
+// ServiceUserParams.SCPRoleSOPClasses says otherwise. If sopClasses includes a
+// C-GET SOP class, they are the storage SOP classes in sopClasses, so that CGet
+// can receive the datasets.
+func defaultSCPRoleSOPClasses(sopClasses []string) []string {
+	storageClasses := map[string]bool{}
+	for _, uid := range sopclass.StorageClasses {
+		storageClasses[uid] = true
+	}
+	getClasses := map[string]bool{}
+	for _, uid := range sopclass.QRGetClasses {
+		if !storageClasses[uid] {
+			getClasses[uid] = true
+		}
+	}
+	var cget bool
+	for _, uid := range sopClasses {
+		cget = cget || getClasses[uid]
+	}
+	if !cget {
+		return nil
+	}
+	var scpRoleSOPClasses []string
+	for _, uid := range sopClasses {
+		if storageClasses[uid] {
+			scpRoleSOPClasses = append(scpRoleSOPClasses, uid)
+		}
+	}
+	return scpRoleSOPClasses
 }
 
 func validateServiceUserParams(params *ServiceUserParams) error {
@@ -86,6 +199,25 @@ func validateServiceUserParams(params *ServiceUserParams) error {
 	if len(params.SOPClasses) == 0 {
 		return fmt.Errorf("Empty ServiceUserParams.SOPClasses")
 	}
+	if params.AsyncOpsWindow != nil {
+		if err := params.AsyncOpsWindow.validate(); err != nil {
+			return err
+		}
+	}
+	if params.UserIdentity != nil {
+		if err := params.UserIdentity.validate(); err != nil {
+			return err
+		}
+	}
+	if params.ARTIMTimeout < 0 || params.ReadTimeout < 0 || params.WriteTimeout < 0 || params.IdleTimeout < 0 {
+		return fmt.Errorf("Negative timeout in ServiceUserParams")
+	}
+	if params.SCPRoleSOPClasses == nil {
+		params.SCPRoleSOPClasses = defaultSCPRoleSOPClasses(params.SOPClasses)
+	}
+	if err := validateMaxPDUSize(params.MaxPDUSize); err != nil {
+		return err
+	}
 	if len(params.TransferSyntaxes) == 0 {
 		params.TransferSyntaxes = dicomio.StandardTransferSyntaxes
 	} else {
@@ -97,6 +229,18 @@ func validateServiceUserParams(params *ServiceUserParams) error {
 			params.TransferSyntaxes[i] = canonicalUID
 		}
 	}
+	// Catch the items that don't fit in the A-ASSOCIATE-RQ, e.g., a long
+	// UserIdentity, before connecting.
+	cm := newContextManager("validate", advertisedMaxPDUSize(params.MaxPDUSize))
+	if _, err := pdu.EncodePDU(&pdu.AAssociate{
+		Type:            pdu.TypeAAssociateRq,
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   params.CalledAETitle,
+		CallingAETitle:  params.CallingAETitle,
+		Items:           cm.generateAssociateRequest(params),
+	}); err != nil {
+		return fmt.Errorf("ServiceUserParams don't fit in an A-ASSOCIATE-RQ: %v", err)
+	}
 	return nil
 }
 
@@ -109,23 +253,38 @@ func NewServiceUser(params ServiceUserParams) (*ServiceUser, error) {
 	mu := &sync.Mutex{}
 	label := newUID("user")
 	su := &ServiceUser{
-		label:    label,
-		upcallCh: make(chan upcallEvent, 128),
-		disp:     newServiceDispatcher(label),
-		mu:       mu,
-		cond:     sync.NewCond(mu),
-		status:   serviceUserInitial,
-	}
-	go runStateMachineForServiceUser(params, su.upcallCh, su.disp.downcallCh, label)
+		label:     label,
+		tlsConfig: params.TLSConfig,
+		upcallCh:  make(chan upcallEvent, 128),
+		disp:      newServiceDispatcher(label),
+		mu:        mu,
+		ready:     make(chan struct{}),
+		status:    serviceUserInitial,
+	}
+	su.disp.registerCallback(dimse.CommandFieldNEventReportRq,
+		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+			handleNEventReport(params.StorageCommitmentReport, getConnState(nil, cs), msg.(*dimse.NEventReportRq), data, cs)
+		})
+	go runStateMachineForServiceUser(params, su.upcallCh, su.disp.downcallCh, su.disp.startReceiving, label)
 	go func() {
 		for event := range su.upcallCh {
 			if event.eventType == upcallEventHandshakeCompleted {
 				su.mu.Lock()
 				doassert(su.cm == nil)
-				su.status = serviceUserAssociationActive
-				su.cond.Broadcast()
 				su.cm = event.cm
 				doassert(su.cm != nil)
+				su.disp.handleEvent(event)
+				su.setStatusLocked(serviceUserAssociationActive)
+				su.mu.Unlock()
+				if params.IdleTimeout > 0 {
+					su.disp.watchIdle(params.IdleTimeout, su.Release)
+				}
+				continue
+			}
+			if event.eventType == upcallEventAssociationFailed {
+				dicomlog.Vprintf(0, "dicom.serviceUser(%s): %v", label, event.err)
+				su.mu.Lock()
+				su.err = event.err
 				su.mu.Unlock()
 				continue
 			}
@@ -133,58 +292,236 @@ func NewServiceUser(params ServiceUserParams) (*ServiceUser, error) {
 			su.disp.handleEvent(event)
 		}
 		dicomlog.Vprintf(1, "dicom.serviceUser: dispatcher finished")
-		su.disp.close()
-		su.mu.Lock()
-		su.cond.Broadcast()
-		su.status = serviceUserClosed
-		su.mu.Unlock()
+		su.disp.finish()
+		su.setStatus(serviceUserClosed)
 	}()
 	return su, nil
 }
 
-func (su *ServiceUser) waitUntilReady() error {
+// Set the status and wake up the callers blocked in waitUntilReady.
+//
+// REQUIRES: su.mu is held.
+func (su *ServiceUser) setStatusLocked(status serviceUserStatus) {
+	su.status = status
+	if status != serviceUserInitial {
+		su.readyOnce.Do(func() { close(su.ready) })
+	}
+}
+
+// Wait for the A-ASSOCIATE handshake to finish. If ctx expires first, abort
+// the association and return a *ContextError for "op".
+func (su *ServiceUser) waitUntilReady(ctx context.Context, op string) error {
+	select {
+	case <-su.ready:
+	case <-ctx.Done():
+		return su.abort(op, ctx.Err())
+	}
 	su.mu.Lock()
 	defer su.mu.Unlock()
-	for su.status <= serviceUserInitial {
-		su.cond.Wait()
-	}
 	if su.status != serviceUserAssociationActive {
 		// Will get an error when waiting for a response.
 		dicomlog.Vprintf(0, "dicom.serviceUser: Connection failed")
+		if su.err != nil {
+			return fmt.Errorf("dicom.serviceUser: Connection failed: %w", su.err)
+		}
 		return fmt.Errorf("dicom.serviceUser: Connection failed")
 	}
 	return nil
 }
 
+// Create an error for "op" whose response channel was closed. If the
+// association was rejected or aborted, the error wraps an
+// *AssociationRejectedError or *AssociationAbortedError.
+func (su *ServiceUser) closedError(op string) error {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	if su.err != nil {
+		return fmt.Errorf("Connection closed while waiting for %s response: %w", op, su.err)
+	}
+	return fmt.Errorf("Connection closed while waiting for %s response", op)
+}
+
+// Start an operation "op". It waits for the A-ASSOCIATE handshake to finish,
+// then for a slot in the asynchronous operations window. On success, the
+// caller must call su.finishOp once the operation finishes. If ctx expires
+// while waiting for a slot, it returns a *ContextError, but the association
+// stays alive.
+func (su *ServiceUser) startOp(ctx context.Context, op string) error {
+	if err := su.waitUntilReady(ctx, op); err != nil {
+		return err
+	}
+	if err := su.disp.acquireInvokeSlot(ctx); err != nil {
+		return &ContextError{Op: op, Err: err}
+	}
+	return nil
+}
+
+// Release the slot taken by startOp.
+func (su *ServiceUser) finishOp() {
+	su.disp.releaseInvokeSlot()
+}
+
+// AsyncOpsWindow returns the asynchronous operations window negotiated with
+// the peer. It returns the zero value until the A-ASSOCIATE handshake
+// finishes.
+func (su *ServiceUser) AsyncOpsWindow() AsyncOpsWindow {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	if su.cm == nil {
+		return AsyncOpsWindow{}
+	}
+	return su.cm.opsWindow
+}
+
+// ContextError is returned by the ServiceUser methods that take a
+// context.Context when the context is canceled or its deadline passes before
+// the operation finishes. Any other error returned by these methods reports a
+// failure of the network or of the peer. Failures of the peer are reported as
+// *AssociationRejectedError, *AssociationAbortedError, or *DIMSEError, possibly
+// wrapped; use errors.As to extract them.
+type ContextError struct {
+	// Op is the operation that was interrupted, e.g., "C-STORE".
+	Op string
+	// Err is the value of ctx.Err(); either context.Canceled or
+	// context.DeadlineExceeded.
+	Err error
+}
+
+func (e *ContextError) Error() string {
+	return fmt.Sprintf("dicom.serviceUser: %s: %v", e.Op, e.Err)
+}
+
+// Unwrap returns e.Err, so that errors.Is(err, context.DeadlineExceeded) works.
+func (e *ContextError) Unwrap() error { return e.Err }
+
+// Timeout reports whether the error was caused by an expired deadline.
+func (e *ContextError) Timeout() bool { return e.Err == context.DeadlineExceeded }
+
+// Abort the association after the context of "op" expired. The peer receives
+// an A-ABORT PDU, and the ServiceUser becomes unusable. Returns the error to
+// be reported to the caller.
+func (su *ServiceUser) abort(op string, err error) error {
+	su.abortAssociation(op, err)
+	return &ContextError{Op: op, Err: err}
+}
+
+// Abort the association because "op" failed with "err". No-op if the
+// association is already closed.
+func (su *ServiceUser) abortAssociation(op string, err error) {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	if su.status != serviceUserClosed {
+		dicomlog.Vprintf(0, "dicom.serviceUser(%s): %s: %v; aborting association", su.label, op, err)
+		su.disp.downcallCh <- stateEvent{event: evt15}
+		su.setStatusLocked(serviceUserClosed)
+	}
+}
+
+// Set the status and wake up the callers blocked in waitUntilReady.
+func (su *ServiceUser) setStatus(status serviceUserStatus) {
+	su.mu.Lock()
+	su.setStatusLocked(status)
+	su.mu.Unlock()
+}
+
+// Crash unless Connect or SetConn hasn't been called yet.
+func (su *ServiceUser) checkInitial() {
+	su.mu.Lock()
+	status := su.status
+	su.mu.Unlock()
+	if status != serviceUserInitial {
+		panic(fmt.Sprintf("dicom.serviceUser: Connect called with wrong state: %v", status))
+	}
+}
+
 // Connect connects to the server at the given "host:port". Either Connect or
 // SetConn must be before calling CStore, etc.
 func (su *ServiceUser) Connect(serverAddr string) {
-	if su.status != serviceUserInitial {
-		panic(fmt.Sprintf("dicom.serviceUser: Connect called with wrong state: %v", su.status))
-	}
-	conn, err := net.Dial("tcp", serverAddr)
+	su.checkInitial()
+	conn, err := su.dial(context.Background(), serverAddr)
 	if err != nil {
 		dicomlog.Vprintf(0, "dicom.serviceUser: Connect(%s): %v", serverAddr, err)
 		su.disp.downcallCh <- stateEvent{event: evt17, pdu: nil, err: err}
 	} else {
-		su.disp.downcallCh <- stateEvent{event: evt02, pdu: nil, err: nil, conn: conn}
+		su.setConn(conn)
 	}
 }
 
+// Open a connection to serverAddr, running the TLS handshake if
+// ServiceUserParams.TLSConfig is set.
+func (su *ServiceUser) dial(ctx context.Context, serverAddr string) (net.Conn, error) {
+	if su.tlsConfig != nil {
+		dialer := tls.Dialer{Config: su.tlsConfig}
+		return dialer.DialContext(ctx, "tcp", serverAddr)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", serverAddr)
+}
+
+// Remember "conn", and pass it to the statemachine.
+func (su *ServiceUser) setConn(conn net.Conn) {
+	su.mu.Lock()
+	su.conn = conn
+	su.mu.Unlock()
+	su.disp.downcallCh <- stateEvent{event: evt02, pdu: nil, err: nil, conn: conn}
+}
+
+// TLSConnectionState returns the state of the TLS connection to the peer. The
+// certificate chain presented by the peer is in PeerCertificates, and the
+// chains verified against ServiceUserParams.TLSConfig.RootCAs are in
+// VerifiedChains. ok is false if the connection doesn't use TLS.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	su.mu.Lock()
+	tlsConn, ok := su.conn.(*tls.Conn)
+	su.mu.Unlock()
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tlsConn.ConnectionState(), true
+}
+
+// ConnectContext is similar to Connect, but it also waits for the
+// A-ASSOCIATE handshake to finish. If ctx expires before the handshake
+// finishes, the association is aborted, and a *ContextError is returned.
+func (su *ServiceUser) ConnectContext(ctx context.Context, serverAddr string) error {
+	su.checkInitial()
+	conn, err := su.dial(ctx, serverAddr)
+	if err != nil {
+		dicomlog.Vprintf(0, "dicom.serviceUser: Connect(%s): %v", serverAddr, err)
+		su.disp.downcallCh <- stateEvent{event: evt17, pdu: nil, err: err}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return &ContextError{Op: "connect", Err: ctxErr}
+		}
+		return err
+	}
+	su.setConn(conn)
+	return su.waitUntilReady(ctx, "connect")
+}
+
 // SetConn instructs ServiceUser to use the given network connection to talk to
 // the server. Either Connect or SetConn must be before calling CStore, etc.
+// ServiceUserParams.TLSConfig is not used; pass a *tls.Conn to run TLS.
 func (su *ServiceUser) SetConn(conn net.Conn) {
-	doassert(su.status == serviceUserInitial)
-	su.disp.downcallCh <- stateEvent{event: evt02, pdu: nil, err: nil, conn: conn}
+	su.checkInitial()
+	su.setConn(conn)
 }
 
 // CEcho send a C-ECHO request to the remote AE and waits for a
 // response. Returns nil iff the remote AE responds ok.
 func (su *ServiceUser) CEcho() error {
-	err := su.waitUntilReady()
+	return su.CEchoContext(context.Background())
+}
+
+// CEchoContext is similar to CEcho, but if ctx expires before the response
+// arrives, the association is aborted, and a *ContextError is returned.
+func (su *ServiceUser) CEchoContext(ctx context.Context) error {
+	err := su.startOp(ctx, "C-ECHO")
 	if err != nil {
 		return err
 	}
+	defer su.finishOp()
 	context, err := su.cm.lookupByAbstractSyntaxUID(dicomuid.VerificationSOPClass)
 	if err != nil {
 		return err
@@ -198,16 +535,22 @@ func (su *ServiceUser) CEcho() error {
 		&dimse.CEchoRq{MessageID: cs.messageID,
 			CommandDataSetType: dimse.CommandDataSetTypeNull,
 		}, nil)
-	event, ok := <-cs.upcallCh
+	var event upcallEvent
+	var ok bool
+	select {
+	case event, ok = <-cs.upcallCh:
+	case <-ctx.Done():
+		return su.abort("C-ECHO", ctx.Err())
+	}
 	if !ok {
-		return fmt.Errorf("Failed to receive C-ECHO response")
+		return su.closedError("C-ECHO")
 	}
 	resp, ok := event.command.(*dimse.CEchoRsp)
 	if !ok {
 		return fmt.Errorf("Invalid response for C-ECHO: %v", event.command)
 	}
 	if resp.Status.Status != dimse.StatusSuccess {
-		err = fmt.Errorf("Non-OK status in C-ECHO response: %+v", resp.Status)
+		err = &DIMSEError{Op: "C-ECHO", Status: resp.Status}
 	}
 	return err
 }
@@ -217,10 +560,17 @@ func (su *ServiceUser) CEcho() error {
 //
 // REQUIRES: Connect() or SetConn has been called.
 func (su *ServiceUser) CStore(ds *dicom.DataSet) error {
-	err := su.waitUntilReady()
+	return su.CStoreContext(context.Background(), ds)
+}
+
+// CStoreContext is similar to CStore, but if ctx expires before the response
+// arrives, the association is aborted, and a *ContextError is returned.
+func (su *ServiceUser) CStoreContext(ctx context.Context, ds *dicom.DataSet) error {
+	err := su.startOp(ctx, "C-STORE")
 	if err != nil {
 		return err
 	}
+	defer su.finishOp()
 	doassert(su.cm != nil)
 
 	var sopClassUID string
@@ -242,7 +592,81 @@ func (su *ServiceUser) CStore(ds *dicom.DataSet) error {
 		return err
 	}
 	defer su.disp.deleteCommand(cs)
-	return runCStoreOnAssociation(cs.upcallCh, su.disp.downcallCh, su.cm, cs.messageID, ds)
+	err = runCStoreOnAssociation(ctx, cs.upcallCh, su.disp, su.cm, cs.messageID, ds)
+	if err != nil && err == ctx.Err() {
+		return su.abort("C-STORE", err)
+	}
+	if err == errConnectionClosed {
+		return su.closedError("C-STORE")
+	}
+	return err
+}
+
+// CStoreStream is similar to CStoreContext, but it reads the body of the
+// dataset, i.e., the elements that follow the file meta information, from
+// "body", and sends them as they are read. The dataset is never held in
+// memory as a whole, so it works for objects of any size. E.g., "body" can be
+// a DICOM file positioned right after the meta information.
+//
+// The body must be encoded in transferSyntaxUID, and the peer must have
+// accepted that transfer syntax for sopClassUID; the data is not transcoded.
+// "body" is read in the caller's goroutine, and at most a few PDUs worth of
+// data are buffered. The fragments of a request can't be interleaved with
+// other messages, so other operations on the association can't send anything
+// until body is fully read: a slow reader stalls the association. ctx is
+// checked between reads, but a blocked read can't be interrupted. If reading
+// body fails, the returned error wraps the read error, and unless the failure
+// happened before anything was sent, the association is aborted. CStoreStream
+// doesn't read from body once it returns.
+func (su *ServiceUser) CStoreStream(ctx context.Context, sopClassUID, sopInstanceUID, transferSyntaxUID string, body io.Reader) error {
+	err := su.startOp(ctx, "C-STORE")
+	if err != nil {
+		return err
+	}
+	defer su.finishOp()
+	doassert(su.cm != nil)
+
+	context, err := su.cm.lookupByAbstractSyntaxUID(sopClassUID)
+	if err != nil {
+		dicomlog.Vprintf(0, "dicom.serviceUser: C-STORE: sop class %v not found in context %v", sopClassUID, err)
+		return err
+	}
+	if transferSyntaxUID, err = dicomio.CanonicalTransferSyntaxUID(transferSyntaxUID); err != nil {
+		return err
+	}
+	if transferSyntaxUID != context.transferSyntaxUID {
+		return fmt.Errorf("dicom.serviceUser: C-STORE: data is encoded in %s, but the peer accepted %s for %s",
+			dicomuid.UIDString(transferSyntaxUID),
+			dicomuid.UIDString(context.transferSyntaxUID),
+			dicomuid.UIDString(sopClassUID))
+	}
+	cs, err := su.disp.newCommand(su.cm, context)
+	if err != nil {
+		return err
+	}
+	defer su.disp.deleteCommand(cs)
+	dicomlog.Vprintf(1, "dicom.serviceUser: C-STORE: streaming sop class %s, instance %s",
+		dicomuid.UIDString(sopClassUID), sopInstanceUID)
+	err = runCStoreStream(ctx, cs.upcallCh, su.disp, su.cm, &dimse.CStoreRq{
+		AffectedSOPClassUID:    sopClassUID,
+		MessageID:              cs.messageID,
+		CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
+		AffectedSOPInstanceUID: sopInstanceUID,
+	}, body)
+	if err != nil && err == ctx.Err() {
+		return su.abort("C-STORE", err)
+	}
+	if readErr, ok := err.(*streamReadError); ok {
+		if readErr.sent {
+			// The peer has received a part of the request.
+			su.abortAssociation("C-STORE", readErr)
+		}
+		return readErr
+	}
+	if err == errConnectionClosed {
+		return su.closedError("C-STORE")
+	}
+	return err
 }
 
 // QRLevel is used to specify the element hierarchy assumed during C-FIND,
@@ -337,34 +761,112 @@ func encodeQRPayload(opType qrOpType, qrLevel QRLevel, filter []*dicom.Element,
 
 // CFind issues a C-FIND request. Returns a channel that streams sequence of
 // either an error or a dataset found. The caller MUST read all responses from
-// the channel before issuing any other DIMSE command (C-FIND, C-STORE, etc).
+// the channel. Other DIMSE commands may be issued meanwhile, but the C-FIND
+// occupies a slot in the asynchronous operations window until it finishes.
 //
 // The param sopClassUID is one of the UIDs defined in sopclass.QRFindClasses.
 // filter is the list of elements to match and retrieve.
 //
 // REQUIRES: Connect() or SetConn has been called.
 func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFindResult {
+	return su.CFindContext(context.Background(), qrLevel, filter)
+}
+
+// CFindContext is similar to CFind, but when "ctx" is canceled, it sends a
+// C-CANCEL request to the peer. The channel reports a *ContextError once the
+// peer acknowledges the cancellation. If the peer does not acknowledge it
+// within cancelGracePeriod, the association is aborted. The caller must still
+// read all responses from the channel.
+func (su *ServiceUser) CFindContext(ctx context.Context, qrLevel QRLevel, filter []*dicom.Element) chan CFindResult {
+	return su.runCFind(ctx, func() (contextManagerEntry, []byte, error) {
+		return encodeQRPayload(qrOpCFind, qrLevel, filter, su.cm)
+	})
+}
+
+// WorklistFind issues a Modality Worklist C-FIND request. P3.4 K.6.1.
+//
+// "filter" lists the matching and return keys at the top level of the
+// dataset, e.g., PatientName. "spsFilter" lists the keys to be placed in the
+// item of ScheduledProcedureStepSequence, e.g., Modality,
+// ScheduledStationAETitle, and ScheduledProcedureStepStartDate. If spsFilter
+// is empty, "filter" is sent as is. Unlike CFind, QueryRetrieveLevel is not
+// added to the request.
+//
+// The result is streamed through the channel the same way as CFind.
+// ServiceUserParams.SOPClasses must include sopclass.WorklistFindClasses.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) WorklistFind(filter, spsFilter []*dicom.Element) chan CFindResult {
+	return su.WorklistFindContext(context.Background(), filter, spsFilter)
+}
+
+// WorklistFindContext is similar to WorklistFind, but it can be canceled
+// the same way as CFindContext.
+func (su *ServiceUser) WorklistFindContext(ctx context.Context, filter, spsFilter []*dicom.Element) chan CFindResult {
+	return su.runCFind(ctx, func() (contextManagerEntry, []byte, error) {
+		return encodeWorklistPayload(filter, spsFilter, su.cm)
+	})
+}
+
+// Encode the payload of a Modality Worklist C-FIND request.
+func encodeWorklistPayload(filter, spsFilter []*dicom.Element, cm *contextManager) (contextManagerEntry, []byte, error) {
+	context, err := cm.lookupByAbstractSyntaxUID(sopclass.WorklistFindClasses[0])
+	if err != nil {
+		return context, nil, err
+	}
+	elems := append([]*dicom.Element{}, filter...)
+	if len(spsFilter) > 0 {
+		for _, elem := range filter {
+			if elem.Tag == dicomtag.ScheduledProcedureStepSequence {
+				return context, nil, fmt.Errorf("dicom.serviceUser: Both filter and spsFilter specify ScheduledProcedureStepSequence")
+			}
+		}
+		item := append([]*dicom.Element{}, spsFilter...)
+		sortElements(item)
+		elems = append(elems, newSequenceElement(dicomtag.ScheduledProcedureStepSequence, [][]*dicom.Element{item}))
+	}
+	sortElements(elems)
+	payload, err := writeElementsToBytes(elems, context.transferSyntaxUID)
+	return context, payload, err
+}
+
+// Sort elements in the ascending tag order, as required in a dataset. P3.5 7.1.
+func sortElements(elems []*dicom.Element) {
+	sort.SliceStable(elems, func(i, j int) bool {
+		if elems[i].Tag.Group != elems[j].Tag.Group {
+			return elems[i].Tag.Group < elems[j].Tag.Group
+		}
+		return elems[i].Tag.Element < elems[j].Tag.Element
+	})
+}
+
+// Run a C-FIND request. "encode" is called once the association is
+// established to produce the context and the payload.
+func (su *ServiceUser) runCFind(ctx context.Context, encode func() (contextManagerEntry, []byte, error)) chan CFindResult {
 	ch := make(chan CFindResult, 128)
-	err := su.waitUntilReady()
+	err := su.startOp(ctx, "C-FIND")
 	if err != nil {
 		ch <- CFindResult{Err: err}
 		close(ch)
 		return ch
 	}
-	context, payload, err := encodeQRPayload(qrOpCFind, qrLevel, filter, su.cm)
+	context, payload, err := encode()
 	if err != nil {
+		su.finishOp()
 		ch <- CFindResult{Err: err}
 		close(ch)
 		return ch
 	}
 	cs, err := su.disp.newCommand(su.cm, context)
 	if err != nil {
+		su.finishOp()
 		ch <- CFindResult{Err: err}
 		close(ch)
 		return ch
 	}
 	go func() {
 		defer close(ch)
+		defer su.finishOp()
 		defer su.disp.deleteCommand(cs)
 		cs.sendMessage(
 			&dimse.CFindRq{
@@ -373,11 +875,25 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 				CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
 			},
 			payload)
+		cancelCh := ctx.Done()
+		var abortCh <-chan time.Time
 		for {
-			event, ok := <-cs.upcallCh
+			var event upcallEvent
+			var ok bool
+			select {
+			case event, ok = <-cs.upcallCh:
+			case <-cancelCh:
+				cancelCh = nil
+				sendCancel(cs)
+				abortCh = time.After(cancelGracePeriod)
+				continue
+			case <-abortCh:
+				ch <- CFindResult{Err: su.abort("C-FIND", ctx.Err())}
+				return
+			}
 			if !ok {
-				su.status = serviceUserClosed
-				ch <- CFindResult{Err: fmt.Errorf("Connection closed while waiting for C-FIND response")}
+				su.setStatus(serviceUserClosed)
+				ch <- CFindResult{Err: su.closedError("C-FIND")}
 				break
 			}
 			doassert(event.eventType == upcallEventData)
@@ -387,17 +903,25 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 				ch <- CFindResult{Err: fmt.Errorf("Found wrong response for C-FIND: %v", event.command)}
 				break
 			}
-			elems, err := readElementsInBytes(event.data, context.transferSyntaxUID)
-			if err != nil {
-				dicomlog.Vprintf(0, "dicom.serviceUser: Failed to decode C-FIND response: %v %v", resp.String(), err)
-				ch <- CFindResult{Err: err}
-			} else {
-				ch <- CFindResult{Elements: elems}
+			if resp.Status.Status == dimse.StatusCancel {
+				ch <- CFindResult{Err: canceledError(ctx, "C-FIND")}
+				break
+			}
+			// The final response usually carries no dataset.
+			if resp.HasData() {
+				elems, err := readElementsInBytes(event.data, context.transferSyntaxUID)
+				if err != nil {
+					dicomlog.Vprintf(0, "dicom.serviceUser: Failed to decode C-FIND response: %v %v", resp.String(), err)
+					ch <- CFindResult{Err: err}
+				} else {
+					ch <- CFindResult{Elements: elems}
+				}
 			}
 			if resp.Status.Status != dimse.StatusPending {
 				if resp.Status.Status != 0 {
-					// TODO: report error if status!= 0
-					panic(resp)
+					err := &DIMSEError{Op: "C-FIND", Status: resp.Status}
+					dicomlog.Vprintf(0, "dicom.serviceUser: C-FIND: %v", err)
+					ch <- CFindResult{Err: err}
 				}
 				break
 			}
@@ -406,6 +930,133 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 	return ch
 }
 
+// CMoveProgress is an object streamed by CMove method. It reports the
+// sub-operation counters found in a C-MOVE response. P3.4 C.4.2.1.6.
+type CMoveProgress struct {
+	// Err is set if the C-MOVE failed, or the server reported an error
+	// status in the final response. A warning status, e.g.,
+	// dimse.CMoveSubOperationsCompleteWithFailures, is not an error; it is
+	// reported only in Status, along with the counters.
+	Err error
+
+	// Status reported by the server. It is StatusPending for all but the
+	// last response.
+	Status dimse.Status
+
+	Remaining int // Number of remaining sub-operations.
+	Completed int // Number of sub-operations completed successfully.
+	Failed    int // Number of failed sub-operations.
+	Warning   int // Number of sub-operations that completed with warnings.
+}
+
+// CMove issues a C-MOVE request. It asks the remote peer to send the datasets
+// matching the "filter" to the application entity "moveDestination" using
+// C-STORE.  The remote peer must know how to reach moveDestination; it is
+// typically registered in the peer's configuration.
+//
+// CMove returns a channel that streams the sub-operation counters reported in
+// each C-MOVE response. The last value sent through the channel reports the
+// final status. The caller MUST read all responses from the channel, as with
+// CFind.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CMove(qrLevel QRLevel, filter []*dicom.Element, moveDestination string) chan CMoveProgress {
+	return su.CMoveContext(context.Background(), qrLevel, filter, moveDestination)
+}
+
+// CMoveContext is similar to CMove, but when "ctx" is canceled, it sends a
+// C-CANCEL request to the peer. The final value sent through the channel
+// reports a *ContextError along with the sub-operation counters. If the peer
+// does not acknowledge the cancellation within cancelGracePeriod, the
+// association is aborted.
+func (su *ServiceUser) CMoveContext(ctx context.Context, qrLevel QRLevel, filter []*dicom.Element, moveDestination string) chan CMoveProgress {
+	ch := make(chan CMoveProgress, 128)
+	err := su.startOp(ctx, "C-MOVE")
+	if err != nil {
+		ch <- CMoveProgress{Err: err}
+		close(ch)
+		return ch
+	}
+	context, payload, err := encodeQRPayload(qrOpCMove, qrLevel, filter, su.cm)
+	if err != nil {
+		su.finishOp()
+		ch <- CMoveProgress{Err: err}
+		close(ch)
+		return ch
+	}
+	cs, err := su.disp.newCommand(su.cm, context)
+	if err != nil {
+		su.finishOp()
+		ch <- CMoveProgress{Err: err}
+		close(ch)
+		return ch
+	}
+	go func() {
+		defer close(ch)
+		defer su.finishOp()
+		defer su.disp.deleteCommand(cs)
+		cs.sendMessage(
+			&dimse.CMoveRq{
+				AffectedSOPClassUID: context.abstractSyntaxUID,
+				MessageID:           cs.messageID,
+				MoveDestination:     moveDestination,
+				CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
+			},
+			payload)
+		cancelCh := ctx.Done()
+		var abortCh <-chan time.Time
+		for {
+			var event upcallEvent
+			var ok bool
+			select {
+			case event, ok = <-cs.upcallCh:
+			case <-cancelCh:
+				cancelCh = nil
+				sendCancel(cs)
+				abortCh = time.After(cancelGracePeriod)
+				continue
+			case <-abortCh:
+				ch <- CMoveProgress{Err: su.abort("C-MOVE", ctx.Err())}
+				return
+			}
+			if !ok {
+				su.setStatus(serviceUserClosed)
+				ch <- CMoveProgress{Err: su.closedError("C-MOVE")}
+				break
+			}
+			doassert(event.eventType == upcallEventData)
+			doassert(event.command != nil)
+			resp, ok := event.command.(*dimse.CMoveRsp)
+			if !ok {
+				ch <- CMoveProgress{Err: fmt.Errorf("Found wrong response for C-MOVE: %v", event.command)}
+				break
+			}
+			progress := CMoveProgress{
+				Status:    resp.Status,
+				Remaining: int(resp.NumberOfRemainingSuboperations),
+				Completed: int(resp.NumberOfCompletedSuboperations),
+				Failed:    int(resp.NumberOfFailedSuboperations),
+				Warning:   int(resp.NumberOfWarningSuboperations),
+			}
+			if resp.Status.Status == dimse.StatusPending {
+				ch <- progress
+				continue
+			}
+			if resp.Status.Status == dimse.StatusCancel {
+				progress.Err = canceledError(ctx, "C-MOVE")
+			} else if isWarningStatus(resp.Status.Status) {
+				dicomlog.Vprintf(0, "dicom.serviceUser: C-MOVE: completed with warning %v", resp.Status)
+			} else if resp.Status.Status != dimse.StatusSuccess {
+				progress.Err = &DIMSEError{Op: "C-MOVE", Status: resp.Status}
+				dicomlog.Vprintf(0, "dicom.serviceUser: C-MOVE: %v", progress.Err)
+			}
+			ch <- progress
+			break
+		}
+	}()
+	return ch
+}
+
 // CGet runs a C-GET command. It calls "cb" sequentially for every dataset
 // received. "cb" should return dimse.Success iff the data was successfully and
 // stably written. This function blocks until it receives all datasets from the
@@ -414,13 +1065,36 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 // The "data" arg to "cb" is the serialized dataset, encoded according to
 // transferSyntaxUID.
 //
+// The peer sends the datasets only if the SCP role is negotiated for their SOP
+// classes. See ServiceUserParams.SCPRoleSOPClasses. If some datasets can't be
+// sent, the peer reports a warning status, e.g.,
+// dimse.CMoveSubOperationsCompleteWithFailures. As in CMove, a warning is not
+// an error: it is logged, and the datasets not passed to "cb" are the ones that
+// failed. A failure status is returned as a *DIMSEError.
+//
+// Concurrent CGet calls on one ServiceUser run one at a time, since the
+// sub-operations cannot be attributed to a particular C-GET.
+//
 // TODO(saito) We should parse the data into DataSet before passing to "cb".
 func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 	cb func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status) error {
-	err := su.waitUntilReady()
+	return su.CGetContext(context.Background(), qrLevel, filter, cb)
+}
+
+// CGetContext is similar to CGet, but when "ctx" is canceled, it sends a
+// C-CANCEL request to the peer. It returns a *ContextError once the peer
+// acknowledges the cancellation. Datasets that arrive before the
+// acknowledgement are still passed to "cb". If the peer does not acknowledge
+// the cancellation within cancelGracePeriod, the association is aborted.
+func (su *ServiceUser) CGetContext(ctx context.Context, qrLevel QRLevel, filter []*dicom.Element,
+	cb func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status) error {
+	su.cgetMu.Lock()
+	defer su.cgetMu.Unlock()
+	err := su.startOp(ctx, "C-GET")
 	if err != nil {
 		return err
 	}
+	defer su.finishOp()
 	context, payload, err := encodeQRPayload(qrOpCGet, qrLevel, filter, su.cm)
 	if err != nil {
 		return err
@@ -456,11 +1130,24 @@ func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 			CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
 		},
 		payload)
+	cancelCh := ctx.Done()
+	var abortCh <-chan time.Time
 	for {
-		event, ok := <-cs.upcallCh
+		var event upcallEvent
+		var ok bool
+		select {
+		case event, ok = <-cs.upcallCh:
+		case <-cancelCh:
+			cancelCh = nil
+			sendCancel(cs)
+			abortCh = time.After(cancelGracePeriod)
+			continue
+		case <-abortCh:
+			return su.abort("C-GET", ctx.Err())
+		}
 		if !ok {
-			su.status = serviceUserClosed
-			return fmt.Errorf("Connection closed while waiting for C-GET response")
+			su.setStatus(serviceUserClosed)
+			return su.closedError("C-GET")
 		}
 		doassert(event.eventType == upcallEventData)
 		doassert(event.command != nil)
@@ -468,9 +1155,14 @@ func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 		if !ok {
 			return fmt.Errorf("Found wrong response for C-GET: %v", event.command)
 		}
+		if resp.Status.Status == dimse.StatusCancel {
+			return canceledError(ctx, "C-GET")
+		}
 		if resp.Status.Status != dimse.StatusPending {
-			if resp.Status.Status != 0 {
-				e := fmt.Errorf("Received C-GET error: %+v", resp)
+			if isWarningStatus(resp.Status.Status) {
+				dicomlog.Vprintf(0, "dicom.serviceUser: C-GET: completed with warning %v", resp.Status)
+			} else if resp.Status.Status != dimse.StatusSuccess {
+				e := &DIMSEError{Op: "C-GET", Status: resp.Status}
 				dicomlog.Vprintf(0, "dicom.serviceUser: C-GET: %v", e)
 				return e
 			}
@@ -480,13 +1172,46 @@ func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 	return nil
 }
 
-// Release shuts down the connection. It must be called exactly once.  After
-// Release(), no other operation can be performed on the ServiceUser object.
+// Reports whether "status" is a warning, i.e., the operation completed, but
+// with problems. P3.7 C, P3.4 C.4.2.1.5.
+func isWarningStatus(status dimse.StatusCode) bool {
+	return status&0xf000 == 0xb000 ||
+		status == dimse.StatusOptionalAttributesNotSupported ||
+		status == dimse.StatusAttributeListError ||
+		status == dimse.StatusAttributeValueOutOfRange
+}
+
+// How long C-{FIND,GET,MOVE} wait for the peer to acknowledge a C-CANCEL
+// before aborting the association.
+var cancelGracePeriod = 5 * time.Second
+
+// Send a C-CANCEL request for the command "cs". P3.7 9.3.2.3.
+func sendCancel(cs *serviceCommandState) {
+	dicomlog.Vprintf(1, "dicom.serviceUser: Sending C-CANCEL for message %v", cs.messageID)
+	cs.sendMessage(&dimse.CCancelRq{
+		MessageIDBeingRespondedTo: cs.messageID,
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+	}, nil)
+}
+
+// Produce an error to report when the peer acknowledges a cancellation. The
+// peer may also cancel an operation on its own, in which case ctx.Err() is nil.
+func canceledError(ctx context.Context, op string) error {
+	if err := ctx.Err(); err != nil {
+		return &ContextError{Op: op, Err: err}
+	}
+	return fmt.Errorf("%s canceled by the peer", op)
+}
+
+// Release shuts down the connection. After Release(), no other operation can
+// be performed on the ServiceUser object. Calls after the first one, or after
+// the association is released for IdleTimeout, are no-ops.
 func (su *ServiceUser) Release() {
-	su.disp.downcallCh <- stateEvent{event: evt11}
+	su.releaseOnce.Do(func() {
+		su.disp.downcallCh <- stateEvent{event: evt11}
+	})
 	su.mu.Lock()
 	defer su.mu.Unlock()
-	su.status = serviceUserClosed
-	su.cond.Broadcast()
+	su.setStatusLocked(serviceUserClosed)
 	su.disp.close()
 }
@@ -143,6 +143,23 @@ var StorageClasses = []string{
 	standardUID("1.2.840.10008.5.1.4.45.1"),
 }
 
+// StorageCommitmentClasses is for issuing storage commitment requests
+// (N-ACTION) and reports (N-EVENT-REPORT).
+var StorageCommitmentClasses = []string{
+	standardUID("1.2.840.10008.1.20.1"),
+}
+
+// MPPSClasses is for creating and updating Modality Performed Procedure Step
+// instances using N-CREATE and N-SET.
+var MPPSClasses = []string{
+	standardUID("1.2.840.10008.3.1.2.3.3"),
+}
+
+// WorklistFindClasses is for issuing Modality Worklist C-FIND requests.
+var WorklistFindClasses = []string{
+	standardUID("1.2.840.10008.5.1.4.31"),
+}
+
 // QRFindClasses is for issuing C-FIND requests.
 var QRFindClasses = []string{
 	standardUID("1.2.840.10008.5.1.4.1.2.1.1"),
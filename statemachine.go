@@ -4,6 +4,7 @@ package netdicom
 // http://dicom.nema.org/medical/dicom/current/output/pdf/part08.pdf
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -161,10 +162,10 @@ var actionAe2 = &stateAction{"AE-2", "Connection established on the user side. S
 	func(sm *stateMachine, event stateEvent) stateType {
 		doassert(event.conn != nil)
 		sm.conn = event.conn
-		go networkReaderThread(sm.netCh, event.conn, DefaultMaxPDUSize, sm.label)
-		items := sm.contextManager.generateAssociateRequest(
-			sm.userParams.SOPClasses,
-			sm.userParams.TransferSyntaxes)
+		go networkReaderThread(sm.netCh, event.conn, sm.contextManager.maxPDUSize, sm.readTimeout, sm.label)
+		sm.contextManager.calledAETitle = strings.TrimSpace(sm.userParams.CalledAETitle)
+		sm.contextManager.callingAETitle = strings.TrimSpace(sm.userParams.CallingAETitle)
+		items := sm.contextManager.generateAssociateRequest(&sm.userParams)
 		pdu := &pdu.AAssociate{
 			Type:            pdu.TypeAAssociateRq,
 			ProtocolVersion: pdu.CurrentProtocolVersion,
@@ -196,6 +197,9 @@ var actionAe3 = &stateAction{"AE-3", "Issue A-ASSOCIATE confirmation (accept) pr
 
 var actionAe4 = &stateAction{"AE-4", "Issue A-ASSOCIATE confirmation (reject) primitive and close transport connection",
 	func(sm *stateMachine, event stateEvent) stateType {
+		if v, ok := event.pdu.(*pdu.AAssociateRj); ok {
+			sm.err = &AssociationRejectedError{Result: v.Result, Source: v.Source, Reason: v.Reason}
+		}
 		closeConnection(sm)
 		return sta01
 	}}
@@ -205,7 +209,7 @@ var actionAe5 = &stateAction{"AE-5", "Issue Transport connection response primit
 		doassert(event.conn != nil)
 		startTimer(sm)
 		go func(ch chan stateEvent, conn net.Conn) {
-			networkReaderThread(ch, conn, DefaultMaxPDUSize, sm.label)
+			networkReaderThread(ch, conn, sm.contextManager.maxPDUSize, sm.readTimeout, sm.label)
 		}(sm.netCh, event.conn)
 		return sta02
 	}}
@@ -233,7 +237,13 @@ otherwise issue A-ASSOCIATE-RJ-PDU and start ARTIM timer`,
 			startTimer(sm)
 			return sta13
 		}
-		responses, err := sm.contextManager.onAssociateRequest(v.Items)
+		sm.contextManager.calledAETitle = strings.TrimSpace(v.CalledAETitle)
+		sm.contextManager.callingAETitle = strings.TrimSpace(v.CallingAETitle)
+		contexts, err := sm.contextManager.onAssociateRequest(v.Items, &sm.providerParams)
+		var req *AssociationRequest
+		if err == nil {
+			req = newAssociationRequest(sm, v, contexts)
+		}
 		if err != nil {
 			// TODO(saito) set proper error code.
 			sm.downcallCh <- stateEvent{
@@ -244,10 +254,23 @@ otherwise issue A-ASSOCIATE-RJ-PDU and start ARTIM timer`,
 					Reason: 1,
 				},
 			}
+		} else if rj := checkAETitles(sm, v); rj != nil {
+			dicomlog.Vprintf(0, "dicom.stateMachine(%s): Association from %v to %v rejected: %v", sm.label, v.CallingAETitle, v.CalledAETitle, rj.String())
+			sm.downcallCh <- stateEvent{event: evt08, pdu: rj}
+		} else if rj := checkCertificateAETitle(sm, v); rj != nil {
+			dicomlog.Vprintf(0, "dicom.stateMachine(%s): Association from %v rejected: AE title not allowed for the client certificate", sm.label, v.CallingAETitle)
+			sm.downcallCh <- stateEvent{event: evt08, pdu: rj}
+		} else if rj := checkUserIdentity(sm, req); rj != nil {
+			dicomlog.Vprintf(0, "dicom.stateMachine(%s): Association from %v rejected by authentication: %v", sm.label, v.CallingAETitle, rj.String())
+			sm.downcallCh <- stateEvent{event: evt08, pdu: rj}
+		} else if rj := checkAssociationPolicy(sm, req); rj != nil {
+			dicomlog.Vprintf(0, "dicom.stateMachine(%s): Association from %v rejected by policy: %v", sm.label, v.CallingAETitle, rj.String())
+			sm.downcallCh <- stateEvent{event: evt08, pdu: rj}
+		} else if rj := checkAssociationLimits(sm, v); rj != nil {
+			sm.downcallCh <- stateEvent{event: evt08, pdu: rj}
 		} else {
+			responses := sm.contextManager.generateAssociateResponse(contexts)
 			doassert(len(responses) > 0)
-			doassert(v.CalledAETitle != "")
-			doassert(v.CallingAETitle != "")
 			sm.downcallCh <- stateEvent{
 				event: evt07,
 				pdu: &pdu.AAssociate{
@@ -261,6 +284,156 @@ otherwise issue A-ASSOCIATE-RJ-PDU and start ARTIM timer`,
 		}
 		return sta03
 	}}
+
+// Check the AE titles in the A-ASSOCIATE-RQ against
+// ServiceProviderParams.{CheckCalledAETitle,AllowedPeers}. Returns non-nil if
+// the association is to be rejected. P3.8 9.3.4. A blank AE title is always
+// rejected.
+func checkAETitles(sm *stateMachine, v *pdu.AAssociate) *pdu.AAssociateRj {
+	params := &sm.providerParams
+	if isBlankAETitle(v.CalledAETitle) {
+		return &pdu.AAssociateRj{
+			Result: pdu.ResultRejectedPermanent,
+			Source: pdu.SourceULServiceUser,
+			Reason: pdu.RejectReasonCalledAETitleNotRecognized,
+		}
+	}
+	if isBlankAETitle(v.CallingAETitle) {
+		return &pdu.AAssociateRj{
+			Result: pdu.ResultRejectedPermanent,
+			Source: pdu.SourceULServiceUser,
+			Reason: pdu.RejectReasonCallingAETitleNotRecognized,
+		}
+	}
+	if params.CheckCalledAETitle && strings.TrimSpace(v.CalledAETitle) != strings.TrimSpace(params.AETitle) {
+		return &pdu.AAssociateRj{
+			Result: pdu.ResultRejectedPermanent,
+			Source: pdu.SourceULServiceUser,
+			Reason: pdu.RejectReasonCalledAETitleNotRecognized,
+		}
+	}
+	if len(params.AllowedPeers) > 0 {
+		var remoteAddr net.Addr
+		if sm.conn != nil {
+			remoteAddr = sm.conn.RemoteAddr()
+		}
+		callingAETitle := strings.TrimSpace(v.CallingAETitle)
+		for i := range params.AllowedPeers {
+			if params.AllowedPeers[i].matches(callingAETitle, remoteAddr) {
+				return nil
+			}
+		}
+		return &pdu.AAssociateRj{
+			Result: pdu.ResultRejectedPermanent,
+			Source: pdu.SourceULServiceUser,
+			Reason: pdu.RejectReasonCallingAETitleNotRecognized,
+		}
+	}
+	return nil
+}
+
+// isBlankAETitle reports whether the AE title consists only of padding. P3.5
+// 6.2 doesn't allow an AE value of only spaces.
+func isBlankAETitle(title string) bool {
+	return strings.Trim(title, " \x00") == ""
+}
+
+// Check the calling AE title in the A-ASSOCIATE-RQ against the client
+// certificate, using ServiceProviderParams.CertificateAETitles. Returns non-nil
+// if the association is to be rejected.
+func checkCertificateAETitle(sm *stateMachine, v *pdu.AAssociate) *pdu.AAssociateRj {
+	mapping := sm.providerParams.CertificateAETitles
+	if len(mapping) == 0 {
+		return nil
+	}
+	rj := &pdu.AAssociateRj{
+		Result: pdu.ResultRejectedPermanent,
+		Source: pdu.SourceULServiceUser,
+		Reason: pdu.RejectReasonCallingAETitleNotRecognized,
+	}
+	tlsConn, ok := sm.conn.(*tls.Conn)
+	if !ok {
+		return rj
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		// No certificate, or it wasn't verified.
+		return rj
+	}
+	callingAETitle := strings.TrimSpace(v.CallingAETitle)
+	for _, name := range certificateNames(state.PeerCertificates[0]) {
+		for _, aeTitle := range mapping[name] {
+			if strings.TrimSpace(aeTitle) == callingAETitle {
+				return nil
+			}
+		}
+	}
+	return rj
+}
+
+// Create an AssociationRequest that describes the A-ASSOCIATE-RQ "v".
+func newAssociationRequest(sm *stateMachine, v *pdu.AAssociate, contexts []*PresentationContext) *AssociationRequest {
+	req := &AssociationRequest{
+		CalledAETitle:        strings.TrimSpace(v.CalledAETitle),
+		CallingAETitle:       strings.TrimSpace(v.CallingAETitle),
+		PresentationContexts: contexts,
+		RoleSelections:       sm.contextManager.roleSelections,
+		UserIdentity:         sm.contextManager.userIdentity,
+
+		ExtendedNegotiations:       sm.contextManager.extendedNegotiations,
+		CommonExtendedNegotiations: sm.contextManager.commonExtendedNegotiations,
+	}
+	if sm.conn != nil {
+		req.RemoteAddr = sm.conn.RemoteAddr()
+		if tlsConn, ok := sm.conn.(*tls.Conn); ok {
+			req.TLS = tlsConn.ConnectionState()
+		}
+	}
+	return req
+}
+
+// Run ServiceProviderParams.Authenticate, if any, against the user identity
+// in the A-ASSOCIATE-RQ. Returns non-nil if the association is to be rejected.
+// P3.7 D.3.3.7.
+func checkUserIdentity(sm *stateMachine, req *AssociationRequest) *pdu.AAssociateRj {
+	cm := sm.contextManager
+	authenticate := sm.providerParams.Authenticate
+	if authenticate == nil {
+		// Nobody vouches for the identity, so don't report it to the
+		// DIMSE callbacks.
+		cm.userIdentity = nil
+		req.UserIdentity = nil
+		return nil
+	}
+	response, err := authenticate(req)
+	if err != nil {
+		dicomlog.Vprintf(0, "dicom.stateMachine(%s): Authentication of %v failed: %v", sm.label, req.CallingAETitle, err)
+		cm.userIdentity = nil
+		return &pdu.AAssociateRj{
+			Result: pdu.ResultRejectedPermanent,
+			Source: pdu.SourceULServiceUser,
+			Reason: pdu.RejectReasonNone,
+		}
+	}
+	if req.UserIdentity != nil && req.UserIdentity.PositiveResponseRequested {
+		if response == nil {
+			response = []byte{}
+		}
+		cm.userIdentityResponse = response
+	}
+	return nil
+}
+
+// Run ServiceProviderParams.AssociationPolicy, if any, against the
+// A-ASSOCIATE-RQ. Returns non-nil if the association is to be rejected.
+func checkAssociationPolicy(sm *stateMachine, req *AssociationRequest) *pdu.AAssociateRj {
+	policy := sm.providerParams.AssociationPolicy
+	if policy == nil {
+		return nil
+	}
+	return policy(req)
+}
+
 var actionAe7 = &stateAction{"AE-7", "Send A-ASSOCIATE-AC PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
 		sendPDU(sm, event.pdu.(*pdu.AAssociate))
@@ -279,18 +452,19 @@ var actionAe8 = &stateAction{"AE-8", "Send A-ASSOCIATE-RJ PDU and start ARTIM ti
 	}}
 
 // Produce a list of P_DATA_TF PDUs that collective store "data".
-func splitDataIntoPDUs(sm *stateMachine, abstractSyntaxName string, command bool, data []byte) []pdu.PDataTf {
-	doassert(len(data) > 0)
+func splitDataIntoPDUs(sm *stateMachine, abstractSyntaxName string, command bool, data []byte) ([]pdu.PDataTf, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("dicom.stateMachine(%s): Empty DIMSE payload for %s", sm.label, dicomuid.UIDString(abstractSyntaxName))
+	}
 	context, err := sm.contextManager.lookupByAbstractSyntaxUID(abstractSyntaxName)
 	if err != nil {
-		// TODO(saito) Don't crash here.
-		panic(fmt.Sprintf("dicom.stateMachine(%s): Illegal syntax name %s: %s", sm.label, dicomuid.UIDString(abstractSyntaxName), err))
+		return nil, fmt.Errorf("dicom.stateMachine(%s): Illegal syntax name %s: %s", sm.label, dicomuid.UIDString(abstractSyntaxName), err)
 	}
 	var pdus []pdu.PDataTf
-	// two byte header overhead.
-	//
-	// TODO(saito) move the magic number elsewhere.
-	var maxChunkSize = sm.contextManager.peerMaxPDUSize - 8
+	maxChunkSize, err := maxPDUChunkSize(sm.contextManager)
+	if err != nil {
+		return nil, err
+	}
 	for len(data) > 0 {
 		chunkSize := len(data)
 		if chunkSize > maxChunkSize {
@@ -309,40 +483,106 @@ func splitDataIntoPDUs(sm *stateMachine, abstractSyntaxName string, command bool
 	if len(pdus) > 0 {
 		pdus[len(pdus)-1].Items[0].Last = true
 	}
-	return pdus
+	return pdus, nil
+}
+
+// Returns the max number of bytes of a DIMSE command or data to be stored in
+// one P_DATA_TF PDU sent to the peer described by "cm".
+func maxPDUChunkSize(cm *contextManager) (int, error) {
+	// two byte header overhead.
+	//
+	// TODO(saito) move the magic number elsewhere.
+	var maxChunkSize = cm.peerMaxPDUSize - 8
+	if cm.peerMaxPDUSize == 0 {
+		// The peer accepts PDUs of any length. Still split the data to
+		// bound the size of each write.
+		maxChunkSize = DefaultMaxPDUSize - 8
+	}
+	if maxChunkSize <= 0 {
+		return 0, fmt.Errorf("dicom.stateMachine(%s): Peer max PDU size %d is too small", cm.label, cm.peerMaxPDUSize)
+	}
+	return maxChunkSize, nil
+}
+
+// Send one fragment of DIMSE data, whose command was sent earlier with
+// dataFollows set, in a P_DATA_TF PDU. payload.data must fit in one PDU.
+func sendDIMSEDataFragment(sm *stateMachine, payload *stateEventDIMSEPayload) error {
+	// Let the sender queue the next fragment.
+	select {
+	case <-payload.window:
+	default:
+	}
+	context, err := sm.contextManager.lookupByAbstractSyntaxUID(payload.abstractSyntaxName)
+	if err != nil {
+		return fmt.Errorf("dicom.stateMachine(%s): Illegal syntax name %s: %s", sm.label, dicomuid.UIDString(payload.abstractSyntaxName), err)
+	}
+	// If sendPDU fails, it has already reported the failure.
+	sendPDU(sm, &pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+		pdu.PresentationDataValueItem{
+			ContextID: context.contextID,
+			Command:   false,
+			Last:      payload.last,
+			Value:     payload.data,
+		}}})
+	return nil
+}
+
+// Encode the DIMSE command and data in "payload" and send them in P_DATA_TF
+// PDUs. Nothing is sent if it returns an error. If payload.command is nil, it
+// sends a fragment of streamed data.
+func sendDIMSEPayload(sm *stateMachine, payload *stateEventDIMSEPayload) error {
+	if payload.command == nil {
+		return sendDIMSEDataFragment(sm, payload)
+	}
+	command := payload.command
+	e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
+	dimse.EncodeMessage(e, command)
+	if e.Error() != nil {
+		return fmt.Errorf("dicom.stateMachine(%s): Failed to encode DIMSE cmd %v: %v", sm.label, command, e.Error())
+	}
+	if !command.HasData() && (len(payload.data) > 0 || payload.dataFollows) {
+		return fmt.Errorf("dicom.stateMachine(%s): Found DIMSE data of %db, command: %v", sm.label, len(payload.data), command)
+	}
+	dicomlog.Vprintf(1, "dicom.stateMachine(%s): Send DIMSE msg: %v", sm.label, command)
+	pdus, err := splitDataIntoPDUs(sm, payload.abstractSyntaxName, true /*command*/, e.Bytes())
+	if err != nil {
+		return err
+	}
+	if command.HasData() && !payload.dataFollows {
+		dicomlog.Vprintf(1, "dicom.stateMachine(%s): Send DIMSE data of %db, command: %v", sm.label, len(payload.data), command)
+		dataPDUs, err := splitDataIntoPDUs(sm, payload.abstractSyntaxName, false /*data*/, payload.data)
+		if err != nil {
+			return err
+		}
+		pdus = append(pdus, dataPDUs...)
+	}
+	for _, pdu := range pdus {
+		if sendPDU(sm, &pdu) != nil {
+			// sendPDU has already reported the failure.
+			return nil
+		}
+	}
+	return nil
 }
 
 // Data transfer related actions
 var actionDt1 = &stateAction{"DT-1", "Send P-DATA-TF PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
 		doassert(event.dimsePayload != nil)
-		command := event.dimsePayload.command
-		doassert(command != nil)
-		e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
-		dimse.EncodeMessage(e, command)
-		if e.Error() != nil {
-			panic(fmt.Sprintf("Failed to encode DIMSE cmd %v: %v", command, e.Error()))
-		}
-		dicomlog.Vprintf(1, "dicom.stateMachine(%s): Send DIMSE msg: %v", sm.label, command)
-		pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, true /*command*/, e.Bytes())
-		for _, pdu := range pdus {
-			sendPDU(sm, &pdu)
-		}
-		if command.HasData() {
-			dicomlog.Vprintf(1, "dicom.stateMachine(%s): Send DIMSE data of %db, command: %v", sm.label, len(event.dimsePayload.data), command)
-			pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, false /*data*/, event.dimsePayload.data)
-			for _, pdu := range pdus {
-				sendPDU(sm, &pdu)
-			}
-		} else if len(event.dimsePayload.data) > 0 {
-			panic(fmt.Sprintf("dicom.stateMachine(%s): Found DIMSE data of %db, command: %v", sm.label, len(event.dimsePayload.data), command))
+		if err := sendDIMSEPayload(sm, event.dimsePayload); err != nil {
+			dicomlog.Vprintf(0, "dicom.stateMachine(%s): DT-1: %v", sm.label, err)
+			return actionAa8.Callback(sm, event)
 		}
 		return sta06
 	}}
 
 var actionDt2 = &stateAction{"DT-2", "Send P-DATA indication primitive",
 	func(sm *stateMachine, event stateEvent) stateType {
+		wasEmpty := sm.commandAssembler.Empty()
 		contextID, command, data, err := sm.commandAssembler.AddDataPDU(event.pdu.(*pdu.PDataTf))
+		if err == nil && wasEmpty && (command != nil || !sm.commandAssembler.Empty()) && sm.onMessageStart != nil {
+			sm.onMessageStart()
+		}
 		if err == nil {
 			if command != nil { // All fragments received
 				dicomlog.Vprintf(1, "dicom.stateMachine(%s): DIMSE request: %v", sm.label, command)
@@ -399,24 +639,9 @@ var actionAr6 = &stateAction{"AR-6", "Issue P-DATA indication",
 var actionAr7 = &stateAction{"AR-7", "Issue P-DATA-TF PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
 		doassert(event.dimsePayload != nil)
-		command := event.dimsePayload.command
-		doassert(command != nil)
-		e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
-		dimse.EncodeMessage(e, command)
-		if e.Error() != nil {
-			panic(fmt.Sprintf("dicom.StateMachine %s: Failed to encode DIMSE cmd %v: %v", sm.label, command, e.Error()))
-		}
-		pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, true /*command*/, e.Bytes())
-		for _, pdu := range pdus {
-			sendPDU(sm, &pdu)
-		}
-		if command.HasData() {
-			pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, false /*data*/, event.dimsePayload.data)
-			for _, pdu := range pdus {
-				sendPDU(sm, &pdu)
-			}
-		} else {
-			doassert(len(event.dimsePayload.data) == 0)
+		if err := sendDIMSEPayload(sm, event.dimsePayload); err != nil {
+			dicomlog.Vprintf(0, "dicom.stateMachine(%s): AR-7: %v", sm.label, err)
+			return actionAa8.Callback(sm, event)
 		}
 		sm.downcallCh <- stateEvent{event: evt14}
 		return sta08
@@ -462,6 +687,9 @@ var actionAa2 = &stateAction{"AA-2", "Stop ARTIM timer if running. Close transpo
 
 var actionAa3 = &stateAction{"AA-3", "If (service-user initiated abort): issue A-ABORT indication and close transport connection, otherwise (service-dul initiated abort): issue A-P-ABORT indication and close transport connection",
 	func(sm *stateMachine, event stateEvent) stateType {
+		if v, ok := event.pdu.(*pdu.AAbort); ok {
+			sm.err = &AssociationAbortedError{Source: v.Source, Reason: v.Reason}
+		}
 		closeConnection(sm)
 		return sta01
 	}}
@@ -491,6 +719,9 @@ var actionAa7 = &stateAction{"AA-7", "Send A-ABORT PDU",
 var actionAa8 = &stateAction{"AA-8", "Send A-ABORT PDU (service-dul source), issue an A-P-ABORT indication and start ARTIM timer",
 	func(sm *stateMachine, event stateEvent) stateType {
 		sendPDU(sm, &pdu.AAbort{Source: 2, Reason: 0})
+		if sm.err == nil {
+			sm.err = &AssociationAbortedError{Source: 2, Reason: 0}
+		}
 		startTimer(sm)
 		return sta13
 	}}
@@ -500,8 +731,10 @@ type upcallEventType int
 const (
 	upcallEventHandshakeCompleted = upcallEventType(100)
 	upcallEventData               = upcallEventType(101)
-	// Note: connection shutdown and any error will result in channel
-	// closure, so they don't have event types.
+	// Sent right before the channel is closed if the association was
+	// rejected or aborted. Other errors, and a normal shutdown, only result
+	// in channel closure.
+	upcallEventAssociationFailed = upcallEventType(102)
 )
 
 func (e *upcallEventType) String() string {
@@ -511,6 +744,8 @@ func (e *upcallEventType) String() string {
 		description = "Handshake completed"
 	case upcallEventData:
 		description = "P_DATA_TF PDU received"
+	case upcallEventAssociationFailed:
+		description = "Association failed"
 	default:
 		panic(fmt.Sprintf("dicom.StateMachine: Unknown event type %v", int(*e)))
 	}
@@ -537,6 +772,10 @@ type upcallEvent struct {
 
 	command dimse.Message
 	data    []byte
+
+	// The reason of the failure. Set only in upcallEventAssociationFailed
+	// event.
+	err error
 }
 
 type stateEventDIMSEPayload struct {
@@ -550,6 +789,15 @@ type stateEventDIMSEPayload struct {
 	// Ditto, but for the data payload. The data PDU is sent iff.
 	// command.HasData()==true.
 	data []byte
+
+	// If set, command.HasData() is true, but the data is streamed in the
+	// following payloads instead of "data". Each of them has a nil
+	// command, and "data" holds one P_DATA_TF fragment; "last" is set in
+	// the final one. The statemachine takes a token from "window" when it
+	// sends a fragment, which bounds the fragments queued.
+	dataFollows bool
+	last        bool
+	window      chan struct{}
 }
 
 type stateEventDebugInfo struct {
@@ -724,6 +972,9 @@ type stateMachine struct {
 	// userParams is set only for a client-side statemachine
 	userParams ServiceUserParams
 
+	// providerParams is set only for a server-side statemachine
+	providerParams ServiceProviderParams
+
 	// Manages mappings between one-byte contextID to the
 	// <abstractsyntaxUID, transfersyntaxuid> pair.  Filled during A_ACCEPT
 	// handshake.
@@ -756,24 +1007,67 @@ type stateMachine struct {
 
 	// Only for testing.
 	faults FaultInjector
+
+	// The reason the association was rejected or aborted. Reported to the
+	// upper layer when upcallCh is closed.
+	err error
+
+	// Limits the number of associations. nil if there is no limit. Set only
+	// for a server-side statemachine.
+	limiter *associationLimiter
+	// Set once the association reserves a slot in limiter. Releases the
+	// slot.
+	releaseLimit func()
+
+	// Called when the first fragment of a DIMSE message arrives, before
+	// the message is sent to upcallCh.
+	onMessageStart func()
+
+	// Timeouts copied from ServiceUserParams or ServiceProviderParams.
+	// artimTimeout is always positive.
+	artimTimeout time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
 }
 
-func closeConnection(sm *stateMachine) {
+// Close upcallCh, after reporting sm.err, if any, to the upper layer.
+func closeUpcallCh(sm *stateMachine) {
+	releaseLimit(sm)
+	if sm.err != nil {
+		sm.upcallCh <- upcallEvent{eventType: upcallEventAssociationFailed, err: sm.err}
+	}
 	close(sm.upcallCh)
+}
+
+// Release the slot reserved by checkAssociationLimits, if any.
+func releaseLimit(sm *stateMachine) {
+	if sm.releaseLimit != nil {
+		sm.releaseLimit()
+		sm.releaseLimit = nil
+	}
+}
+
+func closeConnection(sm *stateMachine) {
+	closeUpcallCh(sm)
 	dicomlog.Vprintf(1, "dicom.StateMachine %s: Closing connection %v", sm.label, sm.conn)
 	if sm.conn != nil {
 		sm.conn.Close()
 	}
 }
 
-func sendPDU(sm *stateMachine, v pdu.PDU) {
+// Send "v" to the peer. On failure, it closes the connection, reports the
+// failure to the state machine as evt17, and returns the error.
+func sendPDU(sm *stateMachine, v pdu.PDU) error {
 	doassert(sm.conn != nil)
 	data, err := pdu.EncodePDU(v)
 	if err != nil {
 		dicomlog.Vprintf(0, "dicom.StateMachine %s: Failed to encode: %v; closing connection %v", sm.label, err, sm.conn)
 		sm.conn.Close()
 		sm.errorCh <- stateEvent{event: evt17, err: err}
-		return
+		return err
+	}
+	if sm.writeTimeout > 0 {
+		sm.conn.SetWriteDeadline(time.Now().Add(sm.writeTimeout))
 	}
 	if sm.faults != nil {
 		action := sm.faults.onSend(data)
@@ -783,26 +1077,38 @@ func sendPDU(sm *stateMachine, v pdu.PDU) {
 		}
 	}
 	n, err := sm.conn.Write(data)
-	if n != len(data) || err != nil {
+	if err == nil && n != len(data) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
 		dicomlog.Vprintf(0, "dicom.StateMachine %s: Failed to write %d bytes. Actual %d bytes : %v; closing connection %v", sm.label, len(data), n, err, sm.conn)
 		sm.conn.Close()
 		sm.errorCh <- stateEvent{event: evt17, err: err}
-		return
+		return err
 	}
 	dicomlog.Vprintf(2, "dicom.StateMachine %s: sendPDU: %v", sm.label, v.String())
+	return nil
 }
 
 func startTimer(sm *stateMachine) {
 	ch := make(chan stateEvent, 1)
 	sm.timerCh = ch
 	currentState := sm.currentState
-	time.AfterFunc(time.Duration(10)*time.Second,
+	time.AfterFunc(sm.artimTimeout,
 		func() {
 			ch <- stateEvent{event: evt18, debug: &stateEventDebugInfo{currentState}}
 			close(ch)
 		})
 }
 
+// Returns the ARTIM timeout to use given the value in the params.
+func artimTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return DefaultARTIMTimeout
+	}
+	return timeout
+}
+
 func restartTimer(sm *stateMachine) {
 	startTimer(sm)
 }
@@ -811,11 +1117,40 @@ func stopTimer(sm *stateMachine) {
 	sm.timerCh = make(chan stateEvent, 1)
 }
 
-func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, smName string) {
+// timeoutReader reads PDUs from a connection. Once the first byte of a PDU
+// arrives, the rest of it must arrive within the timeout. There is no deadline
+// for the first byte, so that the association may stay idle.
+type timeoutReader struct {
+	conn    net.Conn
+	timeout time.Duration
+	started bool // True once the first byte of the current PDU arrived.
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	n, err := r.conn.Read(p)
+	if n > 0 && !r.started && r.timeout > 0 {
+		r.started = true
+		r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	}
+	return n, err
+}
+
+// Prepare for reading the next PDU.
+func (r *timeoutReader) reset() {
+	if r.started {
+		r.started = false
+		r.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, readTimeout time.Duration, smName string) {
 	dicomlog.Vprintf(2, "dicom.StateMachine %s: Starting network reader, maxPDU %d", smName, maxPDUSize)
-	doassert(maxPDUSize > 16*1024)
+	reader := &timeoutReader{conn: conn, timeout: readTimeout}
 	for {
-		v, err := pdu.ReadPDU(conn, maxPDUSize)
+		reader.reset()
+		// P3.8 D.1: the peer must not send a P-DATA-TF PDU larger
+		// than what we advertised. ReadPDU fails if it does.
+		v, err := pdu.ReadPDU(reader, maxPDUSize)
 		if err != nil {
 			dicomlog.Vprintf(0, "dicom.StateMachine %s: Failed to read PDU: %v", smName, err)
 			if err == io.EOF {
@@ -830,11 +1165,14 @@ func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, smNa
 		dicomlog.Vprintf(2, "dicom.StateMachine %s: read PDU: %v", smName, v.String())
 		switch n := v.(type) {
 		case *pdu.AAssociate:
-			if n.Type == pdu.TypeAAssociateRq {
+			switch n.Type {
+			case pdu.TypeAAssociateRq:
 				ch <- stateEvent{event: evt06, pdu: n, err: nil}
-			} else {
-				doassert(n.Type == pdu.TypeAAssociateAc)
+			case pdu.TypeAAssociateAc:
 				ch <- stateEvent{event: evt03, pdu: n, err: nil}
+			default:
+				err := fmt.Errorf("dicom.StateMachine %s: Unexpected A-ASSOCIATE type: %v", smName, n.Type)
+				ch <- stateEvent{event: evt19, pdu: nil, err: err}
 			}
 			continue
 		case *pdu.AAssociateRj:
@@ -890,7 +1228,7 @@ func getNextEvent(sm *stateMachine) stateEvent {
 		doassert(event.conn != nil)
 		sm.conn = event.conn
 	case evt17:
-		close(sm.upcallCh)
+		closeUpcallCh(sm)
 		sm.conn = nil
 	}
 	return event
@@ -935,6 +1273,7 @@ func runStateMachineForServiceUser(
 	params ServiceUserParams,
 	upcallCh chan upcallEvent,
 	downcallCh chan stateEvent,
+	onMessageStart func(),
 	label string) {
 	doassert(params.CallingAETitle != "")
 	doassert(len(params.SOPClasses) > 0)
@@ -942,13 +1281,17 @@ func runStateMachineForServiceUser(
 	sm := &stateMachine{
 		label:          label,
 		isUser:         true,
-		contextManager: newContextManager(label),
+		contextManager: newContextManager(label, advertisedMaxPDUSize(params.MaxPDUSize)),
 		userParams:     params,
 		netCh:          make(chan stateEvent, 128),
 		errorCh:        make(chan stateEvent, 128),
 		downcallCh:     downcallCh,
 		upcallCh:       upcallCh,
 		faults:         getUserFaultInjector(),
+		onMessageStart: onMessageStart,
+		artimTimeout:   artimTimeout(params.ARTIMTimeout),
+		readTimeout:    params.ReadTimeout,
+		writeTimeout:   params.WriteTimeout,
 	}
 	event := stateEvent{event: evt01}
 	action := findAction(sta01, &event, sm.label)
@@ -961,19 +1304,28 @@ func runStateMachineForServiceUser(
 
 func runStateMachineForServiceProvider(
 	conn net.Conn,
+	params ServiceProviderParams,
+	limiter *associationLimiter,
 	upcallCh chan upcallEvent,
 	downcallCh chan stateEvent,
+	onMessageStart func(),
 	label string) {
 	sm := &stateMachine{
 		label:          label,
 		isUser:         false,
-		contextManager: newContextManager(label),
+		contextManager: newContextManager(label, advertisedMaxPDUSize(params.MaxPDUSize)),
+		providerParams: params,
 		conn:           conn,
 		netCh:          make(chan stateEvent, 128),
 		errorCh:        make(chan stateEvent, 128),
 		downcallCh:     downcallCh,
 		upcallCh:       upcallCh,
 		faults:         getProviderFaultInjector(),
+		limiter:        limiter,
+		onMessageStart: onMessageStart,
+		artimTimeout:   artimTimeout(params.ARTIMTimeout),
+		readTimeout:    params.ReadTimeout,
+		writeTimeout:   params.WriteTimeout,
 	}
 	event := stateEvent{event: evt05, conn: conn}
 	action := findAction(sta01, &event, sm.label)
@@ -981,5 +1333,6 @@ func runStateMachineForServiceProvider(
 	for sm.currentState != sta01 {
 		runOneStep(sm)
 	}
+	releaseLimit(sm)
 	dicomlog.Vprintf(1, "dicom.StateMachine %s: statemachine finished", sm.label)
 }
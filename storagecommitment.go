@@ -0,0 +1,475 @@
+package netdicom
+
+// This file implements the Storage Commitment Push Model service. P3.4 J.
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomlog"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/sopclass"
+)
+
+// StorageCommitmentSOPInstanceUID is the well-known SOP instance UID used in
+// storage commitment N-ACTION and N-EVENT-REPORT requests. P3.4 J.3.5.
+const StorageCommitmentSOPInstanceUID = "1.2.840.10008.1.20.1.1"
+
+const (
+	// ActionTypeID for "Request Storage Commitment". P3.4 J.3.2.
+	storageCommitmentActionTypeID = 1
+	// EventTypeIDs for N-EVENT-REPORT. P3.4 J.3.3.
+	storageCommitmentEventTypeSuccess = 1
+	storageCommitmentEventTypeFailure = 2
+)
+
+// SOPReference identifies a SOP instance, e.g., a dataset sent using C-STORE.
+type SOPReference struct {
+	SOPClassUID    string
+	SOPInstanceUID string
+}
+
+// StorageCommitmentFailure is a SOP instance that the storage commitment SCP
+// failed to commit.
+type StorageCommitmentFailure struct {
+	SOPReference
+	// FailureReason is one of the codes listed in P3.4 J.3.3.1.2, e.g.,
+	// dimse.StatusProcessingFailure.
+	FailureReason dimse.StatusCode
+}
+
+// StorageCommitmentResult is the outcome of a storage commitment request.
+type StorageCommitmentResult struct {
+	// TransactionUID identifies the request, as returned by
+	// ServiceUser.StorageCommitment.
+	TransactionUID string
+	// Instances that the SCP took responsibility for.
+	Committed []SOPReference
+	// Instances that the SCP failed to commit.
+	Failed []StorageCommitmentFailure
+}
+
+// StorageCommitmentCallback is called by the server on a storage commitment
+// request. transactionUID identifies the request, and "refs" lists the
+// instances to be committed. The callback should return the instances it
+// stably stored, and those it failed to store. The server acknowledges the
+// request before running the callback, and reports the result to the
+// requestor using N-EVENT-REPORT once the callback returns.
+type StorageCommitmentCallback func(
+	conn ConnectionState,
+	transactionUID string,
+	refs []SOPReference) StorageCommitmentResult
+
+// StorageCommitmentReportCallback is called when a storage commitment result
+// arrives in an N-EVENT-REPORT request. It should return dimse.Success if the
+// report was processed.
+type StorageCommitmentReportCallback func(
+	conn ConnectionState,
+	result StorageCommitmentResult) dimse.Status
+
+// Create a sequence element. Each member of "items" is the list of elements
+// in one item.
+func newSequenceElement(tag dicomtag.Tag, items [][]*dicom.Element) *dicom.Element {
+	seq := &dicom.Element{Tag: tag, VR: "SQ", UndefinedLength: true}
+	for _, item := range items {
+		var values []interface{}
+		for _, elem := range item {
+			values = append(values, elem)
+		}
+		seq.Value = append(seq.Value, &dicom.Element{
+			Tag:             dicomtag.Item,
+			VR:              "NA",
+			UndefinedLength: true,
+			Value:           values})
+	}
+	return seq
+}
+
+// Extract the items of the sequence "tag". Returns an empty list if the
+// sequence is not found.
+func findSequenceItems(elems []*dicom.Element, tag dicomtag.Tag) ([][]*dicom.Element, error) {
+	seq, err := dicom.FindElementByTag(elems, tag)
+	if err != nil {
+		return nil, nil
+	}
+	var items [][]*dicom.Element
+	for _, v := range seq.Value {
+		item, ok := v.(*dicom.Element)
+		if !ok || item.Tag != dicomtag.Item {
+			return nil, fmt.Errorf("dicom.storageCommitment: Malformed item in %v: %v", tag, v)
+		}
+		var subelems []*dicom.Element
+		for _, sv := range item.Value {
+			subelem, ok := sv.(*dicom.Element)
+			if !ok {
+				return nil, fmt.Errorf("dicom.storageCommitment: Malformed element in %v: %v", tag, sv)
+			}
+			subelems = append(subelems, subelem)
+		}
+		items = append(items, subelems)
+	}
+	return items, nil
+}
+
+func findString(elems []*dicom.Element, tag dicomtag.Tag) (string, error) {
+	elem, err := dicom.FindElementByTag(elems, tag)
+	if err != nil {
+		return "", err
+	}
+	return elem.GetString()
+}
+
+func newSOPReferenceElements(ref SOPReference) []*dicom.Element {
+	return []*dicom.Element{
+		dicom.MustNewElement(dicomtag.ReferencedSOPClassUID, ref.SOPClassUID),
+		dicom.MustNewElement(dicomtag.ReferencedSOPInstanceUID, ref.SOPInstanceUID),
+	}
+}
+
+func decodeSOPReference(item []*dicom.Element) (ref SOPReference, err error) {
+	if ref.SOPClassUID, err = findString(item, dicomtag.ReferencedSOPClassUID); err != nil {
+		return ref, err
+	}
+	ref.SOPInstanceUID, err = findString(item, dicomtag.ReferencedSOPInstanceUID)
+	return ref, err
+}
+
+// Encode the N-ACTION payload. P3.4 J.3.2.1.
+func encodeStorageCommitmentRequest(transactionUID string, refs []SOPReference, transferSyntaxUID string) ([]byte, error) {
+	var items [][]*dicom.Element
+	for _, ref := range refs {
+		items = append(items, newSOPReferenceElements(ref))
+	}
+	return writeElementsToBytes([]*dicom.Element{
+		dicom.MustNewElement(dicomtag.TransactionUID, transactionUID),
+		newSequenceElement(dicomtag.ReferencedSOPSequence, items),
+	}, transferSyntaxUID)
+}
+
+// Decode the N-ACTION payload. Returns the transaction UID and the list of
+// instances to be committed.
+func decodeStorageCommitmentRequest(data []byte, transferSyntaxUID string) (string, []SOPReference, error) {
+	elems, err := readElementsInBytes(data, transferSyntaxUID)
+	if err != nil {
+		return "", nil, err
+	}
+	transactionUID, err := findString(elems, dicomtag.TransactionUID)
+	if err != nil {
+		return "", nil, err
+	}
+	items, err := findSequenceItems(elems, dicomtag.ReferencedSOPSequence)
+	if err != nil {
+		return "", nil, err
+	}
+	var refs []SOPReference
+	for _, item := range items {
+		ref, err := decodeSOPReference(item)
+		if err != nil {
+			return "", nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return transactionUID, refs, nil
+}
+
+// Encode the N-EVENT-REPORT payload. P3.4 J.3.3.1.
+func encodeStorageCommitmentResult(result StorageCommitmentResult, transferSyntaxUID string) ([]byte, error) {
+	elems := []*dicom.Element{dicom.MustNewElement(dicomtag.TransactionUID, result.TransactionUID)}
+	if len(result.Committed) > 0 {
+		var items [][]*dicom.Element
+		for _, ref := range result.Committed {
+			items = append(items, newSOPReferenceElements(ref))
+		}
+		elems = append(elems, newSequenceElement(dicomtag.ReferencedSOPSequence, items))
+	}
+	if len(result.Failed) > 0 {
+		var items [][]*dicom.Element
+		for _, f := range result.Failed {
+			items = append(items, append(newSOPReferenceElements(f.SOPReference),
+				dicom.MustNewElement(dicomtag.FailureReason, uint16(f.FailureReason))))
+		}
+		elems = append(elems, newSequenceElement(dicomtag.FailedSOPSequence, items))
+	}
+	return writeElementsToBytes(elems, transferSyntaxUID)
+}
+
+// Decode the N-EVENT-REPORT payload.
+func decodeStorageCommitmentResult(data []byte, transferSyntaxUID string) (StorageCommitmentResult, error) {
+	var result StorageCommitmentResult
+	elems, err := readElementsInBytes(data, transferSyntaxUID)
+	if err != nil {
+		return result, err
+	}
+	if result.TransactionUID, err = findString(elems, dicomtag.TransactionUID); err != nil {
+		return result, err
+	}
+	items, err := findSequenceItems(elems, dicomtag.ReferencedSOPSequence)
+	if err != nil {
+		return result, err
+	}
+	for _, item := range items {
+		ref, err := decodeSOPReference(item)
+		if err != nil {
+			return result, err
+		}
+		result.Committed = append(result.Committed, ref)
+	}
+	if items, err = findSequenceItems(elems, dicomtag.FailedSOPSequence); err != nil {
+		return result, err
+	}
+	for _, item := range items {
+		ref, err := decodeSOPReference(item)
+		if err != nil {
+			return result, err
+		}
+		failure := StorageCommitmentFailure{SOPReference: ref}
+		if elem, err := dicom.FindElementByTag(item, dicomtag.FailureReason); err == nil {
+			reason, err := elem.GetUInt16()
+			if err != nil {
+				return result, err
+			}
+			failure.FailureReason = dimse.StatusCode(reason)
+		}
+		result.Failed = append(result.Failed, failure)
+	}
+	return result, nil
+}
+
+// How long the SCP waits for the response to the N-EVENT-REPORT carrying a
+// storage commitment result, on each association it tries.
+var storageCommitmentReportTimeout = time.Minute
+
+// Send an N-EVENT-REPORT carrying "result" over an established association,
+// and wait for the response. Returns ctx.Err() if ctx expires before the
+// response arrives.
+func runStorageCommitmentReport(ctx context.Context, disp *serviceDispatcher, cm *contextManager, result StorageCommitmentResult) error {
+	if err := disp.acquireInvokeSlot(ctx); err != nil {
+		return err
+	}
+	defer disp.releaseInvokeSlot()
+	context, err := cm.lookupByAbstractSyntaxUID(sopclass.StorageCommitmentClasses[0])
+	if err != nil {
+		return err
+	}
+	payload, err := encodeStorageCommitmentResult(result, context.transferSyntaxUID)
+	if err != nil {
+		return err
+	}
+	cs, err := disp.newCommand(cm, context)
+	if err != nil {
+		return err
+	}
+	defer disp.deleteCommand(cs)
+	eventTypeID := uint16(storageCommitmentEventTypeSuccess)
+	if len(result.Failed) > 0 {
+		eventTypeID = storageCommitmentEventTypeFailure
+	}
+	cs.sendMessage(&dimse.NEventReportRq{
+		AffectedSOPClassUID:    context.abstractSyntaxUID,
+		MessageID:              cs.messageID,
+		CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
+		AffectedSOPInstanceUID: StorageCommitmentSOPInstanceUID,
+		EventTypeID:            eventTypeID,
+	}, payload)
+	var event upcallEvent
+	var ok bool
+	select {
+	case event, ok = <-cs.upcallCh:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if !ok {
+		return fmt.Errorf("Connection closed while waiting for N-EVENT-REPORT response")
+	}
+	resp, ok := event.command.(*dimse.NEventReportRsp)
+	if !ok {
+		return fmt.Errorf("Found wrong response for N-EVENT-REPORT: %v", event.command)
+	}
+	if resp.Status.Status != dimse.StatusSuccess {
+		return &DIMSEError{Op: "N-EVENT-REPORT", Status: resp.Status}
+	}
+	return nil
+}
+
+// Send an N-EVENT-REPORT on a new association to the AE "aeTitle", for when the
+// requestor has released the original association. The SCP is the association
+// requestor, so it proposes the SCP role. P3.4 J.3.3.
+func runStorageCommitmentReportOnNewAssociation(ctx context.Context, params ServiceProviderParams, aeTitle string, result StorageCommitmentResult) error {
+	hostPort, ok := params.RemoteAEs[aeTitle]
+	if !ok {
+		return fmt.Errorf("dicom.storageCommitment: Unknown AE %v; add it to ServiceProviderParams.RemoteAEs", aeTitle)
+	}
+	su, err := NewServiceUser(ServiceUserParams{
+		CalledAETitle:     aeTitle,
+		CallingAETitle:    params.AETitle,
+		SOPClasses:        sopclass.StorageCommitmentClasses,
+		SCPRoleSOPClasses: sopclass.StorageCommitmentClasses,
+		TLSConfig:         params.RemoteTLSConfig})
+	if err != nil {
+		return err
+	}
+	defer su.Release()
+	su.Connect(hostPort)
+	if err := su.waitUntilReady(ctx, "N-EVENT-REPORT"); err != nil {
+		return err
+	}
+	return runStorageCommitmentReport(ctx, su.disp, su.cm, result)
+}
+
+// Handle an N-ACTION request on the storage commitment SCP side.
+func handleNAction(
+	params ServiceProviderParams,
+	connState ConnectionState,
+	c *dimse.NActionRq, data []byte,
+	cs *serviceCommandState) {
+	status := dimse.Success
+	var transactionUID string
+	var refs []SOPReference
+	switch {
+	case c.RequestedSOPClassUID != sopclass.StorageCommitmentClasses[0]:
+		status = dimse.Status{
+			Status:       dimse.StatusNoSuchSOPClass,
+			ErrorComment: fmt.Sprintf("N-ACTION not supported for %v", c.RequestedSOPClassUID),
+		}
+	case c.ActionTypeID != storageCommitmentActionTypeID:
+		status = dimse.Status{Status: dimse.StatusNoSuchActionType}
+	case params.StorageCommitment == nil:
+		status = dimse.Status{
+			Status:       dimse.StatusUnrecognizedOperation,
+			ErrorComment: "No callback found for storage commitment",
+		}
+	default:
+		var err error
+		transactionUID, refs, err = decodeStorageCommitmentRequest(data, cs.context.transferSyntaxUID)
+		if err != nil {
+			status = dimse.Status{
+				Status:       dimse.StatusProcessingFailure,
+				ErrorComment: err.Error(),
+			}
+		}
+	}
+	cs.sendMessage(&dimse.NActionRsp{
+		AffectedSOPClassUID:       c.RequestedSOPClassUID,
+		MessageIDBeingRespondedTo: c.MessageID,
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		AffectedSOPInstanceUID:    c.RequestedSOPInstanceUID,
+		ActionTypeID:              c.ActionTypeID,
+		Status:                    status,
+	}, nil)
+	if status.Status != dimse.StatusSuccess {
+		return
+	}
+	result := params.StorageCommitment(connState, transactionUID, refs)
+	result.TransactionUID = transactionUID
+	ctx, cancel := context.WithTimeout(context.Background(), storageCommitmentReportTimeout)
+	err := runStorageCommitmentReport(ctx, cs.disp, cs.cm, result)
+	cancel()
+	if err != nil {
+		dicomlog.Vprintf(0, "dicom.serviceProvider: Failed to send storage commitment report on the original association: %v; trying a new association", err)
+		ctx, cancel = context.WithTimeout(context.Background(), storageCommitmentReportTimeout)
+		err = runStorageCommitmentReportOnNewAssociation(ctx, params, connState.CallingAETitle, result)
+		cancel()
+	}
+	if err != nil {
+		dicomlog.Vprintf(0, "dicom.serviceProvider: Failed to send storage commitment report %v: %v", transactionUID, err)
+	}
+}
+
+// Handle an N-EVENT-REPORT request carrying a storage commitment result. Used
+// both by the ServiceUser and the ServiceProvider.
+func handleNEventReport(
+	cb StorageCommitmentReportCallback,
+	connState ConnectionState,
+	c *dimse.NEventReportRq, data []byte,
+	cs *serviceCommandState) {
+	status := dimse.Success
+	switch {
+	case c.AffectedSOPClassUID != sopclass.StorageCommitmentClasses[0]:
+		status = dimse.Status{
+			Status:       dimse.StatusNoSuchSOPClass,
+			ErrorComment: fmt.Sprintf("N-EVENT-REPORT not supported for %v", c.AffectedSOPClassUID),
+		}
+	case c.EventTypeID != storageCommitmentEventTypeSuccess && c.EventTypeID != storageCommitmentEventTypeFailure:
+		status = dimse.Status{Status: dimse.StatusNoSuchEventType}
+	case cb == nil:
+		status = dimse.Status{
+			Status:       dimse.StatusUnrecognizedOperation,
+			ErrorComment: "No callback found for storage commitment report",
+		}
+	default:
+		result, err := decodeStorageCommitmentResult(data, cs.context.transferSyntaxUID)
+		if err != nil {
+			status = dimse.Status{
+				Status:       dimse.StatusProcessingFailure,
+				ErrorComment: err.Error(),
+			}
+		} else {
+			status = cb(connState, result)
+		}
+	}
+	cs.sendMessage(&dimse.NEventReportRsp{
+		AffectedSOPClassUID:       c.AffectedSOPClassUID,
+		MessageIDBeingRespondedTo: c.MessageID,
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		AffectedSOPInstanceUID:    c.AffectedSOPInstanceUID,
+		EventTypeID:               c.EventTypeID,
+		Status:                    status,
+	}, nil)
+}
+
+// StorageCommitment asks the peer to take responsibility for the SOP instances
+// listed in "refs", using the Storage Commitment Push Model. It returns the
+// transaction UID that identifies the request once the peer acknowledges it.
+//
+// The result arrives later in an N-EVENT-REPORT. If the peer sends it on this
+// association, it is passed to ServiceUserParams.StorageCommitmentReport. The
+// peer may also send it on a new association after this one is released, in
+// which case ServiceProviderParams.StorageCommitmentReport of a local server is
+// called.
+//
+// ServiceUserParams.SOPClasses must include sopclass.StorageCommitmentClasses.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) StorageCommitment(refs []SOPReference) (string, error) {
+	err := su.startOp(context.Background(), "N-ACTION")
+	if err != nil {
+		return "", err
+	}
+	defer su.finishOp()
+	context, err := su.cm.lookupByAbstractSyntaxUID(sopclass.StorageCommitmentClasses[0])
+	if err != nil {
+		return "", err
+	}
+	transactionUID := newDICOMUID()
+	payload, err := encodeStorageCommitmentRequest(transactionUID, refs, context.transferSyntaxUID)
+	if err != nil {
+		return "", err
+	}
+	cs, err := su.disp.newCommand(su.cm, context)
+	if err != nil {
+		return "", err
+	}
+	defer su.disp.deleteCommand(cs)
+	cs.sendMessage(&dimse.NActionRq{
+		RequestedSOPClassUID:    context.abstractSyntaxUID,
+		MessageID:               cs.messageID,
+		CommandDataSetType:      dimse.CommandDataSetTypeNonNull,
+		RequestedSOPInstanceUID: StorageCommitmentSOPInstanceUID,
+		ActionTypeID:            storageCommitmentActionTypeID,
+	}, payload)
+	event, ok := <-cs.upcallCh
+	if !ok {
+		return "", su.closedError("N-ACTION")
+	}
+	resp, ok := event.command.(*dimse.NActionRsp)
+	if !ok {
+		return "", fmt.Errorf("Found wrong response for N-ACTION: %v", event.command)
+	}
+	if resp.Status.Status != dimse.StatusSuccess {
+		return "", &DIMSEError{Op: "N-ACTION", Status: resp.Status}
+	}
+	return transactionUID, nil
+}
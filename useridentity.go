@@ -0,0 +1,66 @@
+package netdicom
+
+// This file implements User Identity negotiation. P3.7 D.3.3.7.
+
+import (
+	"fmt"
+
+	"github.com/grailbio/go-netdicom/pdu"
+)
+
+// UserIdentity holds the credentials that a client presents in an
+// A-ASSOCIATE-RQ.
+type UserIdentity struct {
+	Type pdu.UserIdentityType
+	// PrimaryField is the username, Kerberos service ticket, SAML
+	// assertion, or JSON web token, depending on Type.
+	PrimaryField []byte
+	// SecondaryField is the passcode. It is used only when Type is
+	// pdu.UserIdentityUsernamePasscode.
+	SecondaryField []byte
+	// PositiveResponseRequested asks the server to confirm the identity in
+	// the A-ASSOCIATE-AC.
+	PositiveResponseRequested bool
+}
+
+// NewUsernamePasscodeIdentity creates a UserIdentity of type
+// pdu.UserIdentityUsernamePasscode.
+func NewUsernamePasscodeIdentity(username, passcode string) *UserIdentity {
+	return &UserIdentity{
+		Type:           pdu.UserIdentityUsernamePasscode,
+		PrimaryField:   []byte(username),
+		SecondaryField: []byte(passcode),
+	}
+}
+
+// Reports an error if the identity doesn't fit in an A-ASSOCIATE-RQ.
+func (id *UserIdentity) validate() error {
+	if n := len(id.PrimaryField) + len(id.SecondaryField); n > pdu.MaxUserIdentityLength {
+		return fmt.Errorf("UserIdentity too long: %d bytes; the limit is %d", n, pdu.MaxUserIdentityLength)
+	}
+	return nil
+}
+
+// AuthenticateCallback is called by the server when an A-ASSOCIATE-RQ
+// arrives. req.UserIdentity is the identity presented by the client, or nil if
+// the client didn't present one. Returning a non-nil error rejects the
+// association. Otherwise, the identity is accepted, and it is reported in
+// ConnectionState.UserIdentity to the DIMSE callbacks.
+//
+// If the client requested a positive response, serverResponse is sent back in
+// the A-ASSOCIATE-AC. It is the Kerberos server ticket, SAML response, or JSON
+// web token, depending on the identity type; it should be nil for the username
+// types.
+type AuthenticateCallback func(req *AssociationRequest) (serverResponse []byte, err error)
+
+// UserIdentityResponse returns the server response to
+// ServiceUserParams.UserIdentity. It returns nil if the server didn't confirm
+// the identity, or the A-ASSOCIATE handshake hasn't finished.
+func (su *ServiceUser) UserIdentityResponse() []byte {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	if su.cm == nil {
+		return nil
+	}
+	return su.cm.userIdentityResponse
+}
@@ -1,7 +1,9 @@
 package netdicom
 
 import (
+	"crypto/rand"
 	"fmt"
+	"math/big"
 	"sync/atomic"
 )
 
@@ -11,6 +13,15 @@ func newUID(prefix string) string {
 	return fmt.Sprintf("%s-%d", prefix, atomic.AddInt32(&idSeq, 1))
 }
 
+// Generate a globally unique DICOM UID, derived from a random UUID. P3.5 B.2.
+func newDICOMUID() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return "2.25." + new(big.Int).SetBytes(buf[:]).String()
+}
+
 func doassert(cond bool, values ...interface{}) {
 	if !cond {
 		var s string
@@ -20,3 +31,13 @@ func doassert(cond bool, values ...interface{}) {
 		panic(s)
 	}
 }
+
+// Returns true iff "list" contains "s".
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}